@@ -0,0 +1,663 @@
+package zns
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"regexp/syntax"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/dghubble/trie"
+	"github.com/miekg/dns"
+)
+
+// blockRule matches a domain and, unless exact, all its subdomains. Rules
+// with glob match the subdomains of domain whose leading labels match the
+// glob, in which * matches any characters. Rules with pattern match names
+// by the regular expression.
+type blockRule struct {
+	domain  string
+	allow   bool
+	exact   bool
+	glob    string
+	pattern string
+}
+
+// ruleSet is an immutable set of block and allow rules.
+type ruleSet struct {
+	block *ruleMatcher
+	allow *ruleMatcher
+}
+
+// newRuleSet creates the rule set. Rules failed to compile are skipped and
+// returned in the error.
+func newRuleSet(rules ...[]blockRule) (*ruleSet, error) {
+	var block, allow []blockRule
+	for _, rs := range rules {
+		for _, r := range rs {
+			if r.allow {
+				allow = append(allow, r)
+			} else {
+				block = append(block, r)
+			}
+		}
+	}
+	b, berr := newRuleMatcher(block)
+	a, aerr := newRuleMatcher(allow)
+	return &ruleSet{block: b, allow: a}, errors.Join(berr, aerr)
+}
+
+// Match reports whether name is blocked and whether it is explicitly allowed.
+func (s *ruleSet) Match(name string) (blocked, allowed bool) {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	path := domainPath(name)
+	return s.block.match(name, path), s.allow.match(name, path)
+}
+
+// ruleNode is the trie value of one domain.
+type ruleNode struct {
+	exact bool // matches the domain only
+	sub   bool // matches the domain and its subdomains
+	globs []blockRule
+}
+
+// ruleMatcher uses the trie of domains as a prefilter, and wildcard rules
+// are stored at the node of their literal suffix. Regular expressions are
+// combined into head if anchored at the beginning, otherwise into re. The
+// combined ones are split if too large to compile.
+type ruleMatcher struct {
+	trie trie.Trier
+	head []*regexp.Regexp
+	re   []*regexp.Regexp
+}
+
+func newRuleMatcher(rules []blockRule) (*ruleMatcher, error) {
+	m := &ruleMatcher{trie: trie.NewPathTrie()}
+	var heads, patterns []string
+	for _, r := range rules {
+		if r.pattern != "" {
+			if h, ok := trimBeginText(r.pattern); ok {
+				heads = append(heads, h)
+			} else {
+				patterns = append(patterns, r.pattern)
+			}
+			continue
+		}
+		path := domainPath(r.domain)
+		n, _ := m.trie.Get(path).(*ruleNode)
+		if n == nil {
+			n = &ruleNode{}
+			m.trie.Put(path, n)
+		}
+		switch {
+		case r.glob != "":
+			n.globs = append(n.globs, r)
+		case r.exact:
+			n.exact = true
+		default:
+			n.sub = true
+		}
+	}
+	// 锚定开头后只需从第一个字符开始匹配，比逐个位置尝试快得多
+	var herrs, errs []error
+	m.head, herrs = compileRegexps("^", heads)
+	m.re, errs = compileRegexps("", patterns)
+	return m, errors.Join(append(herrs, errs...)...)
+}
+
+// compileRegexps combines patterns into as few regular expressions as
+// possible, each of them prefixed by prefix. Patterns are split into halves
+// if the combined one is too large, and the ones failed alone are returned
+// as errors.
+func compileRegexps(prefix string, patterns []string) (res []*regexp.Regexp, errs []error) {
+	if len(patterns) == 0 {
+		return nil, nil
+	}
+	re, err := regexp.Compile(prefix + "(?:(?:" + strings.Join(patterns, ")|(?:") + "))")
+	if err == nil {
+		return []*regexp.Regexp{re}, nil
+	}
+	if len(patterns) == 1 {
+		return nil, []error{fmt.Errorf("/%s/: %w", patterns[0], err)}
+	}
+	i := len(patterns) / 2
+	res, errs = compileRegexps(prefix, patterns[:i])
+	more, merrs := compileRegexps(prefix, patterns[i:])
+	return append(res, more...), append(errs, merrs...)
+}
+
+// regexpSize returns the number of instructions of the compiled pattern,
+// which is the cost of compiling and matching it.
+func regexpSize(pattern string) int {
+	re, err := syntax.Parse(pattern, syntax.Perl)
+	if err != nil {
+		return 0
+	}
+	p, err := syntax.Compile(re.Simplify())
+	if err != nil {
+		return 0
+	}
+	return len(p.Inst)
+}
+
+// trimBeginText removes the leading ^ of pattern like ^ads\..
+func trimBeginText(pattern string) (string, bool) {
+	re, err := syntax.Parse(pattern, syntax.Perl)
+	if err != nil || re.Op != syntax.OpConcat || re.Sub[0].Op != syntax.OpBeginText {
+		return "", false
+	}
+	re.Sub = re.Sub[1:]
+	return re.String(), true
+}
+
+// errMatched stops walking the trie.
+var errMatched = errors.New("matched")
+
+// match reports whether the lower case name with its trie path matches.
+func (m *ruleMatcher) match(name, path string) bool {
+	err := m.trie.WalkPath(path, func(key string, value any) error {
+		n, ok := value.(*ruleNode)
+		if !ok {
+			return nil
+		}
+		if n.sub || (n.exact && key == path) {
+			return errMatched
+		}
+		// 路径与域名等长，由此得到后缀之前的标签
+		if len(n.globs) == 0 || len(key) >= len(name) {
+			return nil
+		}
+		labels := name[:len(name)-len(key)-1]
+		for _, g := range n.globs {
+			if matchLabels(g.glob, labels, g.exact) {
+				return errMatched
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return true
+	}
+	for _, re := range m.head {
+		if re.MatchString(name) {
+			return true
+		}
+	}
+	for _, re := range m.re {
+		if re.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchLabels reports whether glob matches the labels, or any of its
+// trailing labels unless exact.
+func matchLabels(glob, labels string, exact bool) bool {
+	for {
+		if matchGlob(glob, labels) {
+			return true
+		}
+		i := strings.IndexByte(labels, '.')
+		if exact || i < 0 {
+			return false
+		}
+		labels = labels[i+1:]
+	}
+}
+
+// matchGlob reports whether s matches glob, in which * matches any
+// characters.
+func matchGlob(glob, s string) bool {
+	gi, si := 0, 0
+	star, next := -1, 0
+	for si < len(s) {
+		switch {
+		case gi < len(glob) && glob[gi] == '*':
+			star, next = gi, si
+			gi++
+		case gi < len(glob) && glob[gi] == s[si]:
+			gi++
+			si++
+		case star >= 0:
+			gi = star + 1
+			next++
+			si = next
+		default:
+			return false
+		}
+	}
+	for gi < len(glob) && glob[gi] == '*' {
+		gi++
+	}
+	return gi == len(glob)
+}
+
+// domainPath converts www.example.com to com/example/www.
+func domainPath(name string) string {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	labels := strings.Split(name, ".")
+	slices.Reverse(labels)
+	return strings.Join(labels, "/")
+}
+
+var blocklistClient = &http.Client{Timeout: 30 * time.Second}
+
+// blockSets holds the rules of each list.
+type blockSets struct {
+	names []string
+	lists map[string]*ruleSet
+}
+
+// Blocklist loads rules from local files or URLs and swaps them atomically
+// on reload. Supported formats are hosts files, AdGuard/ABP (||domain^,
+// |exact.domain^, ||ads*.domain^, /regexp/ and @@ exceptions), dnsmasq
+// (address=/domain/ and server=/domain/) and plain domains, one rule per
+// line.
+//
+// Each source may be named like ads=https://example.org/ads.txt, otherwise
+// the source itself is the name.
+type Blocklist struct {
+	Sources []string
+
+	sets atomic.Pointer[blockSets]
+
+	sourceSet[[]blockRule]
+}
+
+// NewBlocklist creates a Blocklist and loads all the sources.
+func NewBlocklist(sources []string) (*Blocklist, error) {
+	b := &Blocklist{Sources: sources}
+	return b, b.Reload()
+}
+
+// Blocked reports whether name matches any block rule and no exception.
+func (b *Blocklist) Blocked(name string) bool {
+	_, blocked := b.LookupAll(name)
+	return blocked
+}
+
+// LookupAll returns the first list blocking name. An exception in any list
+// overrides the block rules of others.
+func (b *Blocklist) LookupAll(name string) (list string, blocked bool) {
+	s := b.sets.Load()
+	if s == nil {
+		return
+	}
+	return s.lookup(name, s.names)
+}
+
+// Lookup is like LookupAll but only the named lists are used.
+func (b *Blocklist) Lookup(name string, lists []string) (list string, blocked bool) {
+	s := b.sets.Load()
+	if s == nil {
+		return
+	}
+	return s.lookup(name, lists)
+}
+
+func (s *blockSets) lookup(name string, lists []string) (list string, blocked bool) {
+	for _, l := range lists {
+		rs := s.lists[l]
+		if rs == nil {
+			continue
+		}
+		bl, al := rs.Match(name)
+		if al {
+			return "", false
+		}
+		if bl && !blocked {
+			list, blocked = l, true
+		}
+	}
+	return
+}
+
+// Has reports whether there is a list with the name.
+func (b *Blocklist) Has(name string) bool {
+	s := b.sets.Load()
+	return s != nil && s.lists[name] != nil
+}
+
+// Reload loads all the sources again.
+func (b *Blocklist) Reload() error {
+	return b.reload(b.Sources, true, loadRules, func(lists [][]blockRule, stats []ListStat) error {
+		var errs []error
+		sets := &blockSets{lists: map[string]*ruleSet{}}
+		for i, rules := range lists {
+			st := &stats[i]
+			set, err := newRuleSet(rules)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", st.Source, err))
+				st.Err = strings.TrimPrefix(st.Err+"; "+err.Error(), "; ")
+			}
+			st.Rules = len(rules)
+			sets.names = append(sets.names, st.Name)
+			sets.lists[st.Name] = set
+		}
+		b.sets.Store(sets)
+		return errors.Join(errs...)
+	})
+}
+
+// Watch reloads the sources every d until stop is closed. It returns
+// immediately if d is not positive.
+func (b *Blocklist) Watch(d time.Duration, stop <-chan struct{}) {
+	watch(d, stop, b.Reload)
+}
+
+func loadRules(src string) (rules []blockRule, errs []string, err error) {
+	r, err := openSource(src)
+	if err != nil {
+		return
+	}
+	defer r.Close()
+
+	rules, errs = parseRules(r)
+	return
+}
+
+// openSource opens the local file or URL.
+func openSource(src string) (io.ReadCloser, error) {
+	if !strings.HasPrefix(src, "http://") && !strings.HasPrefix(src, "https://") {
+		return os.Open(src)
+	}
+	resp, err := blocklistClient.Get(src)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, errors.New(resp.Status)
+	}
+	return resp.Body, nil
+}
+
+// parseRules parses rules of all supported formats. Malformed lines are
+// skipped and reported.
+func parseRules(r io.Reader) (rules []blockRule, errs []string) {
+	s := bufio.NewScanner(r)
+	for i := 1; s.Scan(); i++ {
+		rs, err := parseRule(s.Text())
+		if err != nil {
+			if len(errs) < maxParseErrors {
+				errs = append(errs, fmt.Sprintf("line %d: %v", i, err))
+			}
+			continue
+		}
+		rules = append(rules, rs...)
+	}
+	if err := s.Err(); err != nil {
+		errs = append(errs, err.Error())
+	}
+	return
+}
+
+func parseRule(line string) ([]blockRule, error) {
+	line = strings.TrimSpace(line)
+	if line == "" || line[0] == '#' || line[0] == '!' || line[0] == '[' {
+		return nil, nil
+	}
+	// 元素隐藏规则与 DNS 无关
+	if strings.Contains(line, "##") || strings.Contains(line, "#@#") {
+		return nil, nil
+	}
+
+	switch {
+	case isRegexpRule(line):
+		r, err := regexpRule(line[1 : len(line)-1])
+		return []blockRule{r}, err
+	case strings.HasPrefix(line, "||") || strings.HasPrefix(line, "|") || strings.HasPrefix(line, "@@"):
+		return parseAdblockRule(line)
+	case strings.HasPrefix(line, "address=/") ||
+		strings.HasPrefix(line, "server=/") ||
+		strings.HasPrefix(line, "local=/"):
+		return parseDnsmasqRule(line)
+	}
+
+	if i := strings.IndexByte(line, '#'); i > 0 {
+		line = strings.TrimSpace(line[:i])
+	}
+
+	fields := strings.Fields(line)
+	switch len(fields) {
+	case 1:
+		// plain domain, or mosdns style domain:example.com
+		d := fields[0]
+		if k, v, ok := strings.Cut(d, ":"); ok {
+			switch k {
+			case "domain", "full":
+				if !isDomain(v) {
+					return nil, errors.New("invalid domain")
+				}
+				return []blockRule{{domain: v, exact: k == "full"}}, nil
+			case "regexp":
+				r, err := regexpRule(v)
+				return []blockRule{r}, err
+			case "keyword":
+				r, err := regexpRule(regexp.QuoteMeta(strings.ToLower(v)))
+				return []blockRule{r}, err
+			}
+		}
+		if strings.Contains(d, "*") {
+			r, err := wildcardRule(d, false)
+			return []blockRule{r}, err
+		}
+		if !isDomain(d) {
+			return nil, errors.New("invalid domain")
+		}
+		return []blockRule{{domain: d}}, nil
+	default:
+		// hosts: 0.0.0.0 a.example b.example
+		if net.ParseIP(fields[0]) == nil {
+			return nil, errors.New("invalid hosts entry")
+		}
+		var rules []blockRule
+		for _, d := range fields[1:] {
+			if d == "localhost" || d == "localhost.localdomain" ||
+				d == "local" || d == "broadcasthost" || d == "0.0.0.0" {
+				continue
+			}
+			if !isDomain(d) {
+				return nil, errors.New("invalid domain")
+			}
+			rules = append(rules, blockRule{domain: d, exact: true})
+		}
+		return rules, nil
+	}
+}
+
+// parseAdblockRule parses ||example.com^ and @@||example.com^ rules. Rules
+// with unsupported modifiers are rejected.
+func parseAdblockRule(line string) ([]blockRule, error) {
+	var r blockRule
+	if s, ok := strings.CutPrefix(line, "@@"); ok {
+		r.allow = true
+		line = s
+	}
+
+	line, mods, _ := strings.Cut(line, "$")
+	for _, m := range strings.Split(mods, ",") {
+		if m != "" && m != "important" {
+			return nil, fmt.Errorf("unsupported modifier %q", m)
+		}
+	}
+
+	if s, ok := strings.CutPrefix(line, "||"); ok {
+		line = s
+	} else if s, ok := strings.CutPrefix(line, "|"); ok {
+		r.exact = true
+		line = s
+	}
+	line = strings.TrimSuffix(line, "|")
+	line = strings.TrimSuffix(line, "^")
+
+	if isRegexpRule(line) {
+		rr, err := regexpRule(line[1 : len(line)-1])
+		rr.allow = r.allow
+		return []blockRule{rr}, err
+	}
+	if strings.Contains(line, "*") {
+		rr, err := wildcardRule(line, r.exact)
+		rr.allow = r.allow
+		return []blockRule{rr}, err
+	}
+	if !isDomain(line) {
+		return nil, errors.New("invalid domain")
+	}
+	r.domain = line
+	return []blockRule{r}, nil
+}
+
+// parseDnsmasqRule parses address=/a.example/b.example/0.0.0.0 rules.
+// Rules with a real address or upstream are not blocking rules.
+func parseDnsmasqRule(line string) ([]blockRule, error) {
+	directive, v, _ := strings.Cut(line, "=/")
+	parts := strings.Split(v, "/")
+	if len(parts) < 2 {
+		return nil, errors.New("invalid dnsmasq rule")
+	}
+	domains, target := parts[:len(parts)-1], parts[len(parts)-1]
+	switch directive {
+	case "address":
+		// # 表示 0.0.0.0 和 ::
+		switch target {
+		case "", "#", "0.0.0.0", "::":
+		default:
+			return nil, nil
+		}
+	default:
+		// server 和 local 的 # 表示使用默认上游，只有留空才是只在本地解析
+		if target != "" {
+			return nil, nil
+		}
+	}
+
+	var rules []blockRule
+	for _, d := range domains {
+		if !isDomain(d) {
+			return nil, errors.New("invalid domain")
+		}
+		rules = append(rules, blockRule{domain: d})
+	}
+	return rules, nil
+}
+
+func isRegexpRule(s string) bool {
+	return len(s) > 2 && s[0] == '/' && s[len(s)-1] == '/'
+}
+
+// regexpRule parses the regular expression matching names in lower case
+// without the trailing dot.
+func regexpRule(pattern string) (blockRule, error) {
+	if _, err := regexp.Compile(pattern); err != nil {
+		return blockRule{}, err
+	}
+	return blockRule{pattern: pattern}, nil
+}
+
+// wildcardRule converts rules like ads*.example.com, in which * matches any
+// characters, to patterns under the literal suffix example.com.
+func wildcardRule(s string, exact bool) (blockRule, error) {
+	s = strings.ToLower(strings.TrimSuffix(s, "."))
+	if !isDomain(strings.ReplaceAll(s, "*", "a")) {
+		return blockRule{}, errors.New("invalid wildcard")
+	}
+
+	r := blockRule{exact: exact}
+	tail := s[strings.LastIndexByte(s, '*'):]
+	if i := strings.IndexByte(tail, '.'); i >= 0 {
+		r.domain = tail[i+1:]
+		r.glob = s[:len(s)-len(r.domain)-1]
+		return r, nil
+	}
+
+	// 没有字面后缀的只能用正则匹配
+	p := strings.ReplaceAll(regexp.QuoteMeta(s), `\*`, `.*`)
+	if exact {
+		r.pattern = "^" + p + "$"
+	} else {
+		r.pattern = `^(?:.*\.)?` + p + "$"
+	}
+	return r, nil
+}
+
+func isDomain(s string) bool {
+	s = strings.TrimSuffix(s, ".")
+	if s == "" || len(s) > 253 || net.ParseIP(s) != nil {
+		return false
+	}
+	_, ok := dns.IsDomainName(s)
+	return ok && !strings.ContainsAny(s, "*/|^$@ ")
+}
+
+// BlockMode is how blocked queries are answered. Queries are answered with
+// the addresses if set, otherwise with Rcode and no records.
+type BlockMode struct {
+	Rcode int
+	A     net.IP
+	AAAA  net.IP
+}
+
+// blockTTL is the TTL of synthesized answers of blocked queries.
+const blockTTL = 60
+
+// ParseBlockMode parses nxdomain, nodata, refused, null (0.0.0.0 and ::) or
+// sinkhole addresses like 10.0.0.1,fd00::1.
+func ParseBlockMode(s string) (*BlockMode, error) {
+	switch strings.ToLower(s) {
+	case "", "nxdomain":
+		return &BlockMode{Rcode: dns.RcodeNameError}, nil
+	case "nodata":
+		return &BlockMode{Rcode: dns.RcodeSuccess}, nil
+	case "refused":
+		return &BlockMode{Rcode: dns.RcodeRefused}, nil
+	case "null":
+		return &BlockMode{A: net.IPv4zero, AAAA: net.IPv6unspecified}, nil
+	}
+
+	var b BlockMode
+	for _, a := range strings.Split(s, ",") {
+		ip := net.ParseIP(strings.TrimSpace(a))
+		if ip == nil {
+			return nil, fmt.Errorf("invalid block mode %q", s)
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			b.A = ip4
+		} else {
+			b.AAAA = ip
+		}
+	}
+	return &b, nil
+}
+
+// Answer builds the answer of the blocked query with an Extended DNS Error
+// telling which list matched.
+func (b *BlockMode) Answer(q *dns.Msg, code uint16, list string) *dns.Msg {
+	a := new(dns.Msg)
+	a.SetReply(q)
+	a.RecursionAvailable = true
+	a.Rcode = b.Rcode
+
+	qs := q.Question[0]
+	hdr := dns.RR_Header{Name: qs.Name, Class: dns.ClassINET, Ttl: blockTTL}
+	switch {
+	case qs.Qtype == dns.TypeA && b.A != nil:
+		hdr.Rrtype = dns.TypeA
+		a.Answer = []dns.RR{&dns.A{Hdr: hdr, A: b.A}}
+	case qs.Qtype == dns.TypeAAAA && b.AAAA != nil:
+		hdr.Rrtype = dns.TypeAAAA
+		a.Answer = []dns.RR{&dns.AAAA{Hdr: hdr, AAAA: b.AAAA}}
+	}
+
+	setEDE(a, code, "blocked by "+list)
+	return a
+}
@@ -0,0 +1,281 @@
+package zns
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/dghubble/trie"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRules(t *testing.T) {
+	rules, errs := parseRules(strings.NewReader(`
+! adblock
+||ads.example.com^
+@@||good.ads.example.com^
+||track.example.org^$important
+||bad.example^$third-party
+example.com##.banner
+# hosts
+0.0.0.0 hosts.example.com www.hosts.example.com
+127.0.0.1 localhost
+# dnsmasq
+address=/dnsmasq.example/
+address=/real.example/1.2.3.4
+address=/hash.example/#
+server=/local.example/
+server=/upstream.example/#
+server=/upstream.example/10.0.0.1
+# plain
+zeus.ad.xiaomi.com
+domain:mosdns.example
+not a domain
+`))
+
+	assert.Equal(t, []blockRule{
+		{domain: "ads.example.com"},
+		{domain: "good.ads.example.com", allow: true},
+		{domain: "track.example.org"},
+		{domain: "hosts.example.com", exact: true},
+		{domain: "www.hosts.example.com", exact: true},
+		{domain: "dnsmasq.example"},
+		{domain: "hash.example"},
+		{domain: "local.example"},
+		{domain: "zeus.ad.xiaomi.com"},
+		{domain: "mosdns.example"},
+	}, rules)
+	assert.Equal(t, 2, len(errs))
+	assert.True(t, strings.HasPrefix(errs[0], "line 6:"))
+}
+
+func TestRuleSet(t *testing.T) {
+	rules, errs := parseRules(strings.NewReader(`
+||ads*.example.com^
+*.wild.example
+|exact.example^
+full:full.example
+/^track[0-9]+\./
+@@/^track0\./
+keyword:doubleclick
+||*banner*^
+regexp:^ad[sv]\.
+/(?!x)/
+`))
+	assert.Equal(t, 1, len(errs))
+
+	s, err := newRuleSet(rules)
+	assert.Nil(t, err)
+	blocked := func(name string) bool {
+		b, a := s.Match(name)
+		return b && !a
+	}
+
+	assert.True(t, blocked("ads1.example.com."))
+	assert.True(t, blocked("x.ads.cdn.example.com"))
+	assert.False(t, blocked("example.com"))
+	assert.False(t, blocked("bads.example.com"))
+	assert.True(t, blocked("a.wild.example"))
+	assert.True(t, blocked("a.b.wild.example"))
+	assert.False(t, blocked("wild.example"))
+	assert.True(t, blocked("exact.example"))
+	assert.False(t, blocked("www.exact.example"))
+	assert.True(t, blocked("full.example"))
+	assert.False(t, blocked("www.full.example"))
+	assert.True(t, blocked("Track12.example.org"))
+	assert.False(t, blocked("track0.example.org"))
+	assert.False(t, blocked("tracker.example.org"))
+	assert.True(t, blocked("stats.g.doubleclick.net"))
+	assert.True(t, blocked("adv.example.net"))
+	assert.True(t, blocked("x.topbanner1.example.net"))
+}
+
+func TestRuleSetSplit(t *testing.T) {
+	var rules []blockRule
+	for i := range 10 {
+		rules = append(rules, blockRule{pattern: fmt.Sprintf(`(?:^|\.)ad%d\.`, i)})
+	}
+	// 无法编译的规则，和合并后超过大小限制一样导致整体编译失败
+	rules = append(rules, blockRule{pattern: "a{1,1000}{1,1000}"})
+
+	// 合并失败时拆开编译，单独也无法编译的规则被跳过
+	s, err := newRuleSet(rules)
+	assert.NotNil(t, err)
+	assert.True(t, len(s.block.re) > 1)
+	b, _ := s.Match("ad9.example")
+	assert.True(t, b)
+	b, _ = s.Match("ad10.example")
+	assert.False(t, b)
+}
+
+func TestMatchGlob(t *testing.T) {
+	assert.True(t, matchGlob("ads*", "ads"))
+	assert.True(t, matchGlob("a*b*c", "aXXbYbc"))
+	assert.False(t, matchGlob("a*b*c", "aXXbYbcd"))
+	assert.True(t, matchLabels("ads*", "x.ads1", false))
+	assert.False(t, matchLabels("ads*", "x.ads1", true))
+	assert.False(t, matchLabels("ads*", "bads", false))
+}
+
+func TestBlocklist(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "hosts")
+	os.WriteFile(file, []byte("0.0.0.0 hosts.example.com\n"), 0644)
+
+	list := "||zeus.ad.xiaomi.com^\n@@||ok.zeus.ad.xiaomi.com^\n"
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if list == "" {
+			http.Error(w, "gone", http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(list))
+	}))
+	defer s.Close()
+
+	b, err := NewBlocklist([]string{file, s.URL})
+	assert.Nil(t, err)
+
+	assert.True(t, b.Blocked("zeus.ad.xiaomi.com."))
+	assert.True(t, b.Blocked("a.ZEUS.ad.xiaomi.com"))
+	assert.False(t, b.Blocked("zeus.xiaomi.com"))
+	assert.False(t, b.Blocked("ok.zeus.ad.xiaomi.com"))
+	assert.True(t, b.Blocked("hosts.example.com"))
+	assert.False(t, b.Blocked("www.hosts.example.com"))
+
+	stats := b.Stats()
+	assert.Equal(t, 1, stats[0].Rules)
+	assert.Equal(t, 2, stats[1].Rules)
+
+	// the failed list keeps its rules
+	os.WriteFile(file, []byte("www.hosts.example.com\n"), 0644)
+	list = ""
+	assert.NotNil(t, b.Reload())
+	assert.False(t, b.Blocked("hosts.example.com"))
+	assert.True(t, b.Blocked("www.hosts.example.com"))
+	assert.True(t, b.Blocked("zeus.ad.xiaomi.com"))
+	assert.NotEqual(t, "", b.Stats()[1].Err)
+
+	// 重新加载间隔为 0 时不启动定时器
+	b.Watch(0, nil)
+}
+
+func TestBlockMode(t *testing.T) {
+	q := new(dns.Msg)
+	q.SetQuestion("ads.example.", dns.TypeA)
+
+	b, err := ParseBlockMode("nxdomain")
+	assert.Nil(t, err)
+	a := b.Answer(q, dns.ExtendedErrorCodeBlocked, "ads")
+	assert.Equal(t, dns.RcodeNameError, a.Rcode)
+	assert.Equal(t, 0, len(a.Answer))
+	es := edes(a)
+	assert.Equal(t, 1, len(es))
+	assert.Equal(t, dns.ExtendedErrorCodeBlocked, es[0].InfoCode)
+	assert.Equal(t, "blocked by ads", es[0].ExtraText)
+
+	b, _ = ParseBlockMode("refused")
+	assert.Equal(t, dns.RcodeRefused, b.Answer(q, dns.ExtendedErrorCodeFiltered, "custom").Rcode)
+
+	b, _ = ParseBlockMode("null")
+	a = b.Answer(q, dns.ExtendedErrorCodeBlocked, "ads")
+	assert.Equal(t, "0.0.0.0", a.Answer[0].(*dns.A).A.String())
+
+	b, err = ParseBlockMode("10.0.0.1")
+	assert.Nil(t, err)
+	a = b.Answer(q, dns.ExtendedErrorCodeBlocked, "ads")
+	assert.Equal(t, "10.0.0.1", a.Answer[0].(*dns.A).A.String())
+	q.SetQuestion("ads.example.", dns.TypeAAAA)
+	a = b.Answer(q, dns.ExtendedErrorCodeBlocked, "ads")
+	assert.Equal(t, dns.RcodeSuccess, a.Rcode)
+	assert.Equal(t, 0, len(a.Answer))
+
+	_, err = ParseBlockMode("blackhole")
+	assert.NotNil(t, err)
+}
+
+// legacyTrie is the lookup used before regex and wildcard rules.
+type legacyTrie struct {
+	t trie.Trier
+}
+
+func newLegacyTrie(domains []string) legacyTrie {
+	t := trie.NewPathTrie()
+	for _, d := range domains {
+		labels := strings.Split(d, ".")
+		slices.Reverse(labels)
+		t.Put(strings.Join(labels, "/"), struct{}{})
+	}
+	return legacyTrie{t: t}
+}
+
+func (l legacyTrie) isBlackDomain(name string) (black bool) {
+	labels := strings.Split(name, ".")
+	slices.Reverse(labels)
+	path := strings.Join(labels, "/")
+	l.t.WalkPath(path, func(key string, value any) error {
+		if value != nil {
+			black = true
+		}
+		return nil
+	})
+	return
+}
+
+func benchDomains(n int) (domains, names []string) {
+	for i := range n {
+		domains = append(domains, fmt.Sprintf("ad%d.tracker%d.com", i, i%100))
+		names = append(names, fmt.Sprintf("www.ad%d.tracker%d.com", i*7%n, i%100))
+		names = append(names, fmt.Sprintf("www.site%d.example.org", i))
+	}
+	return
+}
+
+func BenchmarkLookupLegacy(b *testing.B) {
+	domains, names := benchDomains(50000)
+	l := newLegacyTrie(domains)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		l.isBlackDomain(names[i%len(names)])
+	}
+}
+
+func BenchmarkLookupDomain(b *testing.B) {
+	domains, names := benchDomains(50000)
+	var rules []blockRule
+	for _, d := range domains {
+		rules = append(rules, blockRule{domain: d})
+	}
+	s, _ := newRuleSet(rules)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s.Match(names[i%len(names)])
+	}
+}
+
+func BenchmarkLookupPattern(b *testing.B) {
+	domains, names := benchDomains(50000)
+	var rules []blockRule
+	for i, d := range domains {
+		if i%100 == 0 {
+			r, _ := wildcardRule("ad*"+strings.TrimPrefix(d, "ad"), false)
+			rules = append(rules, r)
+		} else {
+			rules = append(rules, blockRule{domain: d})
+		}
+	}
+	for i := range 50 {
+		r, _ := regexpRule(fmt.Sprintf(`^track%d[0-9]+\.`, i))
+		rules = append(rules, r)
+	}
+	s, _ := newRuleSet(rules)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s.Match(names[i%len(names)])
+	}
+}
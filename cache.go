@@ -0,0 +1,340 @@
+package zns
+
+import (
+	"container/list"
+	"hash/maphash"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	cacheShards = 32
+	// 最长缓存一天，防止上游返回过大的 TTL
+	cacheMaxTTL = 24 * 60 * 60
+	// 过期应答的 TTL，见 RFC 8767 第 4 节
+	staleTTL = 30
+)
+
+// Cache is a sharded LRU cache of DNS answers.
+type Cache struct {
+	// Stale is how long expired answers are kept for serving stale.
+	Stale time.Duration
+	// PrefetchHits is the number of hits before an answer is refreshed in
+	// background shortly before it expires. Zero disables prefetch.
+	PrefetchHits int
+
+	seed   maphash.Seed
+	shards [cacheShards]cacheShard
+
+	hits   atomic.Uint64
+	misses atomic.Uint64
+}
+
+type cacheShard struct {
+	mu    sync.Mutex
+	size  int
+	items map[string]*list.Element
+	lru   *list.List
+}
+
+type cacheItem struct {
+	key    string
+	msg    []byte
+	ttl    uint32
+	stored time.Time
+
+	hits     int
+	prefetch bool
+	// ECS scope of the answer, whose subnet option is not stored
+	scope uint8
+}
+
+// NewCache creates a cache holding at most size answers.
+func NewCache(size int) *Cache {
+	c := &Cache{seed: maphash.MakeSeed()}
+	n := size / cacheShards
+	if n == 0 {
+		n = 1
+	}
+	for i := range c.shards {
+		c.shards[i].size = n
+		c.shards[i].items = make(map[string]*list.Element, n)
+		c.shards[i].lru = list.New()
+	}
+	return c
+}
+
+func (c *Cache) shard(key string) *cacheShard {
+	i := maphash.String(c.seed, key) % cacheShards
+	return &c.shards[i]
+}
+
+// Hits returns the number of answers served from cache.
+func (c *Cache) Hits() uint64 { return c.hits.Load() }
+
+// Misses returns the number of lookups not found in cache.
+func (c *Cache) Misses() uint64 { return c.misses.Load() }
+
+// Get returns a copy of the cached answer for q with TTLs decremented by its age.
+//
+// It returns nil if there is no fresh answer. prefetch reports whether the
+// caller should refresh the answer because it is popular and about to expire.
+func (c *Cache) Get(q *dns.Msg) (m *dns.Msg, age uint32, prefetch bool) {
+	m, age, prefetch = c.lookup(q, false)
+	if m == nil {
+		c.misses.Add(1)
+		return
+	}
+	c.hits.Add(1)
+	return
+}
+
+// GetStale returns an expired answer for q with TTL set to 30 seconds.
+func (c *Cache) GetStale(q *dns.Msg) *dns.Msg {
+	m, _, _ := c.lookup(q, true)
+	return m
+}
+
+func (c *Cache) lookup(q *dns.Msg, stale bool) (m *dns.Msg, age uint32, prefetch bool) {
+	do := q.IsEdns0() != nil && q.IsEdns0().Do()
+	// 与子网无关的应答优先
+	var scope uint8
+	m, age, prefetch, scope = c.get(cacheKey(q.Question[0], do, netip.Prefix{}), stale)
+	if m == nil {
+		if p := ecsPrefix(q, false); p.IsValid() {
+			m, age, prefetch, scope = c.get(cacheKey(q.Question[0], do, p), stale)
+		}
+	}
+	if m != nil {
+		m.Id = q.Id
+		replyECS(m, q, scope)
+	}
+	return
+}
+
+func (c *Cache) get(key string, stale bool) (*dns.Msg, uint32, bool, uint8) {
+	s := c.shard(key)
+
+	s.mu.Lock()
+	e, ok := s.items[key]
+	if !ok {
+		s.mu.Unlock()
+		return nil, 0, false, 0
+	}
+	it := e.Value.(*cacheItem)
+	age := time.Since(it.stored)
+	ttl := time.Duration(it.ttl) * time.Second
+	if age >= ttl+c.Stale {
+		s.lru.Remove(e)
+		delete(s.items, key)
+		s.mu.Unlock()
+		return nil, 0, false, 0
+	}
+	if (age < ttl) == stale {
+		s.mu.Unlock()
+		return nil, 0, false, 0
+	}
+	s.lru.MoveToFront(e)
+
+	var prefetch bool
+	if !stale {
+		it.hits++
+		if c.PrefetchHits > 0 && it.hits >= c.PrefetchHits &&
+			!it.prefetch && (ttl-age)*10 < ttl {
+			it.prefetch = true
+			prefetch = true
+		}
+	}
+	s.mu.Unlock()
+
+	m := new(dns.Msg)
+	if err := m.Unpack(it.msg); err != nil {
+		return nil, 0, false, 0
+	}
+	secs := uint32(age / time.Second)
+	if stale {
+		setTTL(m, staleTTL)
+	} else {
+		decTTL(m, secs)
+	}
+	return m, secs, prefetch, it.scope
+}
+
+// Set stores the answer a of q if it is cacheable.
+//
+// Answers with a non-zero ECS scope are only shared within the client subnet.
+func (c *Cache) Set(q, a *dns.Msg) {
+	ttl, ok := cacheTTL(a)
+	if !ok || ttl == 0 {
+		return
+	}
+
+	var p netip.Prefix
+	var scope uint8
+	if s := ecsPrefix(a, true); s.IsValid() && s.Bits() > 0 {
+		p, scope = ecsPrefix(q, false), uint8(s.Bits())
+	}
+	do := q.IsEdns0() != nil && q.IsEdns0().Do()
+	key := cacheKey(q.Question[0], do, p)
+
+	// 上游回显的是首个客户端的子网，不能存下来回放给其他客户端
+	a = a.Copy()
+	replyECS(a, nil, 0)
+	b, err := a.Pack()
+	if err != nil {
+		return
+	}
+
+	it := &cacheItem{key: key, msg: b, ttl: ttl, stored: time.Now(), scope: scope}
+
+	s := c.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if e, ok := s.items[key]; ok {
+		e.Value = it
+		s.lru.MoveToFront(e)
+		return
+	}
+
+	s.items[key] = s.lru.PushFront(it)
+	for s.lru.Len() > s.size {
+		e := s.lru.Back()
+		s.lru.Remove(e)
+		delete(s.items, e.Value.(*cacheItem).key)
+	}
+}
+
+// cacheKey builds the key from question, DO bit and the ECS scope.
+func cacheKey(q dns.Question, do bool, ecs netip.Prefix) string {
+	var b strings.Builder
+	b.WriteString(strings.ToLower(q.Name))
+	b.WriteByte('/')
+	b.WriteString(strconv.Itoa(int(q.Qtype)))
+	b.WriteByte('/')
+	b.WriteString(strconv.Itoa(int(q.Qclass)))
+	if do {
+		b.WriteString("/do")
+	}
+	if ecs.IsValid() && ecs.Bits() > 0 {
+		b.WriteByte('/')
+		b.WriteString(ecs.String())
+	}
+	return b.String()
+}
+
+// cacheTTL returns how long m can be cached.
+//
+// Negative answers are cached with the SOA minimum, see RFC 2308 section 5.
+func cacheTTL(m *dns.Msg) (ttl uint32, ok bool) {
+	if m.Truncated {
+		return
+	}
+
+	switch m.Rcode {
+	case dns.RcodeSuccess:
+		if len(m.Answer) > 0 {
+			ttl = cacheMaxTTL
+			for _, rr := range m.Answer {
+				ttl = min(ttl, rr.Header().Ttl)
+			}
+			return ttl, true
+		}
+		fallthrough
+	case dns.RcodeNameError:
+		for _, rr := range m.Ns {
+			if soa, ok := rr.(*dns.SOA); ok {
+				return min(soa.Hdr.Ttl, soa.Minttl, cacheMaxTTL), true
+			}
+		}
+	}
+	return
+}
+
+func setTTL(m *dns.Msg, ttl uint32) {
+	for _, rrs := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range rrs {
+			if h := rr.Header(); h.Rrtype != dns.TypeOPT {
+				h.Ttl = ttl
+			}
+		}
+	}
+}
+
+func decTTL(m *dns.Msg, d uint32) {
+	for _, rrs := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range rrs {
+			h := rr.Header()
+			if h.Rrtype == dns.TypeOPT {
+				continue
+			}
+			if h.Ttl > d {
+				h.Ttl -= d
+			} else {
+				h.Ttl = 0
+			}
+		}
+	}
+}
+
+// replyECS replaces the client subnet option of the answer m by the one of
+// the query q with the scope netmask, see RFC 7871 section 7.2.1. The option
+// is removed if q is nil or carries none.
+func replyECS(m, q *dns.Msg, scope uint8) {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return
+	}
+	opts := opt.Option[:0]
+	for _, o := range opt.Option {
+		if _, ok := o.(*dns.EDNS0_SUBNET); !ok {
+			opts = append(opts, o)
+		}
+	}
+	opt.Option = opts
+
+	if q == nil || q.IsEdns0() == nil {
+		return
+	}
+	for _, o := range q.IsEdns0().Option {
+		if e, ok := o.(*dns.EDNS0_SUBNET); ok {
+			e := *e
+			e.SourceScope = scope
+			opt.Option = append(opt.Option, &e)
+			return
+		}
+	}
+}
+
+// ecsPrefix returns the client subnet carried by m.
+//
+// If scope is true, the prefix is truncated to the scope netmask of the answer.
+func ecsPrefix(m *dns.Msg, scope bool) (p netip.Prefix) {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return
+	}
+	for _, o := range opt.Option {
+		e, ok := o.(*dns.EDNS0_SUBNET)
+		if !ok {
+			continue
+		}
+		addr, ok := netip.AddrFromSlice(e.Address)
+		if !ok {
+			return
+		}
+		bits := int(e.SourceNetmask)
+		if scope {
+			bits = int(e.SourceScope)
+		}
+		p, _ = addr.Unmap().Prefix(bits)
+		return
+	}
+	return
+}
@@ -0,0 +1,202 @@
+package zns
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCache(t *testing.T) {
+	c := NewCache(100)
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+
+	m, _, _ := c.Get(q)
+	assert.Nil(t, m)
+
+	a := new(dns.Msg)
+	a.SetReply(q)
+	rr, _ := dns.NewRR("example.com. 300 IN A 1.2.3.4")
+	a.Answer = []dns.RR{rr}
+	c.Set(q, a)
+
+	q.Id = 42
+	m, _, _ = c.Get(q)
+	assert.NotNil(t, m)
+	assert.Equal(t, uint16(42), m.Id)
+	assert.Equal(t, uint32(300), m.Answer[0].Header().Ttl)
+
+	// answers are keyed on DO bit
+	q.SetEdns0(dns.DefaultMsgSize, true)
+	m, _, _ = c.Get(q)
+	assert.Nil(t, m)
+
+	assert.Equal(t, uint64(1), c.Hits())
+	assert.Equal(t, uint64(2), c.Misses())
+}
+
+func TestCacheExpire(t *testing.T) {
+	c := NewCache(100)
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+
+	a := new(dns.Msg)
+	a.SetReply(q)
+	rr, _ := dns.NewRR("example.com. 300 IN A 1.2.3.4")
+	a.Answer = []dns.RR{rr}
+	c.Set(q, a)
+
+	key := cacheKey(q.Question[0], false, ecsPrefix(q, false))
+	s := c.shard(key)
+	s.items[key].Value.(*cacheItem).stored = time.Now().Add(-100 * time.Second)
+
+	m, age, _ := c.Get(q)
+	assert.NotNil(t, m)
+	assert.Equal(t, uint32(100), age)
+	assert.Equal(t, uint32(200), m.Answer[0].Header().Ttl)
+
+	s.items[key].Value.(*cacheItem).stored = time.Now().Add(-300 * time.Second)
+	m, _, _ = c.Get(q)
+	assert.Nil(t, m)
+	assert.Nil(t, c.GetStale(q))
+}
+
+func TestCacheStale(t *testing.T) {
+	c := NewCache(100)
+	c.Stale = time.Hour
+	c.PrefetchHits = 2
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+
+	a := new(dns.Msg)
+	a.SetReply(q)
+	rr, _ := dns.NewRR("example.com. 300 IN A 1.2.3.4")
+	a.Answer = []dns.RR{rr}
+	c.Set(q, a)
+
+	assert.Nil(t, c.GetStale(q))
+
+	key := cacheKey(q.Question[0], false, ecsPrefix(q, false))
+	it := c.shard(key).items[key].Value.(*cacheItem)
+	it.stored = time.Now().Add(-290 * time.Second)
+
+	m, _, prefetch := c.Get(q)
+	assert.NotNil(t, m)
+	assert.False(t, prefetch)
+	m, _, prefetch = c.Get(q)
+	assert.NotNil(t, m)
+	assert.True(t, prefetch)
+	m, _, prefetch = c.Get(q)
+	assert.NotNil(t, m)
+	assert.False(t, prefetch, "only prefetch once")
+
+	it.stored = time.Now().Add(-time.Hour)
+	m, _, _ = c.Get(q)
+	assert.Nil(t, m)
+
+	m = c.GetStale(q)
+	assert.NotNil(t, m)
+	assert.Equal(t, uint32(30), m.Answer[0].Header().Ttl)
+}
+
+func TestCacheNegative(t *testing.T) {
+	c := NewCache(100)
+
+	q := new(dns.Msg)
+	q.SetQuestion("nx.example.com.", dns.TypeA)
+
+	a := new(dns.Msg)
+	a.SetRcode(q, dns.RcodeNameError)
+	c.Set(q, a)
+	m, _, _ := c.Get(q)
+	assert.Nil(t, m, "no SOA, no negative caching")
+
+	soa, _ := dns.NewRR("example.com. 3600 IN SOA ns. admin. 1 7200 3600 86400 60")
+	a.Ns = []dns.RR{soa}
+	c.Set(q, a)
+
+	ttl, ok := cacheTTL(a)
+	assert.True(t, ok)
+	assert.Equal(t, uint32(60), ttl)
+
+	m, _, _ = c.Get(q)
+	assert.NotNil(t, m)
+	assert.Equal(t, dns.RcodeNameError, m.Rcode)
+}
+
+func TestCacheSubnet(t *testing.T) {
+	c := NewCache(100)
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	q.SetEdns0(dns.DefaultMsgSize, false)
+	ecs := &dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		Family:        1,
+		SourceNetmask: 24,
+		Address:       net.IPv4(1, 2, 3, 0),
+	}
+	q.IsEdns0().Option = []dns.EDNS0{ecs}
+
+	a := q.Copy()
+	a.Response = true
+	rr, _ := dns.NewRR("example.com. 300 IN A 1.2.3.4")
+	a.Answer = []dns.RR{rr}
+	a.IsEdns0().Option = []dns.EDNS0{&dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		Family:        1,
+		SourceNetmask: 24,
+		SourceScope:   24,
+		Address:       net.IPv4(1, 2, 3, 0),
+	}}
+	c.Set(q, a)
+
+	m, _, _ := c.Get(q)
+	assert.NotNil(t, m)
+
+	ecs.Address = net.IPv4(5, 6, 7, 0)
+	m, _, _ = c.Get(q)
+	assert.Nil(t, m)
+}
+
+func TestCacheSharedSubnet(t *testing.T) {
+	c := NewCache(100)
+
+	subnet := func(ip net.IP) *dns.EDNS0_SUBNET {
+		return &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 24, Address: ip}
+	}
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	q.SetEdns0(dns.DefaultMsgSize, false)
+	q.IsEdns0().Option = []dns.EDNS0{subnet(net.IPv4(1, 2, 3, 0))}
+
+	// 作用域为 0 的应答所有客户端共用
+	a := new(dns.Msg)
+	a.SetReply(q)
+	a.SetEdns0(dns.DefaultMsgSize, false)
+	a.IsEdns0().Option = []dns.EDNS0{subnet(net.IPv4(1, 2, 3, 0))}
+	rr, _ := dns.NewRR("example.com. 300 IN A 1.2.3.4")
+	a.Answer = []dns.RR{rr}
+	c.Set(q, a)
+
+	// 其他子网的客户端只能看到自己的子网
+	q.IsEdns0().Option = []dns.EDNS0{subnet(net.IPv4(5, 6, 7, 0))}
+	m, _, _ := c.Get(q)
+	assert.NotNil(t, m)
+	assert.Equal(t, "5.6.7.0/24", ecsPrefix(m, false).String())
+	assert.Equal(t, 1, len(m.IsEdns0().Option))
+	assert.Equal(t, uint8(0), m.IsEdns0().Option[0].(*dns.EDNS0_SUBNET).SourceScope)
+
+	// 不带子网的查询得到的应答也不带子网
+	q.IsEdns0().Option = nil
+	m, _, _ = c.Get(q)
+	assert.NotNil(t, m)
+	assert.Empty(t, m.IsEdns0().Option)
+}
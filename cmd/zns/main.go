@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
 	"crypto/tls"
 	"flag"
 	"fmt"
@@ -8,9 +10,13 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
 	"github.com/quic-go/quic-go/http3"
 	"github.com/taoso/zns"
 	"golang.org/x/crypto/acme/autocert"
@@ -19,14 +25,42 @@ import (
 var tlsCert string
 var tlsKey string
 var tlsHosts string
-var h12, h3, dot string
-var upstream string
+var h12, h3, dot, doq string
+var dnsAddr string
+var dnsClients string
+var upstream, strategy string
 var dbPath string
 var price int
 var free bool
 var root string
+var cacheSize int
+var cacheFree bool
+var odohKey string
+var odohProxy bool
+var dnssec bool
+var cacheStale time.Duration
+var cachePrefetch int
+var blocklist string
+var blocklistReload time.Duration
+var blockMode string
+var rpz string
+var local string
+var forward string
+var dns64, dns64Exclude, dns64Listeners string
+var ecsMode string
+var ecsBits4, ecsBits6 int
+var rateGlobal, rateIP, ratePlans string
+var rateBits4, rateBits6 int
+var trustedProxies string
+var queryLog string
+var queryLogSize, queryLogBackups int
+var queryLogAnonymize bool
+var queryLogRetention time.Duration
+var dnstapOut, dnstapIdentity string
+var adminAddr string
+var usageRollup, usageRetention time.Duration
 
-func listen() (lnH12, lnDot net.Listener, lnH3 net.PacketConn, err error) {
+func listen() (lnH12, lnDot net.Listener, lnH3, lnDoQ net.PacketConn, err error) {
 	if h12 != "" {
 		lnH12, err = net.Listen("tcp", h12)
 		if err != nil {
@@ -41,6 +75,12 @@ func listen() (lnH12, lnDot net.Listener, lnH3 net.PacketConn, err error) {
 	}
 	if h3 != "" {
 		lnH3, err = net.ListenPacket("udp", h3)
+		if err != nil {
+			return
+		}
+	}
+	if doq != "" {
+		lnDoQ, err = net.ListenPacket("udp", doq)
 	}
 	return
 }
@@ -92,6 +132,21 @@ func (l *certLoader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, err
 	return l.cert, nil
 }
 
+func loadSeed(path string) []byte {
+	seed, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		seed = make([]byte, 32)
+		if _, err = rand.Read(seed); err != nil {
+			panic(err)
+		}
+		err = os.WriteFile(path, seed, 0600)
+	}
+	if err != nil {
+		panic(err)
+	}
+	return seed
+}
+
 func main() {
 	flag.StringVar(&tlsCert, "tls-cert", "", "File path of TLS certificate")
 	flag.StringVar(&tlsKey, "tls-key", "", "File path of TLS key")
@@ -99,10 +154,49 @@ func main() {
 	flag.StringVar(&h12, "h12", ":443", "Listen address for http1 and h2")
 	flag.StringVar(&h3, "h3", ":443", "Listen address for h3")
 	flag.StringVar(&dot, "dot", ":853", "Listen address for DoT")
-	flag.StringVar(&upstream, "upstream", "https://doh.pub/dns-query", "DoH upstream URL")
+	flag.StringVar(&doq, "doq", "", "Listen address for DoQ")
+	flag.StringVar(&dnsAddr, "dns", "", "Listen address for plain DNS over UDP and TCP")
+	flag.StringVar(&dnsClients, "dns-clients", "", "Trusted networks of plain DNS, like 192.168.1.0/24=token,fd00::/8=token")
+	flag.StringVar(&upstream, "upstream", "https://doh.pub/dns-query", "Upstream URLs separated by comma, schemes: udp, tcp, tls, quic, https")
+	flag.StringVar(&strategy, "strategy", zns.StrategyFailover, "Upstream selection strategy: failover, roundrobin, latency or race")
 	flag.StringVar(&dbPath, "db", "", "File path of Sqlite database")
 	flag.StringVar(&root, "root", ".", "Root path of static files")
+	flag.StringVar(&odohKey, "odoh-key", "", "File path of ODoH key seed, generated if not exists")
+	flag.BoolVar(&odohProxy, "odoh-proxy", false, "Whether act as ODoH proxy")
+	flag.BoolVar(&dnssec, "dnssec", false, "Whether validate answers with DNSSEC")
+	flag.StringVar(&blocklist, "blocklist", "", "Blocklist files or URLs separated by comma, used by queries with noad")
+	flag.DurationVar(&blocklistReload, "blocklist-reload", 24*time.Hour, "Blocklist, RPZ, local data and forwarding rules reload interval, 0 disables it, also reloaded on SIGHUP")
+	flag.StringVar(&forward, "forward", "", "Conditional forwarding rule files or URLs separated by comma")
+	flag.StringVar(&ecsMode, "ecs", zns.ECSSynthesize, "EDNS Client Subnet policy: synthesize, forward or strip")
+	flag.IntVar(&ecsBits4, "ecs-bits4", 24, "Max IPv4 prefix length of EDNS Client Subnet")
+	flag.IntVar(&ecsBits6, "ecs-bits6", 48, "Max IPv6 prefix length of EDNS Client Subnet")
+	flag.StringVar(&rateGlobal, "rate-global", "", "Global query rate limit like 1000/2000, queries per second and burst")
+	flag.StringVar(&rateIP, "rate-ip", "", "Query rate limit of each client network like 20/50")
+	flag.IntVar(&rateBits4, "rate-ip-bits4", 32, "IPv4 prefix length of client networks limited by rate-ip")
+	flag.IntVar(&rateBits6, "rate-ip-bits6", 56, "IPv6 prefix length of client networks limited by rate-ip")
+	flag.StringVar(&trustedProxies, "trusted-proxies", "", "Peers allowed to set the client address by the zns-real-addr header like 10.0.0.0/8,::1")
+	flag.StringVar(&ratePlans, "rate-token", "", "Query rate limits of tokens by ticket total bytes like 0=10/20,1073741824=50/100")
+	flag.StringVar(&queryLog, "querylog", "", "Query log sinks separated by comma: stdout, sqlite or file paths")
+	flag.IntVar(&queryLogSize, "querylog-size", 100, "Max MB of query log files before rotation")
+	flag.IntVar(&queryLogBackups, "querylog-backups", 5, "Number of rotated query log files kept")
+	flag.BoolVar(&queryLogAnonymize, "querylog-anonymize", false, "Mask client addresses in query logs to /24 and /48")
+	flag.DurationVar(&queryLogRetention, "querylog-retention", 30*24*time.Hour, "Age of query logs deleted from sqlite, 0 to keep")
+	flag.StringVar(&dnstapOut, "dnstap", "", "Dnstap output, a Unix socket like unix:/var/run/dnstap.sock or a file path")
+	flag.StringVar(&dnstapIdentity, "dnstap-identity", "", "Server identity in dnstap frames, hostname by default")
+	flag.DurationVar(&usageRollup, "usage-rollup", 7*24*time.Hour, "Age of hourly usage merged into daily usage, 0 to keep")
+	flag.DurationVar(&usageRetention, "usage-retention", 365*24*time.Hour, "Age of usage deleted, 0 to keep")
+	flag.StringVar(&adminAddr, "admin", "", "Listen address for admin endpoints like /metrics, keep it private")
+	flag.StringVar(&dns64, "dns64", "", "NAT64 prefix like "+zns.DefaultDNS64Prefix+" to enable DNS64 for tokens and queries with dns64")
+	flag.StringVar(&dns64Exclude, "dns64-exclude", "", "Address ranges excluded by DNS64 separated by comma")
+	flag.StringVar(&dns64Listeners, "dns64-listeners", "", "Listeners using DNS64 for all queries separated by comma: dns, dot, doq")
+	flag.StringVar(&local, "local", "", "Local zone files or hosts files separated by comma")
+	flag.StringVar(&rpz, "rpz", "", "Response policy zone files or URLs separated by comma")
+	flag.StringVar(&blockMode, "block-mode", "nxdomain", "Answer of blocked queries: nxdomain, nodata, refused, null or sinkhole addresses like 10.0.0.1,fd00::1")
 	flag.IntVar(&price, "price", 1024, "Traffic price MB/Yuan")
+	flag.IntVar(&cacheSize, "cache", 0, "Max number of cached answers, 0 to disable")
+	flag.BoolVar(&cacheFree, "cache-free", false, "Do not charge for cached answers")
+	flag.DurationVar(&cacheStale, "cache-stale", 24*time.Hour, "How long expired answers are served when upstream fails")
+	flag.IntVar(&cachePrefetch, "cache-prefetch", 3, "Hits before an answer is refreshed ahead of expiry, 0 to disable")
 	flag.BoolVar(&free, "free", false, `Whether allow free access.
 If not free, you should set the following environment variables:
 	- ALIPAY_APP_ID
@@ -129,7 +223,7 @@ If not free, you should set the following environment variables:
 		tlsCfg.GetCertificate = l.GetCertificate
 	}
 
-	lnH12, lnDot, lnH3, err := listen()
+	lnH12, lnDot, lnH3, lnDoQ, err := listen()
 	if err != nil {
 		panic(err)
 	}
@@ -147,16 +241,211 @@ If not free, you should set the following environment variables:
 		)
 	}
 
-	h := &zns.Handler{Upstream: upstream, Repo: repo, Root: http.Dir(root)}
+	ups, err := zns.NewUpstreams(strings.Split(upstream, ","), strategy)
+	if err != nil {
+		panic(err)
+	}
+	go ups.Probe(1 * time.Minute)
+
+	h := &zns.Handler{Upstream: ups, Repo: repo, Root: http.Dir(root)}
+	if dnssec {
+		h.Validator = zns.NewValidator(h.Exchange)
+	}
+	if cacheSize > 0 {
+		h.Cache = zns.NewCache(cacheSize)
+		h.Cache.Stale = cacheStale
+		h.Cache.PrefetchHits = cachePrefetch
+		h.CacheFree = cacheFree
+	}
+	// 退出前写完缓冲的查询日志、dnstap 和用量
+	var closers []func()
+	if h.BlockMode, err = zns.ParseBlockMode(blockMode); err != nil {
+		panic(err)
+	}
+	if h.ECS, err = zns.NewECSPolicy(ecsMode, ecsBits4, ecsBits6); err != nil {
+		panic(err)
+	}
+	if rateGlobal != "" || rateIP != "" || ratePlans != "" {
+		rl := &zns.RateLimiter{Bits4: rateBits4, Bits6: rateBits6}
+		if rl.Global, err = zns.ParseLimit(rateGlobal); err != nil {
+			panic(err)
+		}
+		if rl.IP, err = zns.ParseLimit(rateIP); err != nil {
+			panic(err)
+		}
+		if rl.Plans, err = zns.ParseRatePlans(ratePlans); err != nil {
+			panic(err)
+		}
+		h.RateLimit = rl
+	}
+	if queryLog != "" {
+		var sinks []zns.QueryLogSink
+		for _, s := range strings.Split(queryLog, ",") {
+			switch s {
+			case "":
+			case "stdout":
+				sinks = append(sinks, zns.JSONSink{W: os.Stdout})
+			case "sqlite":
+				sink, ok := repo.(zns.QueryLogSink)
+				if !ok {
+					panic("sqlite query log needs the db option")
+				}
+				sinks = append(sinks, sink)
+			default:
+				sinks = append(sinks, &zns.FileSink{Path: s, MaxSize: int64(queryLogSize) << 20, MaxBackups: queryLogBackups})
+			}
+		}
+		h.QueryLog = zns.NewQueryLogger(sinks...)
+		h.QueryLog.Anonymize = queryLogAnonymize
+		h.QueryLog.Retention = queryLogRetention
+		closers = append(closers, h.QueryLog.Close)
+	}
+	if dnstapOut != "" {
+		if h.Dnstap, err = zns.NewDnstap(dnstapOut); err != nil {
+			panic(err)
+		}
+		if dnstapIdentity == "" {
+			dnstapIdentity, _ = os.Hostname()
+		}
+		h.Dnstap.Identity = dnstapIdentity
+		closers = append(closers, h.Dnstap.Close)
+	}
+	if dns64 != "" {
+		if h.DNS64, err = zns.NewDNS64(dns64, strings.Split(dns64Exclude, ",")); err != nil {
+			panic(err)
+		}
+		h.DNS64.Listeners = strings.Split(dns64Listeners, ",")
+	}
+	// 收到 SIGHUP 时重新加载拦截列表、RPZ、本地数据和转发规则
+	var reloads []func() error
+	if blocklist != "" {
+		h.Blocklist, err = zns.NewBlocklist(strings.Split(blocklist, ","))
+		if err != nil {
+			log.Println("Failed to load blocklist", err)
+		}
+		for _, s := range h.Blocklist.Stats() {
+			log.Printf("Blocklist %s: %d rules, %d errors", s.Source, s.Rules, len(s.Errors))
+		}
+		go h.Blocklist.Watch(blocklistReload, nil)
+		reloads = append(reloads, h.Blocklist.Reload)
+	} else {
+		log.Println("No blocklist, queries with noad block nothing")
+	}
+	if rpz != "" {
+		h.RPZ, err = zns.NewRPZ(strings.Split(rpz, ","))
+		if err != nil {
+			log.Println("Failed to load rpz", err)
+		}
+		for _, s := range h.RPZ.Stats() {
+			log.Printf("RPZ %s: %d rules, %d errors", s.Name, s.Rules, len(s.Errors))
+		}
+		go h.RPZ.Watch(blocklistReload, nil)
+		reloads = append(reloads, h.RPZ.Reload)
+	}
+	if local != "" {
+		h.Local, err = zns.NewLocalZone(strings.Split(local, ","))
+		if err != nil {
+			log.Println("Failed to load local zone", err)
+		}
+		for _, s := range h.Local.Stats() {
+			log.Printf("Local %s: %d records, %d errors", s.Source, s.Rules, len(s.Errors))
+		}
+		go h.Local.Watch(blocklistReload, nil)
+		reloads = append(reloads, h.Local.Reload)
+	}
+	if forward != "" {
+		h.Forwarder, err = zns.NewForwarder(strings.Split(forward, ","), strategy)
+		if err != nil {
+			log.Println("Failed to load forwarding rules", err)
+		}
+		for _, s := range h.Forwarder.Stats() {
+			log.Printf("Forward %s: %d rules, %d errors", s.Source, s.Rules, len(s.Errors))
+		}
+		go h.Forwarder.Watch(blocklistReload, nil)
+		reloads = append(reloads, h.Forwarder.Reload)
+	}
+	if len(reloads) > 0 {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		go func() {
+			for range hup {
+				for _, reload := range reloads {
+					if err := reload(); err != nil {
+						log.Println("Failed to reload", err)
+					}
+				}
+			}
+		}()
+	}
+	if ur, ok := repo.(zns.UsageRepo); ok {
+		h.Usage = zns.NewUsageRecorder(ur, repo)
+		h.Usage.RollupAfter = usageRollup
+		h.Usage.Retention = usageRetention
+		closers = append(closers, h.Usage.Close)
+	}
+	// 所有 closers 添加完后才开始处理信号
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	shutdown := func() {
+		for _, c := range closers {
+			c()
+		}
+	}
+	go func() {
+		sig := <-stop
+		log.Println("Shutting down on", sig)
+		shutdown()
+		os.Exit(0)
+	}()
+	if h.TrustedProxies, err = zns.ParsePrefixes(trustedProxies); err != nil {
+		panic(err)
+	}
 	th := &zns.TicketHandler{MBpCNY: price, Pay: pay, Repo: repo}
+	op := &zns.ODoHProxy{Repo: repo, RateLimit: h.RateLimit, Usage: h.Usage, TrustedProxies: h.TrustedProxies}
+
+	var fs *zns.Filters
+	if fr, ok := repo.(zns.FilterRepo); ok {
+		fs = &zns.Filters{Repo: fr, Tickets: repo, Blocklist: h.Blocklist}
+		h.Filters = fs
+	}
+
+	if odohKey != "" {
+		h.ODoH, err = zns.NewODoHTarget(loadSeed(odohKey))
+		if err != nil {
+			panic(err)
+		}
+	}
 
 	mux := http.NewServeMux()
 	mux.Handle("/dns-query", h)
 	mux.Handle("/dns/{token}", h)
 	mux.Handle("/ticket/", th)
 	mux.Handle("/ticket/{token}", th)
+	if fs != nil {
+		mux.Handle("/ticket/{token}/filter", fs)
+	}
+	if h.Usage != nil {
+		mux.Handle("/ticket/{token}/usage", h.Usage)
+	}
+	if h.ODoH != nil {
+		mux.Handle("/.well-known/odohconfigs", h.ODoH)
+	}
+	if odohProxy {
+		mux.Handle("/proxy", op)
+		mux.Handle("/proxy/{token}", op)
+	}
 	mux.Handle("/", http.FileServer(h.Root))
 
+	if adminAddr != "" {
+		admin := http.NewServeMux()
+		admin.Handle("/metrics", zns.MetricsHandler())
+		go func() {
+			if err := http.ListenAndServe(adminAddr, admin); err != nil {
+				log.Fatal(err)
+			}
+		}()
+	}
+
 	x := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if r.Method == http.MethodConnect {
 			h.ServeHTTP(w, r)
@@ -169,6 +458,13 @@ If not free, you should set the following environment variables:
 		p := lnH3.LocalAddr().(*net.UDPAddr).Port
 		h.AltSvc = fmt.Sprintf(`h3=":%d"`, p)
 		th.AltSvc = h.AltSvc
+		op.AltSvc = h.AltSvc
+		if fs != nil {
+			fs.AltSvc = h.AltSvc
+		}
+		if h.Usage != nil {
+			h.Usage.AltSvc = h.AltSvc
+		}
 
 		h3 := http3.Server{Handler: mux, TLSConfig: tlsCfg}
 		go h3.Serve(lnH3)
@@ -188,8 +484,43 @@ If not free, you should set the following environment variables:
 		}()
 	}
 
+	if lnDoQ != nil {
+		cfg := tlsCfg.Clone()
+		cfg.NextProtos = []string{"doq"}
+		ln, err := quic.Listen(lnDoQ, cfg, nil)
+		if err != nil {
+			panic(err)
+		}
+		go func() {
+			for {
+				c, err := ln.Accept(context.Background())
+				if err != nil {
+					log.Println("Failed to accept doq connection", err)
+					continue
+				}
+				go h.ServeDoQ(c)
+			}
+		}()
+	}
+
+	if dnsAddr != "" {
+		h.Clients, err = zns.ParseClientNets(dnsClients)
+		if err != nil {
+			panic(err)
+		}
+		for _, n := range []string{"udp", "tcp"} {
+			s := &dns.Server{Addr: dnsAddr, Net: n, Handler: h}
+			go func() {
+				if err := s.ListenAndServe(); err != nil {
+					log.Fatal(err)
+				}
+			}()
+		}
+	}
+
 	lnTLS := tls.NewListener(lnH12, tlsCfg)
 	if err = http.Serve(lnTLS, x); err != nil {
+		shutdown()
 		log.Fatal(err)
 	}
 }
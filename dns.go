@@ -0,0 +1,126 @@
+package zns
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// ClientNet maps a trusted source network to a ticket token.
+type ClientNet struct {
+	Prefix netip.Prefix
+	Token  string
+}
+
+// ParseClientNets parses comma separated cidr=token pairs like
+//
+//	192.168.1.0/24=foo,fd00::/8=bar
+func ParseClientNets(s string) ([]ClientNet, error) {
+	var cs []ClientNet
+	for _, kv := range strings.Split(s, ",") {
+		if kv == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok || v == "" {
+			return nil, errors.New("invalid client net: " + kv)
+		}
+		p, err := netip.ParsePrefix(k)
+		if err != nil {
+			return nil, err
+		}
+		cs = append(cs, ClientNet{Prefix: p.Masked(), Token: v})
+	}
+	// 最长前缀优先
+	slices.SortStableFunc(cs, func(a, b ClientNet) int {
+		return b.Prefix.Bits() - a.Prefix.Bits()
+	})
+	return cs, nil
+}
+
+func (h *Handler) clientToken(addr net.Addr) string {
+	ap, err := netip.ParseAddrPort(addr.String())
+	if err != nil {
+		return ""
+	}
+	ip := ap.Addr().Unmap()
+	for _, c := range h.Clients {
+		if c.Prefix.Contains(ip) {
+			return c.Token
+		}
+	}
+	return ""
+}
+
+// ServeDNS serves plain DNS over UDP and TCP.
+//
+// Only clients in Handler.Clients are allowed and billed with the mapped token.
+func (h *Handler) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	token := h.clientToken(w.RemoteAddr())
+	if token == "" {
+		a := new(dns.Msg)
+		a.SetRcode(r, dns.RcodeRefused)
+		w.WriteMsg(a)
+		return
+	}
+
+	query, err := r.Pack()
+	if err != nil {
+		return
+	}
+
+	req, err := http.NewRequest("POST", "/dns/"+token+h.listenerQuery("dns"), io.NopCloser(bytes.NewReader(query)))
+	if err != nil {
+		return
+	}
+	req.SetPathValue("token", token)
+	req.RemoteAddr = w.RemoteAddr().String()
+	if _, ok := w.RemoteAddr().(*net.TCPAddr); ok {
+		req = withTransport(req, TransportTCP)
+	} else {
+		req = withTransport(req, TransportUDP)
+	}
+
+	tw := &tlsWriter{}
+	h.ServeHTTP(tw, req)
+
+	if tw.code == statusDropped {
+		return
+	}
+
+	a := new(dns.Msg)
+	if tw.code != http.StatusOK && tw.code != 0 {
+		log.Println("dns query error", string(tw.body))
+		if tw.code == http.StatusUnauthorized || tw.code == http.StatusTooManyRequests {
+			a.SetRcode(r, dns.RcodeRefused)
+		} else {
+			a.SetRcode(r, dns.RcodeServerFailure)
+		}
+		w.WriteMsg(a)
+		return
+	}
+
+	if err = a.Unpack(tw.body); err != nil {
+		a.SetRcode(r, dns.RcodeServerFailure)
+		w.WriteMsg(a)
+		return
+	}
+
+	if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+		size := dns.MinMsgSize
+		if opt := r.IsEdns0(); opt != nil {
+			size = int(opt.UDPSize())
+		}
+		a.Truncate(size)
+	}
+
+	w.WriteMsg(a)
+}
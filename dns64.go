@@ -0,0 +1,214 @@
+package zns
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// DNS64 synthesizes AAAA records from A records for clients behind NAT64,
+// see RFC 6147.
+type DNS64 struct {
+	// Prefix is the NAT64 prefix, the length must be 32, 40, 48, 56, 64 or 96.
+	Prefix netip.Prefix
+	// Exclude are addresses not used. IPv6 ones are treated as no AAAA
+	// records, and IPv4 ones are not synthesized.
+	Exclude []netip.Prefix
+	// Listeners are the listeners using DNS64 for all queries, like dns,
+	// dot or doq.
+	Listeners []string
+}
+
+// DefaultDNS64Prefix is the Well-Known Prefix, see RFC 6052.
+const DefaultDNS64Prefix = "64:ff9b::/96"
+
+// IPv4 映射地址总是排除，见 RFC 6147 5.1.4
+var dns64Mapped = netip.MustParsePrefix("::ffff:0:0/96")
+
+// NewDNS64 creates DNS64 with the prefix and exclusion ranges. The default
+// prefix is used if prefix is empty.
+func NewDNS64(prefix string, exclude []string) (*DNS64, error) {
+	if prefix == "" {
+		prefix = DefaultDNS64Prefix
+	}
+	p, err := netip.ParsePrefix(prefix)
+	if err != nil {
+		return nil, err
+	}
+	if !p.Addr().Is6() || !slices.Contains([]int{32, 40, 48, 56, 64, 96}, p.Bits()) {
+		return nil, errors.New("invalid dns64 prefix: " + prefix)
+	}
+
+	d := &DNS64{Prefix: p.Masked(), Exclude: []netip.Prefix{dns64Mapped}}
+	for _, s := range exclude {
+		if s == "" {
+			continue
+		}
+		e, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, err
+		}
+		d.Exclude = append(d.Exclude, e.Masked())
+	}
+	return d, nil
+}
+
+// Listen reports whether all queries of the listener use DNS64.
+func (d *DNS64) Listen(listener string) bool {
+	return slices.Contains(d.Listeners, listener)
+}
+
+func (d *DNS64) excluded(ip netip.Addr) bool {
+	for _, p := range d.Exclude {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Need reports whether the AAAA answer a needs synthesis, which is NOERROR
+// without any usable AAAA records. Excluded AAAA records are removed.
+func (d *DNS64) Need(a *dns.Msg) bool {
+	if a.Rcode != dns.RcodeSuccess {
+		return false
+	}
+	rrs := a.Answer[:0]
+	var found bool
+	for _, rr := range a.Answer {
+		if v, ok := rr.(*dns.AAAA); ok {
+			ip, _ := netip.AddrFromSlice(v.AAAA)
+			if d.excluded(ip) {
+				continue
+			}
+			found = true
+		}
+		rrs = append(rrs, rr)
+	}
+	a.Answer = rrs
+	return !found
+}
+
+// Synthesize replaces the answer of a with the AAAA records converted from
+// the A answer v4. It returns false if there is no A record to convert.
+func (d *DNS64) Synthesize(a, v4 *dns.Msg) bool {
+	// 合成记录的 TTL 不超过原应答 SOA 的否定缓存时间，见 RFC 6147 5.1.7
+	maxTTL := ^uint32(0)
+	for _, rr := range a.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			maxTTL = min(soa.Hdr.Ttl, soa.Minttl)
+		}
+	}
+
+	var rrs []dns.RR
+	var found bool
+	for _, rr := range v4.Answer {
+		switch v := rr.(type) {
+		case *dns.CNAME:
+			rrs = append(rrs, rr)
+		case *dns.A:
+			ip, _ := netip.AddrFromSlice(v.A.To4())
+			if d.excluded(ip) {
+				continue
+			}
+			hdr := v.Hdr
+			hdr.Rrtype = dns.TypeAAAA
+			hdr.Ttl = min(hdr.Ttl, maxTTL)
+			rrs = append(rrs, &dns.AAAA{Hdr: hdr, AAAA: net.IP(d.embed(ip).AsSlice())})
+			found = true
+		}
+	}
+	if !found {
+		return false
+	}
+
+	a.Answer = rrs
+	a.Ns = nil
+	// 合成的记录无法通过 DNSSEC 验证
+	a.AuthenticatedData = false
+	return true
+}
+
+// embed puts IPv4 address into the prefix, see RFC 6052 2.2.
+func (d *DNS64) embed(ip netip.Addr) netip.Addr {
+	b := d.Prefix.Addr().As16()
+	v := ip.As4()
+	for i, j := d.Prefix.Bits()/8, 0; j < len(v); i++ {
+		// 第 64 到 71 位必须为零
+		if i == 8 {
+			continue
+		}
+		b[i] = v[j]
+		j++
+	}
+	return netip.AddrFrom16(b)
+}
+
+// extract takes the IPv4 address embedded in ip.
+func (d *DNS64) extract(ip netip.Addr) netip.Addr {
+	b := ip.As16()
+	var v [4]byte
+	for i, j := d.Prefix.Bits()/8, 0; j < len(v); i++ {
+		if i == 8 {
+			continue
+		}
+		v[j] = b[i]
+		j++
+	}
+	return netip.AddrFrom4(v)
+}
+
+// PTRReply answers the PTR query of synthesized addresses with a CNAME to
+// the in-addr.arpa name, nil if the name is not under the prefix, see
+// RFC 6147 5.3.1.
+func (d *DNS64) PTRReply(m *dns.Msg) *dns.Msg {
+	q := m.Question[0]
+	if q.Qtype != dns.TypePTR {
+		return nil
+	}
+	ip, ok := parseIP6Arpa(q.Name)
+	if !ok || !d.Prefix.Contains(ip) {
+		return nil
+	}
+	arpa, err := dns.ReverseAddr(d.extract(ip).String())
+	if err != nil {
+		return nil
+	}
+
+	a := new(dns.Msg)
+	a.SetReply(m)
+	a.RecursionAvailable = true
+	a.Answer = []dns.RR{&dns.CNAME{
+		Hdr:    dns.RR_Header{Name: q.Name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: localTTL},
+		Target: arpa,
+	}}
+	return a
+}
+
+// parseIP6Arpa parses the full nibble name like 1.0.0...ip6.arpa.
+func parseIP6Arpa(name string) (netip.Addr, bool) {
+	s, ok := strings.CutSuffix(strings.ToLower(name), ".ip6.arpa.")
+	if !ok {
+		return netip.Addr{}, false
+	}
+	nibbles := strings.Split(s, ".")
+	if len(nibbles) != 32 {
+		return netip.Addr{}, false
+	}
+	var b [16]byte
+	for i, n := range nibbles {
+		v, err := strconv.ParseUint(n, 16, 8)
+		if err != nil || len(n) != 1 {
+			return netip.Addr{}, false
+		}
+		// 第一个标签是最低的半字节
+		k := 31 - i
+		b[k/2] |= byte(v) << (4 * (1 - k%2))
+	}
+	return netip.AddrFrom16(b), true
+}
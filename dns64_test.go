@@ -0,0 +1,111 @@
+package zns
+
+import (
+	"encoding/base64"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDNS64Embed(t *testing.T) {
+	// RFC 6052 2.4
+	ip := netip.MustParseAddr("192.0.2.33")
+	for p, v := range map[string]string{
+		"2001:db8::/32":         "2001:db8:c000:221::",
+		"2001:db8:100::/40":     "2001:db8:1c0:2:21::",
+		"2001:db8:122::/48":     "2001:db8:122:c000:2:2100::",
+		"2001:db8:122:300::/56": "2001:db8:122:3c0:0:221::",
+		"2001:db8:122:344::/64": "2001:db8:122:344:c0:2:2100:0",
+		"2001:db8:122:344::/96": "2001:db8:122:344::c000:221",
+	} {
+		d, err := NewDNS64(p, nil)
+		assert.Nil(t, err)
+		assert.Equal(t, v, d.embed(ip).String(), p)
+		assert.Equal(t, ip, d.extract(d.embed(ip)), p)
+	}
+
+	_, err := NewDNS64("2001:db8::/33", nil)
+	assert.NotNil(t, err)
+	_, err = NewDNS64("10.0.0.0/8", nil)
+	assert.NotNil(t, err)
+}
+
+func TestDNS64(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	s := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		q := r.Question[0]
+		a := new(dns.Msg)
+		a.SetReply(r)
+		switch {
+		case q.Qtype == dns.TypeA && q.Name == "private.example.":
+			a.Answer = []dns.RR{rr(q.Name + " 300 IN A 10.0.0.1")}
+		case q.Qtype == dns.TypeA:
+			a.Answer = []dns.RR{rr(q.Name + " 300 IN A 192.0.2.1")}
+		case q.Name == "v6.example.":
+			a.Answer = []dns.RR{rr(q.Name + " 300 IN AAAA 2001:db8::1")}
+		case q.Name == "mapped.example.":
+			a.Answer = []dns.RR{rr(q.Name + " 300 IN AAAA ::ffff:192.0.2.2")}
+		case q.Qtype == dns.TypePTR:
+			a.Answer = []dns.RR{rr(q.Name + " 300 IN PTR host.example.")}
+		default:
+			a.Ns = []dns.RR{rr("example. 60 IN SOA ns.example. root.example. 1 3600 600 86400 30")}
+		}
+		w.WriteMsg(a)
+	})}
+	go s.ActivateAndServe()
+	defer s.Shutdown()
+
+	up, err := NewUpstreams([]string{"udp://" + pc.LocalAddr().String()}, StrategyFailover)
+	assert.Nil(t, err)
+
+	d, err := NewDNS64("", []string{"10.0.0.0/8"})
+	assert.Nil(t, err)
+	h := &Handler{Upstream: up, Repo: FreeTicketRepo{}, DNS64: d}
+
+	query := func(name string, qtype uint16, param string) *dns.Msg {
+		m := new(dns.Msg)
+		m.SetQuestion(name, qtype)
+		b, _ := m.Pack()
+		req := httptest.NewRequest(http.MethodGet, "/dns/foo?dns="+base64.RawURLEncoding.EncodeToString(b)+param, nil)
+		req.SetPathValue("token", "foo")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Nil(t, m.Unpack(w.Body.Bytes()))
+		return m
+	}
+
+	a := query("www.example.", dns.TypeAAAA, "")
+	assert.Equal(t, 0, len(a.Answer))
+
+	a = query("www.example.", dns.TypeAAAA, "&dns64=1")
+	assert.Equal(t, 1, len(a.Answer))
+	assert.Equal(t, "64:ff9b::c000:201", a.Answer[0].(*dns.AAAA).AAAA.String())
+	assert.Equal(t, uint32(30), a.Answer[0].Header().Ttl)
+
+	a = query("v6.example.", dns.TypeAAAA, "&dns64=1")
+	assert.Equal(t, "2001:db8::1", a.Answer[0].(*dns.AAAA).AAAA.String())
+
+	a = query("mapped.example.", dns.TypeAAAA, "&dns64=1")
+	assert.Equal(t, "64:ff9b::c000:201", a.Answer[0].(*dns.AAAA).AAAA.String())
+
+	a = query("private.example.", dns.TypeAAAA, "&dns64=1")
+	assert.Equal(t, dns.RcodeSuccess, a.Rcode)
+	assert.Equal(t, 0, len(a.Answer))
+
+	arpa, _ := dns.ReverseAddr("64:ff9b::c000:201")
+	a = query(arpa, dns.TypePTR, "&dns64=1")
+	assert.Equal(t, 2, len(a.Answer))
+	assert.Equal(t, "1.2.0.192.in-addr.arpa.", a.Answer[0].(*dns.CNAME).Target)
+	assert.Equal(t, "host.example.", a.Answer[1].(*dns.PTR).Ptr)
+
+	d.Listeners = []string{"dns"}
+	assert.Equal(t, "?dns64=1", h.listenerQuery("dns"))
+	assert.Equal(t, "", h.listenerQuery("dot"))
+}
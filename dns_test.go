@@ -0,0 +1,52 @@
+package zns
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseClientNets(t *testing.T) {
+	cs, err := ParseClientNets("10.0.0.0/8=a,10.1.2.3/16=b")
+	assert.Nil(t, err)
+	assert.Equal(t, []ClientNet{
+		{Prefix: netip.MustParsePrefix("10.1.0.0/16"), Token: "b"},
+		{Prefix: netip.MustParsePrefix("10.0.0.0/8"), Token: "a"},
+	}, cs)
+
+	_, err = ParseClientNets("10.0.0.0/8")
+	assert.NotNil(t, err)
+}
+
+func TestServeDNS(t *testing.T) {
+	up, stop := testUpstream(t)
+	defer stop()
+
+	serve := func(h *Handler) string {
+		pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+		assert.Nil(t, err)
+		s := &dns.Server{PacketConn: pc, Handler: h}
+		go s.ActivateAndServe()
+		t.Cleanup(func() { s.Shutdown() })
+		return pc.LocalAddr().String()
+	}
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+
+	addr := serve(&Handler{Upstream: up, Repo: FreeTicketRepo{}})
+	a, err := dns.Exchange(q, addr)
+	assert.Nil(t, err)
+	assert.Equal(t, dns.RcodeRefused, a.Rcode)
+
+	// Clients 必须在服务启动前设置
+	clients, _ := ParseClientNets("127.0.0.0/8=foo")
+	addr = serve(&Handler{Upstream: up, Repo: FreeTicketRepo{}, Clients: clients})
+	a, err = dns.Exchange(q, addr)
+	assert.Nil(t, err)
+	assert.Equal(t, dns.RcodeSuccess, a.Rcode)
+	assert.Equal(t, "1.2.3.4", a.Answer[0].(*dns.A).A.String())
+}
@@ -0,0 +1,688 @@
+package zns
+
+import (
+	"cmp"
+	"container/list"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// RootAnchors are the DS records of root KSK-2017 and KSK-2024.
+//
+// See https://data.iana.org/root-anchors/root-anchors.xml
+var RootAnchors = []string{
+	". 86400 IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D",
+	". 86400 IN DS 38696 8 2 683D2D0ACB8C9B712A1948B27F741219298D0A450D612C483AF444A4C0FB2B16",
+}
+
+const (
+	// 验证过的 DNSKEY 和 DS 最多缓存一小时
+	dnssecMaxTTL = 3600
+	// 防止异常应答导致无限递归
+	dnssecMaxDepth = 32
+	// 每种缓存最多保存的区域数
+	dnssecMaxZones = 4096
+)
+
+// Validator validates answers by walking the chain of trust from the root
+// trust anchors, see RFC 4035 section 5.
+type Validator struct {
+	Anchors []*dns.DS
+
+	exchange func([]byte) ([]byte, error)
+
+	// 区域的可信 DNSKEY，nil 表示区域未签名
+	keys *zoneCache[[]*dns.DNSKEY]
+	// 区域切分点 DS 查询结果
+	cuts *zoneCache[cutState]
+}
+
+type cutState int
+
+const (
+	cutNone cutState = iota
+	cutSecure
+	cutInsecure
+)
+
+// zoneCache is an LRU cache of per-zone results which expire after their TTL.
+type zoneCache[T any] struct {
+	mu    sync.Mutex
+	size  int
+	items map[string]*list.Element
+	lru   *list.List
+}
+
+type zoneEntry[T any] struct {
+	zone    string
+	value   T
+	expires time.Time
+}
+
+func newZoneCache[T any](size int) *zoneCache[T] {
+	return &zoneCache[T]{size: size, items: map[string]*list.Element{}, lru: list.New()}
+}
+
+// get returns the unexpired value of zone.
+func (c *zoneCache[T]) get(zone string) (value T, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.items[zone]
+	if !ok {
+		return value, false
+	}
+	z := e.Value.(*zoneEntry[T])
+	if !time.Now().Before(z.expires) {
+		c.lru.Remove(e)
+		delete(c.items, zone)
+		return value, false
+	}
+	c.lru.MoveToFront(e)
+	return z.value, true
+}
+
+// set stores value of zone for ttl seconds, and evicts the least recently
+// used zones beyond the size.
+func (c *zoneCache[T]) set(zone string, value T, ttl uint32) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	z := &zoneEntry[T]{zone: zone, value: value, expires: time.Now().Add(time.Duration(ttl) * time.Second)}
+	if e, ok := c.items[zone]; ok {
+		e.Value = z
+		c.lru.MoveToFront(e)
+		return
+	}
+	c.items[zone] = c.lru.PushFront(z)
+	for c.lru.Len() > c.size {
+		e := c.lru.Back()
+		c.lru.Remove(e)
+		delete(c.items, e.Value.(*zoneEntry[T]).zone)
+	}
+}
+
+// NewValidator creates a Validator which fetches DS and DNSKEY records with exchange.
+func NewValidator(exchange func([]byte) ([]byte, error)) *Validator {
+	v := &Validator{
+		exchange: exchange,
+		keys:     newZoneCache[[]*dns.DNSKEY](dnssecMaxZones),
+		cuts:     newZoneCache[cutState](dnssecMaxZones),
+	}
+	for _, s := range RootAnchors {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			panic(err)
+		}
+		v.Anchors = append(v.Anchors, rr.(*dns.DS))
+	}
+	return v
+}
+
+// Validate reports whether a is secure. It returns an error if a is bogus.
+//
+// Answers from provably unsigned zones are insecure, and so are answers
+// whose denial of existence or wildcard expansion is not fully proved.
+func (v *Validator) Validate(a *dns.Msg) (secure bool, err error) {
+	return v.validate(a, 0)
+}
+
+func (v *Validator) validate(a *dns.Msg, depth int) (secure bool, err error) {
+	if depth > dnssecMaxDepth {
+		return false, errors.New("chain of trust is too long")
+	}
+	if len(a.Question) == 0 {
+		return false, errors.New("question is empty")
+	}
+	if a.Rcode != dns.RcodeSuccess && a.Rcode != dns.RcodeNameError {
+		return false, nil
+	}
+
+	secure = true
+	sets := rrsets(a.Answer)
+	answers := len(sets)
+	for _, set := range rrsets(a.Ns) {
+		switch set[0].Header().Rrtype {
+		case dns.TypeSOA, dns.TypeNSEC, dns.TypeNSEC3:
+			sets = append(sets, set)
+		}
+	}
+
+	var unsigned []string
+	var expanded [][]*dns.RRSIG
+	for i, set := range sets {
+		sigs := sigsOf(set, a.Answer, a.Ns)
+		if len(sigs) == 0 {
+			unsigned = append(unsigned, set[0].Header().Name)
+			continue
+		}
+		ok, err := v.verify(set, sigs, depth+1)
+		if err != nil {
+			return false, err
+		}
+		secure = secure && ok
+		if i < answers && wildcardExpanded(set[0].Header().Name, sigs) {
+			expanded = append(expanded, sigs)
+		}
+	}
+
+	qname := answerName(a)
+	if len(sets) == 0 {
+		unsigned = append(unsigned, qname)
+	}
+
+	for _, name := range unsigned {
+		insecure, err := v.insecure(name, depth+1)
+		if err != nil {
+			return false, err
+		}
+		if !insecure {
+			return false, errors.New("missing signature for " + name)
+		}
+		secure = false
+	}
+
+	// 通配符展开的应答需要证明没有更接近的名字，见 RFC 4035 第 5.3.4 节
+	for _, sigs := range expanded {
+		secure = secure && noCloserMatch(a, sigs)
+	}
+
+	if secure && !hasRRset(a.Answer, qname, a.Question[0].Qtype) {
+		proved, err := checkDenial(a, qname)
+		if err != nil {
+			return false, err
+		}
+		secure = proved
+	}
+
+	return secure, nil
+}
+
+// verify checks the signatures of the RRset with the trusted keys of the signer.
+func (v *Validator) verify(set []dns.RR, sigs []*dns.RRSIG, depth int) (secure bool, err error) {
+	name := set[0].Header().Name
+	err = errors.New("no valid signature for " + name + " " + dns.TypeToString[set[0].Header().Rrtype])
+
+	now := time.Now()
+	for _, sig := range sigs {
+		if !dns.IsSubDomain(sig.SignerName, name) {
+			continue
+		}
+		if !sig.ValidityPeriod(now) {
+			err = errors.New("signature expired for " + name)
+			continue
+		}
+
+		keys, kerr := v.zoneKeys(sig.SignerName, depth+1)
+		if kerr != nil {
+			return false, kerr
+		}
+		if keys == nil {
+			// 签名者所在区域未签名
+			return false, nil
+		}
+
+		for _, k := range keys {
+			if k.KeyTag() == sig.KeyTag && k.Algorithm == sig.Algorithm && sig.Verify(k, set) == nil {
+				return true, nil
+			}
+		}
+	}
+	return false, err
+}
+
+// zoneKeys returns the trusted DNSKEYs of zone, or nil if zone is unsigned.
+func (v *Validator) zoneKeys(zone string, depth int) ([]*dns.DNSKEY, error) {
+	zone = dns.CanonicalName(zone)
+
+	if keys, ok := v.keys.get(zone); ok {
+		return keys, nil
+	}
+
+	ttl := uint32(dnssecMaxTTL)
+
+	var ds []*dns.DS
+	if zone == "." {
+		ds = v.Anchors
+	} else {
+		a, err := v.query(zone, dns.TypeDS)
+		if err != nil {
+			return nil, err
+		}
+		var set []dns.RR
+		for _, rr := range a.Answer {
+			if d, ok := rr.(*dns.DS); ok && strings.EqualFold(d.Hdr.Name, zone) {
+				ds = append(ds, d)
+				set = append(set, d)
+				ttl = min(ttl, d.Hdr.Ttl)
+			}
+		}
+
+		var secure bool
+		if len(set) == 0 {
+			// 没有 DS，需要验证否定应答
+			_, err = v.validate(a, depth+1)
+		} else {
+			secure, err = v.verify(set, sigsOf(set, a.Answer), depth+1)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !secure {
+			v.setKeys(zone, nil, ttl)
+			return nil, nil
+		}
+	}
+
+	a, err := v.query(zone, dns.TypeDNSKEY)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []*dns.DNSKEY
+	var set []dns.RR
+	for _, rr := range a.Answer {
+		if k, ok := rr.(*dns.DNSKEY); ok && strings.EqualFold(k.Hdr.Name, zone) {
+			keys = append(keys, k)
+			set = append(set, k)
+			ttl = min(ttl, k.Hdr.Ttl)
+		}
+	}
+
+	sigs := sigsOf(set, a.Answer)
+	now := time.Now()
+	for _, d := range ds {
+		for _, k := range keys {
+			if k.KeyTag() != d.KeyTag || k.Algorithm != d.Algorithm {
+				continue
+			}
+			if x := k.ToDS(d.DigestType); x == nil || !strings.EqualFold(x.Digest, d.Digest) {
+				continue
+			}
+			for _, sig := range sigs {
+				if sig.KeyTag == d.KeyTag && sig.ValidityPeriod(now) && sig.Verify(k, set) == nil {
+					v.setKeys(zone, keys, ttl)
+					return keys, nil
+				}
+			}
+		}
+	}
+
+	return nil, errors.New("no trusted DNSKEY for " + zone)
+}
+
+func (v *Validator) setKeys(zone string, keys []*dns.DNSKEY, ttl uint32) {
+	v.keys.set(zone, keys, ttl)
+}
+
+// insecure reports whether name is under a provably unsigned delegation.
+func (v *Validator) insecure(name string, depth int) (bool, error) {
+	labels := dns.SplitDomainName(dns.CanonicalName(name))
+	for i := len(labels) - 1; i >= 0; i-- {
+		zone := dns.Fqdn(strings.Join(labels[i:], "."))
+		state, err := v.cut(zone, depth+1)
+		if err != nil {
+			return false, err
+		}
+		if state == cutInsecure {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// cut queries the DS of zone to find out whether there is a zone cut.
+func (v *Validator) cut(zone string, depth int) (cutState, error) {
+	if state, ok := v.cuts.get(zone); ok {
+		return state, nil
+	}
+
+	a, err := v.query(zone, dns.TypeDS)
+	if err != nil {
+		return cutNone, err
+	}
+
+	state := cutNone
+	if hasRRset(a.Answer, zone, dns.TypeDS) {
+		keys, err := v.zoneKeys(zone, depth+1)
+		if err != nil {
+			return cutNone, err
+		}
+		state = cutSecure
+		if keys == nil {
+			state = cutInsecure
+		}
+	} else {
+		secure, err := v.validate(a, depth+1)
+		if err != nil {
+			return cutNone, err
+		}
+		if !secure || insecureDelegation(a, zone) {
+			state = cutInsecure
+		}
+	}
+
+	v.cuts.set(zone, state, dnssecMaxTTL)
+	return state, nil
+}
+
+func (v *Validator) query(name string, qtype uint16) (*dns.Msg, error) {
+	q := new(dns.Msg)
+	q.SetQuestion(name, qtype)
+	q.SetEdns0(dns.DefaultMsgSize, true)
+	q.CheckingDisabled = true
+
+	b, err := q.Pack()
+	if err != nil {
+		return nil, err
+	}
+	b, err = v.exchange(b)
+	if err != nil {
+		return nil, err
+	}
+
+	a := new(dns.Msg)
+	if err = a.Unpack(b); err != nil {
+		return nil, err
+	}
+	if a.Rcode != dns.RcodeSuccess && a.Rcode != dns.RcodeNameError {
+		return nil, errors.New("failed to query " + name + " " + dns.TypeToString[qtype] + ": " + dns.RcodeToString[a.Rcode])
+	}
+	return a, nil
+}
+
+// insecureDelegation checks the NSEC or NSEC3 proof of delegation without DS.
+func insecureDelegation(a *dns.Msg, zone string) bool {
+	for _, rr := range a.Ns {
+		switch x := rr.(type) {
+		case *dns.NSEC:
+			if strings.EqualFold(x.Hdr.Name, zone) {
+				return hasType(x.TypeBitMap, dns.TypeNS) && !hasType(x.TypeBitMap, dns.TypeDS)
+			}
+		case *dns.NSEC3:
+			if x.Match(zone) {
+				return hasType(x.TypeBitMap, dns.TypeNS) && !hasType(x.TypeBitMap, dns.TypeDS)
+			}
+			// opt-out
+			if x.Cover(zone) && x.Flags&1 == 1 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// checkDenial reports whether the NSEC or NSEC3 records prove the absence
+// of name for NXDOMAIN, or of its records of the query type for NODATA, see
+// RFC 4035 section 5.4 and RFC 5155 section 8. It returns an error if there
+// is no NSEC or NSEC3 record at all, and false if the proof is incomplete.
+func checkDenial(a *dns.Msg, name string) (proved bool, err error) {
+	var nsec []*dns.NSEC
+	var nsec3 []*dns.NSEC3
+	for _, rr := range a.Ns {
+		switch x := rr.(type) {
+		case *dns.NSEC:
+			nsec = append(nsec, x)
+		case *dns.NSEC3:
+			nsec3 = append(nsec3, x)
+		}
+	}
+	if len(nsec) == 0 && len(nsec3) == 0 {
+		return false, errors.New("missing denial of existence for " + name)
+	}
+
+	qtype := a.Question[0].Qtype
+	// 名字存在但没有查询的类型
+	nodata := func(types []uint16) bool {
+		return !hasType(types, qtype) && !hasType(types, dns.TypeCNAME)
+	}
+
+	if len(nsec) > 0 {
+		for _, x := range nsec {
+			if strings.EqualFold(x.Hdr.Name, name) {
+				return a.Rcode == dns.RcodeSuccess && nodata(x.TypeBitMap), nil
+			}
+		}
+		for _, x := range nsec {
+			if !nsecCover(x, name) {
+				continue
+			}
+			// 下一个名字是 name 的子域时 name 是空的非终端节点
+			if a.Rcode == dns.RcodeSuccess && dns.IsSubDomain(name, x.NextDomain) {
+				return true, nil
+			}
+			// 名字不存在，还需要证明最近祖先下的通配符不存在或没有查询的类型
+			wild := wildcardOf(nsecEncloser(x, name))
+			for _, w := range nsec {
+				if strings.EqualFold(w.Hdr.Name, wild) {
+					return a.Rcode == dns.RcodeSuccess && nodata(w.TypeBitMap), nil
+				}
+				if nsecCover(w, wild) {
+					return a.Rcode == dns.RcodeNameError, nil
+				}
+			}
+		}
+		return false, nil
+	}
+
+	for _, x := range nsec3 {
+		if x.Match(name) {
+			return a.Rcode == dns.RcodeSuccess && nodata(x.TypeBitMap), nil
+		}
+	}
+	ce, _, ok := nsec3Encloser(nsec3, name)
+	if !ok {
+		return false, nil
+	}
+	wild := wildcardOf(ce)
+	for _, x := range nsec3 {
+		if x.Match(wild) {
+			return a.Rcode == dns.RcodeSuccess && nodata(x.TypeBitMap), nil
+		}
+		if x.Cover(wild) {
+			return a.Rcode == dns.RcodeNameError, nil
+		}
+	}
+	return false, nil
+}
+
+// wildcardExpanded reports whether the RRset of name is synthesized from a
+// wildcard, that is its signatures have fewer labels than name.
+func wildcardExpanded(name string, sigs []*dns.RRSIG) bool {
+	for _, sig := range sigs {
+		if int(sig.Labels) < dns.CountLabel(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// noCloserMatch reports whether the NSEC or NSEC3 records prove that no name
+// closer than the wildcard exists for the name expanded with sigs.
+func noCloserMatch(a *dns.Msg, sigs []*dns.RRSIG) bool {
+	name := sigs[0].Hdr.Name
+	labels := dns.CountLabel(name)
+	for _, sig := range sigs {
+		labels = min(labels, int(sig.Labels))
+	}
+	// 通配符所在区域下比通配符更接近 name 的名字
+	next := lastLabels(name, labels+1)
+	for _, rr := range a.Ns {
+		switch x := rr.(type) {
+		case *dns.NSEC:
+			if nsecCover(x, name) {
+				return true
+			}
+		case *dns.NSEC3:
+			if x.Cover(next) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// nsecEncloser returns the closest encloser of name proved by the NSEC
+// covering it, which is the longest common ancestor of name with the owner
+// or the next name.
+func nsecEncloser(n *dns.NSEC, name string) string {
+	a := dns.CompareDomainName(name, n.Hdr.Name)
+	b := dns.CompareDomainName(name, n.NextDomain)
+	return lastLabels(name, max(a, b))
+}
+
+// nsec3Encloser finds the closest encloser ce of name whose NSEC3 matches,
+// and the next closer name covered, see RFC 5155 section 8.3.
+func nsec3Encloser(nsec3 []*dns.NSEC3, name string) (ce, next string, ok bool) {
+	n := dns.CountLabel(name)
+	for i := n - 1; i >= 0; i-- {
+		ce, next = lastLabels(name, i), lastLabels(name, i+1)
+		var matched, covered bool
+		for _, x := range nsec3 {
+			matched = matched || x.Match(ce)
+			covered = covered || x.Cover(next)
+		}
+		if matched {
+			return ce, next, covered
+		}
+	}
+	return "", "", false
+}
+
+// lastLabels returns the name of the last n labels of name.
+func lastLabels(name string, n int) string {
+	labels := dns.SplitDomainName(name)
+	if n <= 0 {
+		return "."
+	}
+	if n >= len(labels) {
+		return dns.Fqdn(name)
+	}
+	return dns.Fqdn(strings.Join(labels[len(labels)-n:], "."))
+}
+
+// wildcardOf returns the wildcard name under zone.
+func wildcardOf(zone string) string {
+	if zone == "." {
+		return "*."
+	}
+	return "*." + zone
+}
+
+func nsecCover(n *dns.NSEC, name string) bool {
+	owner, next := n.Hdr.Name, n.NextDomain
+	if canonicalCompare(owner, next) < 0 {
+		return canonicalCompare(owner, name) < 0 && canonicalCompare(name, next) < 0
+	}
+	// 最后一条 NSEC 指向区域顶点
+	return canonicalCompare(owner, name) < 0 || canonicalCompare(name, next) < 0
+}
+
+// canonicalCompare compares names in canonical order, see RFC 4034 section 6.1.
+func canonicalCompare(a, b string) int {
+	x := dns.SplitDomainName(strings.ToLower(a))
+	y := dns.SplitDomainName(strings.ToLower(b))
+	for i := 1; i <= min(len(x), len(y)); i++ {
+		if c := strings.Compare(x[len(x)-i], y[len(y)-i]); c != 0 {
+			return c
+		}
+	}
+	return cmp.Compare(len(x), len(y))
+}
+
+// answerName follows the CNAME chain in answer and returns the last name.
+func answerName(a *dns.Msg) string {
+	name := a.Question[0].Name
+	for range a.Answer {
+		next := name
+		for _, rr := range a.Answer {
+			if c, ok := rr.(*dns.CNAME); ok && strings.EqualFold(c.Hdr.Name, name) {
+				next = c.Target
+			}
+		}
+		if next == name {
+			break
+		}
+		name = next
+	}
+	return name
+}
+
+func hasRRset(rrs []dns.RR, name string, qtype uint16) bool {
+	for _, rr := range rrs {
+		h := rr.Header()
+		if h.Rrtype == qtype && strings.EqualFold(h.Name, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func hasType(types []uint16, t uint16) bool {
+	for _, x := range types {
+		if x == t {
+			return true
+		}
+	}
+	return false
+}
+
+// rrsets groups records by name and type, RRSIGs excluded.
+func rrsets(rrs []dns.RR) (sets [][]dns.RR) {
+	idx := map[string]int{}
+	for _, rr := range rrs {
+		h := rr.Header()
+		if h.Rrtype == dns.TypeRRSIG || h.Rrtype == dns.TypeOPT {
+			continue
+		}
+		k := strings.ToLower(h.Name) + "/" + dns.TypeToString[h.Rrtype]
+		if i, ok := idx[k]; ok {
+			sets[i] = append(sets[i], rr)
+		} else {
+			idx[k] = len(sets)
+			sets = append(sets, []dns.RR{rr})
+		}
+	}
+	return
+}
+
+// sigsOf returns the RRSIGs covering the RRset.
+func sigsOf(set []dns.RR, sections ...[]dns.RR) (sigs []*dns.RRSIG) {
+	if len(set) == 0 {
+		return
+	}
+	h := set[0].Header()
+	for _, rrs := range sections {
+		for _, rr := range rrs {
+			if s, ok := rr.(*dns.RRSIG); ok && s.TypeCovered == h.Rrtype && strings.EqualFold(s.Hdr.Name, h.Name) {
+				sigs = append(sigs, s)
+			}
+		}
+	}
+	return
+}
+
+// stripDNSSEC removes DNSSEC records not asked by clients without DO bit.
+func stripDNSSEC(a *dns.Msg) {
+	qtype := a.Question[0].Qtype
+	strip := func(rrs []dns.RR) (out []dns.RR) {
+		for _, rr := range rrs {
+			switch t := rr.Header().Rrtype; t {
+			case dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNSEC3:
+				if t != qtype {
+					continue
+				}
+			}
+			out = append(out, rr)
+		}
+		return
+	}
+	a.Answer = strip(a.Answer)
+	a.Ns = strip(a.Ns)
+	a.Extra = strip(a.Extra)
+	if opt := a.IsEdns0(); opt != nil {
+		opt.SetDo(false)
+	}
+}
@@ -0,0 +1,214 @@
+package zns
+
+import (
+	"crypto"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+type testZone struct {
+	key  *dns.DNSKEY
+	priv crypto.Signer
+}
+
+func newTestZone(t *testing.T, name string) *testZone {
+	key := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: name, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags:     257,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+	priv, err := key.Generate(256)
+	assert.Nil(t, err)
+	return &testZone{key: key, priv: priv.(crypto.Signer)}
+}
+
+func (z *testZone) sign(t *testing.T, rrs ...dns.RR) []dns.RR {
+	sig := &dns.RRSIG{
+		Hdr:        dns.RR_Header{Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: 3600},
+		KeyTag:     z.key.KeyTag(),
+		SignerName: z.key.Hdr.Name,
+		Algorithm:  z.key.Algorithm,
+		Inception:  uint32(time.Now().Add(-time.Hour).Unix()),
+		Expiration: uint32(time.Now().Add(time.Hour).Unix()),
+	}
+	assert.Nil(t, sig.Sign(z.priv, rrs))
+	return append(rrs, sig)
+}
+
+func rr(s string) dns.RR {
+	r, err := dns.NewRR(s)
+	if err != nil {
+		panic(err)
+	}
+	return r
+}
+
+func TestValidator(t *testing.T) {
+	root := newTestZone(t, ".")
+	test := newTestZone(t, "test.")
+
+	nsec := &dns.NSEC{
+		Hdr:        dns.RR_Header{Name: "insecure.", Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: 3600},
+		NextDomain: "test.",
+		TypeBitMap: []uint16{dns.TypeNS, dns.TypeRRSIG, dns.TypeNSEC},
+	}
+	soa := rr(". 3600 IN SOA a.root-servers.net. nstld.verisign-grs.com. 1 1800 900 604800 86400")
+
+	a := rr("www.test. 300 IN A 1.2.3.4")
+	zone := map[string][]dns.RR{
+		"./DNSKEY":        root.sign(t, root.key),
+		"test./DS":        root.sign(t, test.key.ToDS(dns.SHA256)),
+		"test./DNSKEY":    test.sign(t, test.key),
+		"www.test./A":     test.sign(t, a),
+		"www.insecure./A": {rr("www.insecure. 300 IN A 5.6.7.8")},
+	}
+
+	exchange := func(b []byte) ([]byte, error) {
+		q := new(dns.Msg)
+		q.Unpack(b)
+		m := new(dns.Msg)
+		m.SetReply(q)
+		k := q.Question[0].Name + "/" + dns.TypeToString[q.Question[0].Qtype]
+		if rrs, ok := zone[k]; ok {
+			m.Answer = rrs
+		} else if k == "insecure./DS" {
+			m.Ns = append(root.sign(t, soa), root.sign(t, nsec)...)
+		} else {
+			m.Rcode = dns.RcodeServerFailure
+		}
+		return m.Pack()
+	}
+
+	v := NewValidator(exchange)
+	v.Anchors = []*dns.DS{root.key.ToDS(dns.SHA256)}
+
+	answer := func(name string) *dns.Msg {
+		q := new(dns.Msg)
+		q.SetQuestion(name, dns.TypeA)
+		b, _ := q.Pack()
+		b, _ = exchange(b)
+		m := new(dns.Msg)
+		m.Unpack(b)
+		return m
+	}
+
+	secure, err := v.Validate(answer("www.test."))
+	assert.Nil(t, err)
+	assert.True(t, secure)
+
+	secure, err = v.Validate(answer("www.insecure."))
+	assert.Nil(t, err)
+	assert.False(t, secure)
+
+	m := answer("www.test.")
+	m.Answer[0].(*dns.A).A[3] = 5
+	_, err = v.Validate(m)
+	assert.NotNil(t, err)
+
+	m = answer("www.test.")
+	m.Answer = m.Answer[:1]
+	_, err = v.Validate(m)
+	assert.NotNil(t, err, "signed zone without signature")
+
+	stripDNSSEC(m)
+	assert.Equal(t, 1, len(m.Answer))
+
+	newNSEC := func(owner, next string, types ...uint16) dns.RR {
+		return &dns.NSEC{
+			Hdr:        dns.RR_Header{Name: owner, Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: 300},
+			NextDomain: next,
+			TypeBitMap: append(types, dns.TypeRRSIG, dns.TypeNSEC),
+		}
+	}
+
+	// 通配符展开的应答需要证明没有更接近的名字
+	wild := test.sign(t, rr("*.wild.test. 300 IN A 9.9.9.9"))
+	for _, x := range wild {
+		x.Header().Name = "a.wild.test."
+	}
+	m = new(dns.Msg)
+	m.SetQuestion("a.wild.test.", dns.TypeA)
+	m.Answer = wild
+	secure, err = v.Validate(m)
+	assert.Nil(t, err)
+	assert.False(t, secure)
+
+	m.Ns = test.sign(t, newNSEC("*.wild.test.", "b.wild.test.", dns.TypeA))
+	secure, err = v.Validate(m)
+	assert.Nil(t, err)
+	assert.True(t, secure)
+
+	// NXDOMAIN 还需要证明最近祖先下没有通配符
+	m = new(dns.Msg)
+	m.SetQuestion("x.test.", dns.TypeA)
+	m.Rcode = dns.RcodeNameError
+	m.Ns = append(m.Ns, test.sign(t, rr("test. 300 IN SOA ns.test. root.test. 1 1800 900 604800 300"))...)
+	m.Ns = append(m.Ns, test.sign(t, newNSEC("www.test.", "test.", dns.TypeA))...)
+	secure, err = v.Validate(m)
+	assert.Nil(t, err)
+	assert.False(t, secure)
+
+	m.Ns = append(m.Ns, test.sign(t, newNSEC("test.", "a.test.", dns.TypeSOA, dns.TypeNS))...)
+	secure, err = v.Validate(m)
+	assert.Nil(t, err)
+	assert.True(t, secure)
+
+	// 只有一条 NSEC3 时匹配区域顶点，并覆盖其他所有名字
+	hash := dns.HashName("test.", dns.SHA1, 0, "")
+	m.Ns = append(m.Ns[:2:2], test.sign(t, &dns.NSEC3{
+		Hdr:        dns.RR_Header{Name: strings.ToLower(hash) + ".test.", Rrtype: dns.TypeNSEC3, Class: dns.ClassINET, Ttl: 300},
+		Hash:       dns.SHA1,
+		HashLength: 20,
+		NextDomain: hash,
+		TypeBitMap: []uint16{dns.TypeNS, dns.TypeSOA, dns.TypeRRSIG},
+	})...)
+	secure, err = v.Validate(m)
+	assert.Nil(t, err)
+	assert.True(t, secure)
+
+	// CD=1 不验证，DO=0 时仍然去掉 DNSSEC 记录
+	h := &Handler{Validator: v}
+	b, _ := answer("www.test.").Pack()
+	for _, do := range []bool{false, true} {
+		b, err := h.validate(b, do, true)
+		assert.Nil(t, err)
+		assert.Nil(t, m.Unpack(b))
+		assert.False(t, m.AuthenticatedData)
+		assert.Equal(t, map[bool]int{false: 1, true: 2}[do], len(m.Answer))
+	}
+}
+
+func TestZoneCache(t *testing.T) {
+	c := newZoneCache[int](2)
+	c.set("a.", 1, 60)
+	c.set("b.", 2, 60)
+	_, ok := c.get("a.")
+	assert.True(t, ok)
+
+	// 超过容量淘汰最久未用的区域
+	c.set("c.", 3, 60)
+	_, ok = c.get("b.")
+	assert.False(t, ok)
+	v, ok := c.get("a.")
+	assert.True(t, ok)
+	assert.Equal(t, 1, v)
+
+	// TTL 到期后失效并删除
+	c.set("d.", 4, 0)
+	_, ok = c.get("d.")
+	assert.False(t, ok)
+	assert.Equal(t, 1, c.lru.Len())
+	assert.Equal(t, 1, len(c.items))
+}
+
+func TestCanonicalCompare(t *testing.T) {
+	assert.Equal(t, -1, canonicalCompare("example.", "a.example."))
+	assert.Equal(t, -1, canonicalCompare("Z.a.example.", "zABC.a.EXAMPLE."))
+	assert.Equal(t, 1, canonicalCompare("b.example.", "a.example."))
+	assert.Equal(t, 0, canonicalCompare("A.example.", "a.example."))
+}
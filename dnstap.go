@@ -0,0 +1,285 @@
+package zns
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	dnstap "github.com/dnstap/golang-dnstap"
+	"google.golang.org/protobuf/proto"
+)
+
+// Transports of queries, which are reported in the dnstap extra field.
+const (
+	TransportUDP   = "udp"
+	TransportTCP   = "tcp"
+	TransportDoT   = "dot"
+	TransportDoQ   = "doq"
+	TransportHTTP1 = "http/1.1"
+	TransportH2    = "h2"
+	TransportH3    = "h3"
+)
+
+// socketProtocolDOQ is DNS over QUIC, which is defined by the latest
+// dnstap.proto but not the generated package.
+const socketProtocolDOQ dnstap.SocketProtocol = 7
+
+// dnstapBuffer is the max number of frames waiting to be written, more
+// frames are dropped.
+const dnstapBuffer = 4096
+
+type transportKey struct{}
+
+// withTransport sets the transport of the query carried by r.
+func withTransport(r *http.Request, transport string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), transportKey{}, transport))
+}
+
+// transport returns the transport of r, which is set by withTransport or
+// the HTTP version.
+func transport(r *http.Request) string {
+	if t, ok := r.Context().Value(transportKey{}).(string); ok {
+		return t
+	}
+	switch r.ProtoMajor {
+	case 3:
+		return TransportH3
+	case 2:
+		return TransportH2
+	default:
+		return TransportHTTP1
+	}
+}
+
+func socketProtocol(transport string) dnstap.SocketProtocol {
+	switch transport {
+	case TransportUDP:
+		return dnstap.SocketProtocol_UDP
+	case TransportTCP:
+		return dnstap.SocketProtocol_TCP
+	case TransportDoT:
+		return dnstap.SocketProtocol_DOT
+	case TransportDoQ:
+		return socketProtocolDOQ
+	default:
+		return dnstap.SocketProtocol_DOH
+	}
+}
+
+// Dnstap writes dnstap frames to a Frame Streams socket or file, see
+// https://dnstap.info.
+type Dnstap struct {
+	// Identity is the server identity in every frame.
+	Identity string
+
+	w dnstap.Writer
+	f *os.File
+	// mu guards closing frames against writes in flight
+	mu      sync.RWMutex
+	closed  bool
+	frames  chan []byte
+	done    chan struct{}
+	dropped atomic.Int64
+}
+
+// NewDnstap creates Dnstap writing to dest, which is a Unix socket like
+// unix:/var/run/dnstap.sock or a file path. An existing file is kept by
+// renaming it with its modification time appended.
+func NewDnstap(dest string) (*Dnstap, error) {
+	t := &Dnstap{frames: make(chan []byte, dnstapBuffer), done: make(chan struct{})}
+	if path, ok := strings.CutPrefix(dest, "unix:"); ok {
+		addr := &net.UnixAddr{Name: path, Net: "unix"}
+		t.w = dnstap.NewSocketWriter(addr, &dnstap.SocketWriterOptions{
+			Timeout:       5 * time.Second,
+			FlushTimeout:  1 * time.Second,
+			RetryInterval: 10 * time.Second,
+			Dialer:        &net.Dialer{Timeout: 5 * time.Second},
+		})
+	} else {
+		// 每个文件只能有一个 Frame Streams 流，旧文件改名保留而不是追加
+		if fi, err := os.Stat(dest); err == nil && fi.Size() > 0 {
+			if err := os.Rename(dest, dest+"."+fi.ModTime().Format("20060102150405")); err != nil {
+				return nil, err
+			}
+		}
+		f, err := os.OpenFile(dest, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0644)
+		if err != nil {
+			return nil, err
+		}
+		if t.w, err = dnstap.NewWriter(f, nil); err != nil {
+			f.Close()
+			return nil, err
+		}
+		t.f = f
+	}
+	go t.run()
+	return t, nil
+}
+
+// Close writes the queued frames and closes the output.
+func (t *Dnstap) Close() {
+	t.mu.Lock()
+	if !t.closed {
+		t.closed = true
+		close(t.frames)
+	}
+	t.mu.Unlock()
+	<-t.done
+}
+
+func (t *Dnstap) run() {
+	defer close(t.done)
+	for b := range t.frames {
+		if n := t.dropped.Swap(0); n > 0 {
+			log.Println("dnstap frames dropped", n)
+		}
+		if _, err := t.w.WriteFrame(b); err != nil {
+			log.Println("Failed to write dnstap frame", err)
+		}
+	}
+	t.w.Close()
+	if t.f != nil {
+		t.f.Close()
+	}
+}
+
+// ClientQuery emits the CLIENT_QUERY frame.
+func (t *Dnstap) ClientQuery(transport string, client netip.AddrPort, query []byte, start time.Time) {
+	m := t.message(dnstap.Message_CLIENT_QUERY, transport, client)
+	setTime(&m.QueryTimeSec, &m.QueryTimeNsec, start)
+	m.QueryMessage = query
+	t.write(m, transport)
+}
+
+// ClientResponse emits the CLIENT_RESPONSE frame.
+func (t *Dnstap) ClientResponse(transport string, client netip.AddrPort, query, answer []byte, start time.Time) {
+	m := t.message(dnstap.Message_CLIENT_RESPONSE, transport, client)
+	setTime(&m.QueryTimeSec, &m.QueryTimeNsec, start)
+	setTime(&m.ResponseTimeSec, &m.ResponseTimeNsec, time.Now())
+	m.QueryMessage = query
+	m.ResponseMessage = answer
+	t.write(m, transport)
+}
+
+// Forward emits the FORWARDER_QUERY and FORWARDER_RESPONSE frames of the
+// query sent to upstream, answer is nil if failed.
+func (t *Dnstap) Forward(upstream string, query, answer []byte, start time.Time) {
+	transport, server := upstreamAddr(upstream)
+
+	m := t.message(dnstap.Message_FORWARDER_QUERY, transport, netip.AddrPort{})
+	setAddr(m, server, false)
+	setTime(&m.QueryTimeSec, &m.QueryTimeNsec, start)
+	m.QueryMessage = query
+	t.write(m, transport)
+
+	if answer == nil {
+		return
+	}
+	m = t.message(dnstap.Message_FORWARDER_RESPONSE, transport, netip.AddrPort{})
+	setAddr(m, server, false)
+	setTime(&m.QueryTimeSec, &m.QueryTimeNsec, start)
+	setTime(&m.ResponseTimeSec, &m.ResponseTimeNsec, time.Now())
+	m.QueryMessage = query
+	m.ResponseMessage = answer
+	t.write(m, transport)
+}
+
+func (t *Dnstap) message(typ dnstap.Message_Type, transport string, client netip.AddrPort) *dnstap.Message {
+	m := &dnstap.Message{
+		Type:           typ.Enum(),
+		SocketProtocol: socketProtocol(transport).Enum(),
+	}
+	setAddr(m, client, true)
+	return m
+}
+
+// write queues the frame of m. The transport is put into the extra field,
+// which tells the HTTP version of DoH.
+func (t *Dnstap) write(m *dnstap.Message, transport string) {
+	typ := dnstap.Dnstap_MESSAGE
+	d := &dnstap.Dnstap{Type: &typ, Message: m, Extra: []byte(transport)}
+	if t.Identity != "" {
+		d.Identity = []byte(t.Identity)
+	}
+	b, err := proto.Marshal(d)
+	if err != nil {
+		log.Println("Failed to marshal dnstap frame", err)
+		return
+	}
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if t.closed {
+		return
+	}
+	select {
+	case t.frames <- b:
+	default:
+		t.dropped.Add(1)
+	}
+}
+
+// setAddr sets the query address if client is true, otherwise the response
+// address.
+func setAddr(m *dnstap.Message, ap netip.AddrPort, client bool) {
+	if !ap.IsValid() {
+		return
+	}
+	ip := ap.Addr().Unmap()
+	family := dnstap.SocketFamily_INET6
+	if ip.Is4() {
+		family = dnstap.SocketFamily_INET
+	}
+	m.SocketFamily = family.Enum()
+	port := uint32(ap.Port())
+	if client {
+		m.QueryAddress, m.QueryPort = ip.AsSlice(), &port
+	} else {
+		m.ResponseAddress, m.ResponsePort = ip.AsSlice(), &port
+	}
+}
+
+func setTime(sec **uint64, nsec **uint32, t time.Time) {
+	s, ns := uint64(t.Unix()), uint32(t.Nanosecond())
+	*sec, *nsec = &s, &ns
+}
+
+// upstreamAddr returns the transport and the address of the upstream url.
+// The address is invalid if the host is not an IP.
+func upstreamAddr(upstream string) (string, netip.AddrPort) {
+	if !strings.Contains(upstream, "://") {
+		upstream = "udp://" + upstream
+	}
+	u, err := url.Parse(upstream)
+	if err != nil {
+		return TransportUDP, netip.AddrPort{}
+	}
+
+	var transport, port string
+	switch u.Scheme {
+	case "tcp":
+		transport, port = TransportTCP, "53"
+	case "tls":
+		transport, port = TransportDoT, "853"
+	case "quic":
+		transport, port = TransportDoQ, "853"
+	case "https":
+		transport, port = TransportH2, "443"
+	case "http":
+		transport, port = TransportHTTP1, "80"
+	default:
+		transport, port = TransportUDP, "53"
+	}
+	if u.Port() != "" {
+		port = u.Port()
+	}
+	ap, _ := netip.ParseAddrPort(net.JoinHostPort(u.Hostname(), port))
+	return transport, ap
+}
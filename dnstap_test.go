@@ -0,0 +1,187 @@
+package zns
+
+import (
+	"encoding/base64"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	dnstap "github.com/dnstap/golang-dnstap"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestUpstreamAddr(t *testing.T) {
+	tr, ap := upstreamAddr("tls://1.1.1.1")
+	assert.Equal(t, TransportDoT, tr)
+	assert.Equal(t, "1.1.1.1:853", ap.String())
+
+	tr, ap = upstreamAddr("[2001:db8::1]:5353")
+	assert.Equal(t, TransportUDP, tr)
+	assert.Equal(t, "[2001:db8::1]:5353", ap.String())
+
+	tr, ap = upstreamAddr("https://doh.pub/dns-query")
+	assert.Equal(t, TransportH2, tr)
+	assert.False(t, ap.IsValid())
+}
+
+func TestDnstap(t *testing.T) {
+	up, stop := testUpstream(t)
+	defer stop()
+
+	path := filepath.Join(t.TempDir(), "dnstap.fstrm")
+	tap, err := NewDnstap(path)
+	assert.Nil(t, err)
+	tap.Identity = "zns"
+
+	h := &Handler{Upstream: up, Repo: FreeTicketRepo{}, Dnstap: tap}
+
+	m := new(dns.Msg)
+	m.SetQuestion("example.com.", dns.TypeA)
+	b, _ := m.Pack()
+
+	req := httptest.NewRequest(http.MethodGet, "/dns/foo?dns="+base64.RawURLEncoding.EncodeToString(b), nil)
+	req.SetPathValue("token", "foo")
+	req.ProtoMajor = 3
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	req = httptest.NewRequest(http.MethodGet, "/dns/foo?dns="+base64.RawURLEncoding.EncodeToString(b), nil)
+	req.SetPathValue("token", "foo")
+	h.ServeHTTP(httptest.NewRecorder(), withTransport(req, TransportDoT))
+
+	tap.Close()
+
+	f, err := os.Open(path)
+	assert.Nil(t, err)
+	defer f.Close()
+	r, err := dnstap.NewReader(f, nil)
+	assert.Nil(t, err)
+
+	var frames []*dnstap.Dnstap
+	buf := make([]byte, 65536)
+	for {
+		n, err := r.ReadFrame(buf)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		assert.Nil(t, err)
+		d := new(dnstap.Dnstap)
+		assert.Nil(t, proto.Unmarshal(buf[:n], d))
+		frames = append(frames, d)
+	}
+
+	assert.Equal(t, 8, len(frames))
+	types := []dnstap.Message_Type{
+		dnstap.Message_CLIENT_QUERY,
+		dnstap.Message_FORWARDER_QUERY,
+		dnstap.Message_FORWARDER_RESPONSE,
+		dnstap.Message_CLIENT_RESPONSE,
+		dnstap.Message_CLIENT_QUERY,
+		dnstap.Message_FORWARDER_QUERY,
+		dnstap.Message_FORWARDER_RESPONSE,
+		dnstap.Message_CLIENT_RESPONSE,
+	}
+	for i, d := range frames {
+		assert.Equal(t, types[i], d.Message.GetType(), i)
+		assert.Equal(t, "zns", string(d.Identity))
+	}
+
+	q := frames[0].Message
+	assert.Equal(t, dnstap.SocketProtocol_DOH, q.GetSocketProtocol())
+	assert.Equal(t, TransportH3, string(frames[0].Extra))
+	assert.Equal(t, []byte{192, 0, 2, 1}, q.QueryAddress)
+	assert.Equal(t, b, q.QueryMessage)
+
+	f1 := frames[2].Message
+	assert.Equal(t, dnstap.SocketProtocol_UDP, f1.GetSocketProtocol())
+	assert.Equal(t, []byte{127, 0, 0, 1}, f1.ResponseAddress)
+	assert.NotNil(t, f1.ResponseMessage)
+
+	a := new(dns.Msg)
+	assert.Nil(t, a.Unpack(frames[3].Message.ResponseMessage))
+	assert.Equal(t, "1.2.3.4", a.Answer[0].(*dns.A).A.String())
+
+	assert.Equal(t, dnstap.SocketProtocol_DOT, frames[4].Message.GetSocketProtocol())
+	assert.Equal(t, TransportDoT, string(frames[4].Extra))
+}
+
+func TestDnstapToken(t *testing.T) {
+	up, stop := testUpstream(t)
+	defer stop()
+
+	path := filepath.Join(t.TempDir(), "dnstap.fstrm")
+	tap, err := NewDnstap(path)
+	assert.Nil(t, err)
+
+	h := &Handler{Upstream: up, Repo: tokenRepo{token: "foo"}, Dnstap: tap}
+
+	query := func(token string) {
+		m := new(dns.Msg)
+		m.SetQuestion("example.com.", dns.TypeA)
+		m.SetEdns0(dns.DefaultMsgSize, false)
+		opt := m.IsEdns0()
+		opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{Code: edns0Token, Data: []byte(token)})
+		b, _ := m.Pack()
+		req := httptest.NewRequest(http.MethodGet, "/dns-query?dns="+base64.RawURLEncoding.EncodeToString(b), nil)
+		h.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	query("bar")
+	query("foo")
+	tap.Close()
+
+	f, err := os.Open(path)
+	assert.Nil(t, err)
+	defer f.Close()
+	r, err := dnstap.NewReader(f, nil)
+	assert.Nil(t, err)
+
+	var clients []*dnstap.Message
+	buf := make([]byte, 65536)
+	for {
+		n, err := r.ReadFrame(buf)
+		if err != nil {
+			break
+		}
+		d := new(dnstap.Dnstap)
+		assert.Nil(t, proto.Unmarshal(buf[:n], d))
+		if typ := d.Message.GetType(); typ == dnstap.Message_CLIENT_QUERY || typ == dnstap.Message_CLIENT_RESPONSE {
+			clients = append(clients, d.Message)
+		}
+	}
+
+	// 无效 token 的查询不写入，有效的查询不含 token
+	assert.Equal(t, 2, len(clients))
+	for _, c := range clients {
+		m := new(dns.Msg)
+		assert.Nil(t, m.Unpack(c.QueryMessage))
+		assert.Equal(t, "", takeToken(m))
+		assert.NotContains(t, string(c.QueryMessage), "foo")
+	}
+}
+
+func TestDnstapKeepFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dnstap.fstrm")
+	os.WriteFile(path, []byte("old"), 0644)
+	mod := time.Date(2025, 1, 2, 3, 4, 5, 0, time.Local)
+	os.Chtimes(path, mod, mod)
+
+	tap, err := NewDnstap(path)
+	assert.Nil(t, err)
+	tap.Close()
+	tap.Forward("udp://192.0.2.1", []byte{0}, nil, time.Now())
+	tap.Close()
+
+	b, err := os.ReadFile(path + ".20250102030405")
+	assert.Nil(t, err)
+	assert.Equal(t, "old", string(b))
+	_, err = os.Stat(path)
+	assert.Nil(t, err)
+}
@@ -0,0 +1,76 @@
+package zns
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// DOQ_INTERNAL_ERROR, see RFC 9250 section 8.4
+const doqInternalError = 0x2
+
+// ServeDoQ serves DNS over QUIC, one query per stream, see RFC 9250.
+func (p *Handler) ServeDoQ(conn quic.Connection) {
+	defer conn.CloseWithError(0, "")
+
+	domain := conn.ConnectionState().TLS.ServerName
+
+	for {
+		s, err := conn.AcceptStream(context.Background())
+		if err != nil {
+			return
+		}
+		go p.serveDoQStream(conn, s, domain)
+	}
+}
+
+func (p *Handler) serveDoQStream(conn quic.Connection, s quic.Stream, domain string) {
+	defer s.Close()
+
+	s.SetDeadline(time.Now().Add(10 * time.Second))
+
+	query, err := readStreamMsg(s)
+	if err != nil {
+		log.Println("reading doq query error", err)
+		s.CancelRead(doqInternalError)
+		s.CancelWrite(doqInternalError)
+		return
+	}
+
+	url := "https://" + domain + ":853/dns-query" + p.listenerQuery("doq")
+	req, err := http.NewRequest("POST", url, io.NopCloser(bytes.NewReader(query)))
+	if err != nil {
+		return
+	}
+
+	req.RemoteAddr = conn.RemoteAddr().String()
+	req = withTransport(req, TransportDoQ)
+
+	w := &tlsWriter{}
+	p.ServeHTTP(w, req)
+
+	// 丢弃的查询关闭流但不应答
+	if w.code == statusDropped {
+		return
+	}
+
+	if w.code == http.StatusTooManyRequests {
+		if w.body, err = refused(query); err != nil {
+			s.CancelWrite(doqInternalError)
+			return
+		}
+	} else if w.code != http.StatusOK && w.code != 0 {
+		log.Println("doq query error", string(w.body))
+		s.CancelWrite(doqInternalError)
+		return
+	}
+
+	if err := writeStreamMsg(s, w.body); err != nil {
+		log.Println("doq writing response body error", err)
+	}
+}
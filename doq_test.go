@@ -0,0 +1,142 @@
+package zns
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func testTLSConfig(t *testing.T) *tls.Config {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+
+	tpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "zns.test"},
+		DNSNames:     []string{"*.zns.test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, tpl, &key.PublicKey, key)
+	assert.Nil(t, err)
+
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+}
+
+// testUpstream starts a UDP DNS server answering A queries with 1.2.3.4.
+func testUpstream(t *testing.T) (*Upstreams, func()) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+
+	s := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		a := new(dns.Msg)
+		a.SetReply(r)
+		rr, _ := dns.NewRR(r.Question[0].Name + " 300 IN A 1.2.3.4")
+		a.Answer = []dns.RR{rr}
+		w.WriteMsg(a)
+	})}
+	go s.ActivateAndServe()
+
+	u, err := NewUpstreams([]string{"udp://" + pc.LocalAddr().String()}, StrategyFailover)
+	assert.Nil(t, err)
+
+	return u, func() { s.Shutdown() }
+}
+
+func TestServeDoQ(t *testing.T) {
+	up, stop := testUpstream(t)
+	defer stop()
+
+	h := &Handler{Upstream: up, Repo: FreeTicketRepo{}}
+
+	cfg := testTLSConfig(t)
+	cfg.NextProtos = []string{"doq"}
+	ln, err := quic.ListenAddr("127.0.0.1:0", cfg, nil)
+	assert.Nil(t, err)
+	defer ln.Close()
+
+	go func() {
+		for {
+			c, err := ln.Accept(context.Background())
+			if err != nil {
+				return
+			}
+			go h.ServeDoQ(c)
+		}
+	}()
+
+	e, err := NewExchanger("quic://foo.zns.test")
+	assert.Nil(t, err)
+	doq := e.(*doqExchanger)
+	doq.addr = ln.Addr().String()
+	doq.cfg.InsecureSkipVerify = true
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	q.Id = 1234
+	question, _ := q.Pack()
+
+	answer, err := e.Exchange(context.Background(), question)
+	assert.Nil(t, err)
+
+	a := new(dns.Msg)
+	assert.Nil(t, a.Unpack(answer))
+	assert.Equal(t, uint16(1234), a.Id)
+	assert.Equal(t, "1.2.3.4", a.Answer[0].(*dns.A).A.String())
+}
+
+func TestServeDoQDropped(t *testing.T) {
+	up, stop := testUpstream(t)
+	defer stop()
+
+	h := &Handler{Upstream: up, Repo: FreeTicketRepo{}, RPZ: testDropRPZ(t)}
+
+	cfg := testTLSConfig(t)
+	cfg.NextProtos = []string{"doq"}
+	ln, err := quic.ListenAddr("127.0.0.1:0", cfg, nil)
+	assert.Nil(t, err)
+	defer ln.Close()
+	go func() {
+		c, err := ln.Accept(context.Background())
+		if err != nil {
+			return
+		}
+		h.ServeDoQ(c)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, err := quic.DialAddr(ctx, ln.Addr().String(), &tls.Config{
+		ServerName:         "foo.zns.test",
+		InsecureSkipVerify: true,
+		NextProtos:         []string{"doq"},
+	}, nil)
+	assert.Nil(t, err)
+	defer c.CloseWithError(0, "")
+
+	s, err := c.OpenStreamSync(ctx)
+	assert.Nil(t, err)
+	q := new(dns.Msg)
+	q.SetQuestion("drop.example.", dns.TypeA)
+	b, _ := q.Pack()
+	assert.Nil(t, writeStreamMsg(s, b))
+	s.Close()
+
+	// 流正常关闭而不是以 DOQ_INTERNAL_ERROR 重置
+	b, err = io.ReadAll(s)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(b))
+}
@@ -0,0 +1,123 @@
+package zns
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// ECSSynthesize sends the client subnet, or the subnet of the client
+	// address if not present.
+	ECSSynthesize = "synthesize"
+	// ECSForward sends the client subnet only.
+	ECSForward = "forward"
+	// ECSStrip never sends the client subnet.
+	ECSStrip = "strip"
+)
+
+// ECSPolicy decides the EDNS Client Subnet sent to upstreams, see RFC 7871.
+//
+// Clients can always opt out with a 0.0.0.0/0 or ::/0 subnet.
+type ECSPolicy struct {
+	Mode string
+	// Bits4 and Bits6 are the max prefix lengths sent to upstreams.
+	Bits4 int
+	Bits6 int
+}
+
+// DefaultECSPolicy synthesizes /24 for IPv4 and /48 for IPv6.
+var DefaultECSPolicy = &ECSPolicy{Mode: ECSSynthesize, Bits4: 24, Bits6: 48}
+
+// NewECSPolicy creates ECSPolicy with the mode and prefix lengths.
+func NewECSPolicy(mode string, bits4, bits6 int) (*ECSPolicy, error) {
+	switch mode {
+	case "":
+		mode = ECSSynthesize
+	case ECSSynthesize, ECSForward, ECSStrip:
+	default:
+		return nil, errors.New("invalid ecs mode: " + mode)
+	}
+	if bits4 < 0 || bits4 > 32 || bits6 < 0 || bits6 > 128 {
+		return nil, errors.New("invalid ecs prefix length")
+	}
+	return &ECSPolicy{Mode: mode, Bits4: bits4, Bits6: bits6}, nil
+}
+
+// Apply replaces the client subnet of m by the policy. The fixed subnet
+// of the token is used instead if valid, and client is the address of
+// the client.
+func (p *ECSPolicy) Apply(m *dns.Msg, client netip.Addr, fixed netip.Prefix) {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return
+	}
+
+	var ecs *dns.EDNS0_SUBNET
+	opts := opt.Option[:0]
+	for _, o := range opt.Option {
+		if e, ok := o.(*dns.EDNS0_SUBNET); ok {
+			if ecs == nil {
+				ecs = e
+			}
+			continue
+		}
+		opts = append(opts, o)
+	}
+	opt.Option = opts
+
+	var subnet netip.Prefix
+	switch {
+	case ecs != nil && ecs.SourceNetmask == 0:
+		// 客户端明确拒绝传递子网，见 RFC 7871 7.1.2
+		if p.Mode != ECSStrip {
+			ecs.SourceScope = 0
+			opt.Option = append(opt.Option, ecs)
+		}
+		return
+	case fixed.IsValid():
+		subnet = fixed
+	case p.Mode == ECSStrip:
+		return
+	case ecs != nil:
+		addr, ok := netip.AddrFromSlice(ecs.Address)
+		if !ok {
+			return
+		}
+		subnet = netip.PrefixFrom(addr.Unmap(), int(ecs.SourceNetmask))
+	case p.Mode == ECSSynthesize && client.IsValid():
+		client = client.Unmap()
+		subnet = netip.PrefixFrom(client, client.BitLen())
+	default:
+		return
+	}
+
+	if e := p.option(subnet); e != nil {
+		opt.Option = append(opt.Option, e)
+	}
+}
+
+// option builds the ECS option of subnet truncated to the max prefix length.
+func (p *ECSPolicy) option(subnet netip.Prefix) *dns.EDNS0_SUBNET {
+	e := &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET}
+	bits := subnet.Bits()
+	if subnet.Addr().Is4() {
+		e.Family = 1
+		bits = min(bits, p.Bits4)
+	} else {
+		e.Family = 2
+		bits = min(bits, p.Bits6)
+	}
+	if bits <= 0 {
+		return nil
+	}
+	s, err := subnet.Addr().Prefix(bits)
+	if err != nil {
+		return nil
+	}
+	e.SourceNetmask = uint8(bits)
+	e.Address = net.IP(s.Addr().AsSlice())
+	return e
+}
@@ -0,0 +1,64 @@
+package zns
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestECSPolicy(t *testing.T) {
+	client := netip.MustParseAddr("192.0.2.99")
+	apply := func(p *ECSPolicy, subnet string, fixed string) string {
+		m := new(dns.Msg)
+		m.SetQuestion("example.com.", dns.TypeA)
+		m.SetEdns0(dns.DefaultMsgSize, false)
+		if subnet != "" {
+			s := netip.MustParsePrefix(subnet)
+			m.IsEdns0().Option = append(m.IsEdns0().Option, &dns.EDNS0_SUBNET{
+				Code:          dns.EDNS0SUBNET,
+				Family:        1,
+				SourceNetmask: uint8(s.Bits()),
+				Address:       s.Addr().AsSlice(),
+			})
+		}
+		var f netip.Prefix
+		if fixed != "" {
+			f = netip.MustParsePrefix(fixed)
+		}
+		p.Apply(m, client, f)
+		p2 := ecsPrefix(m, false)
+		if !p2.IsValid() {
+			return ""
+		}
+		return p2.String()
+	}
+
+	p := DefaultECSPolicy
+	assert.Equal(t, "192.0.2.0/24", apply(p, "", ""))
+	assert.Equal(t, "198.51.100.0/24", apply(p, "198.51.100.0/24", ""))
+	assert.Equal(t, "198.51.0.0/16", apply(p, "198.51.0.0/16", ""))
+	assert.Equal(t, "0.0.0.0/0", apply(p, "0.0.0.0/0", ""))
+	assert.Equal(t, "203.0.113.0/24", apply(p, "", "203.0.113.0/24"))
+	assert.Equal(t, "0.0.0.0/0", apply(p, "0.0.0.0/0", "203.0.113.0/24"))
+
+	p, err := NewECSPolicy(ECSSynthesize, 16, 32)
+	assert.Nil(t, err)
+	assert.Equal(t, "192.0.0.0/16", apply(p, "", ""))
+	assert.Equal(t, "198.51.0.0/16", apply(p, "198.51.100.0/24", ""))
+
+	p, _ = NewECSPolicy(ECSForward, 24, 48)
+	assert.Equal(t, "", apply(p, "", ""))
+	assert.Equal(t, "198.51.100.0/24", apply(p, "198.51.100.0/24", ""))
+
+	p, _ = NewECSPolicy(ECSStrip, 24, 48)
+	assert.Equal(t, "", apply(p, "198.51.100.0/24", ""))
+	assert.Equal(t, "", apply(p, "0.0.0.0/0", ""))
+	assert.Equal(t, "203.0.113.0/24", apply(p, "", "203.0.113.0/24"))
+
+	_, err = NewECSPolicy("all", 24, 48)
+	assert.NotNil(t, err)
+	_, err = NewECSPolicy(ECSForward, 33, 48)
+	assert.NotNil(t, err)
+}
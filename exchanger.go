@@ -0,0 +1,417 @@
+package zns
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+)
+
+const exchangeTimeout = 5 * time.Second
+
+// Exchanger sends one packed DNS query and returns the packed answer.
+type Exchanger interface {
+	Exchange(ctx context.Context, question []byte) ([]byte, error)
+}
+
+// NewExchanger creates an Exchanger by the scheme of addr.
+//
+//	udp://1.1.1.1:53
+//	tcp://1.1.1.1:53
+//	tls://1.1.1.1:853
+//	quic://dns.adguard-dns.com:853
+//	https://1.1.1.1/dns-query
+//
+// The port can be omitted. Plain ip:port is the same as udp.
+func NewExchanger(addr string) (Exchanger, error) {
+	if !strings.Contains(addr, "://") {
+		addr = "udp://" + addr
+	}
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	host := u.Host
+	port := func(p string) string {
+		if u.Port() == "" {
+			return net.JoinHostPort(u.Hostname(), p)
+		}
+		return host
+	}
+	tlsCfg := func(alpn string) *tls.Config {
+		return &tls.Config{ServerName: u.Hostname(), NextProtos: []string{alpn}}
+	}
+
+	switch u.Scheme {
+	case "https", "http":
+		return dohExchanger{url: addr}, nil
+	case "udp":
+		return &dnsExchanger{addr: port("53")}, nil
+	case "tcp":
+		return &dnsExchanger{addr: port("53"), tcp: true}, nil
+	case "tls":
+		return &dotExchanger{addr: port("853"), cfg: tlsCfg("dot")}, nil
+	case "quic":
+		return &doqExchanger{addr: port("853"), cfg: tlsCfg("doq")}, nil
+	default:
+		return nil, errors.New("unsupported upstream: " + addr)
+	}
+}
+
+var upstreamClient = &http.Client{Timeout: exchangeTimeout}
+
+type dohExchanger struct {
+	url string
+}
+
+func (e dohExchanger) Exchange(ctx context.Context, question []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.url, bytes.NewReader(question))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("content-type", "application/dns-message")
+
+	resp, err := upstreamClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("upstream error: " + resp.Status)
+	}
+
+	return io.ReadAll(resp.Body)
+}
+
+// dnsExchanger sends queries over UDP and retries over TCP if truncated.
+type dnsExchanger struct {
+	addr string
+	tcp  bool
+}
+
+func (e *dnsExchanger) Exchange(ctx context.Context, question []byte) ([]byte, error) {
+	if len(question) < 2 {
+		return nil, dns.ErrShortRead
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, exchangeTimeout)
+	defer cancel()
+
+	if !e.tcp {
+		answer, err := e.exchange(ctx, "udp", question)
+		if err != nil {
+			return nil, err
+		}
+		// TC 位在第三个字节
+		if len(answer) < 3 || answer[2]&0x02 == 0 {
+			return answer, nil
+		}
+	}
+	return e.exchange(ctx, "tcp", question)
+}
+
+func (e *dnsExchanger) exchange(ctx context.Context, network string, question []byte) ([]byte, error) {
+	var d net.Dialer
+	c, err := d.DialContext(ctx, network, e.addr)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	if t, ok := ctx.Deadline(); ok {
+		c.SetDeadline(t)
+	}
+
+	if network == "tcp" {
+		return exchangeStream(c, question)
+	}
+
+	if _, err = c.Write(question); err != nil {
+		return nil, err
+	}
+	id := binary.BigEndian.Uint16(question)
+	b := make([]byte, dns.MaxMsgSize)
+	for {
+		n, err := c.Read(b)
+		if err != nil {
+			return nil, err
+		}
+		// 丢弃 ID 不匹配的应答，防止投毒
+		if n >= 2 && binary.BigEndian.Uint16(b) == id {
+			return b[:n], nil
+		}
+	}
+}
+
+// exchangeStream writes the query and reads the answer with 2-byte length
+// framing, see RFC 1035 section 4.2.2.
+func exchangeStream(c io.ReadWriter, question []byte) ([]byte, error) {
+	if err := writeStreamMsg(c, question); err != nil {
+		return nil, err
+	}
+	return readStreamMsg(c)
+}
+
+func writeStreamMsg(w io.Writer, msg []byte) error {
+	buf := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(buf, uint16(len(msg)))
+	copy(buf[2:], msg)
+	_, err := w.Write(buf)
+	return err
+}
+
+func readStreamMsg(r io.Reader) ([]byte, error) {
+	var l [2]byte
+	if _, err := io.ReadFull(r, l[:]); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(l[:]))
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// dotExchanger reuses one TLS connection and pipelines queries on it.
+//
+// Query IDs are rewritten to match out-of-order answers, see RFC 7766.
+type dotExchanger struct {
+	addr string
+	cfg  *tls.Config
+
+	mu   sync.Mutex
+	conn *dotConn
+}
+
+type dotConn struct {
+	c net.Conn
+
+	wmu sync.Mutex
+
+	mu      sync.Mutex
+	id      uint16
+	pending map[uint16]chan []byte
+	err     error
+}
+
+func (e *dotExchanger) Exchange(ctx context.Context, question []byte) ([]byte, error) {
+	if len(question) < 2 {
+		return nil, dns.ErrShortRead
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, exchangeTimeout)
+	defer cancel()
+
+	dc, err := e.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	id, c, err := dc.add()
+	if err != nil {
+		return nil, err
+	}
+	defer dc.remove(id, c)
+
+	q := bytes.Clone(question)
+	binary.BigEndian.PutUint16(q, id)
+
+	dc.wmu.Lock()
+	if t, ok := ctx.Deadline(); ok {
+		dc.c.SetWriteDeadline(t)
+	}
+	err = writeStreamMsg(dc.c, q)
+	dc.wmu.Unlock()
+	if err != nil {
+		dc.c.Close()
+		return nil, err
+	}
+
+	select {
+	case answer, ok := <-c:
+		if !ok {
+			return nil, dc.error()
+		}
+		copy(answer, question[:2])
+		return answer, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (e *dotExchanger) dial(ctx context.Context) (*dotConn, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.conn != nil && e.conn.error() == nil {
+		return e.conn, nil
+	}
+
+	d := tls.Dialer{Config: e.cfg}
+	c, err := d.DialContext(ctx, "tcp", e.addr)
+	if err != nil {
+		return nil, err
+	}
+
+	e.conn = &dotConn{c: c, pending: map[uint16]chan []byte{}}
+	go e.conn.read()
+	return e.conn, nil
+}
+
+func (dc *dotConn) add() (uint16, chan []byte, error) {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+
+	if dc.err != nil {
+		return 0, nil, dc.err
+	}
+	for {
+		dc.id++
+		if _, ok := dc.pending[dc.id]; !ok {
+			break
+		}
+	}
+	c := make(chan []byte, 1)
+	dc.pending[dc.id] = c
+	return dc.id, c, nil
+}
+
+// remove deletes the pending query id, unless it is answered and the id is
+// used by another query.
+func (dc *dotConn) remove(id uint16, c chan []byte) {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	if dc.pending[id] == c {
+		delete(dc.pending, id)
+	}
+}
+
+func (dc *dotConn) error() error {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	return dc.err
+}
+
+func (dc *dotConn) read() {
+	defer dc.c.Close()
+	for {
+		// 服务端通常会关闭空闲连接
+		dc.c.SetReadDeadline(time.Now().Add(2 * time.Minute))
+		answer, err := readStreamMsg(dc.c)
+		if err == nil && len(answer) < 2 {
+			err = dns.ErrShortRead
+		}
+
+		dc.mu.Lock()
+		if err != nil {
+			dc.err = err
+			for id, c := range dc.pending {
+				close(c)
+				delete(dc.pending, id)
+			}
+			dc.mu.Unlock()
+			return
+		}
+		// 每个查询只接收一次应答，重复的应答不能阻塞读取
+		id := binary.BigEndian.Uint16(answer)
+		if c, ok := dc.pending[id]; ok {
+			delete(dc.pending, id)
+			select {
+			case c <- answer:
+			default:
+			}
+		}
+		dc.mu.Unlock()
+	}
+}
+
+// doqExchanger sends each query on a new stream of one QUIC connection,
+// see RFC 9250.
+type doqExchanger struct {
+	addr string
+	cfg  *tls.Config
+
+	mu   sync.Mutex
+	conn quic.Connection
+}
+
+func (e *doqExchanger) Exchange(ctx context.Context, question []byte) ([]byte, error) {
+	if len(question) < 2 {
+		return nil, dns.ErrShortRead
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, exchangeTimeout)
+	defer cancel()
+
+	conn, err := e.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		e.reset(conn)
+		return nil, err
+	}
+	defer s.CancelRead(0)
+
+	if t, ok := ctx.Deadline(); ok {
+		s.SetDeadline(t)
+	}
+
+	// DoQ 要求 ID 为零
+	q := bytes.Clone(question)
+	binary.BigEndian.PutUint16(q, 0)
+	if err = writeStreamMsg(s, q); err != nil {
+		return nil, err
+	}
+	s.Close()
+
+	answer, err := readStreamMsg(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(answer) < 2 {
+		return nil, dns.ErrShortRead
+	}
+	copy(answer, question[:2])
+	return answer, nil
+}
+
+func (e *doqExchanger) dial(ctx context.Context) (quic.Connection, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.conn != nil && e.conn.Context().Err() == nil {
+		return e.conn, nil
+	}
+
+	conn, err := quic.DialAddr(ctx, e.addr, e.cfg, nil)
+	if err != nil {
+		return nil, err
+	}
+	e.conn = conn
+	return conn, nil
+}
+
+func (e *doqExchanger) reset(conn quic.Connection) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.conn == conn {
+		e.conn.CloseWithError(0, "")
+		e.conn = nil
+	}
+}
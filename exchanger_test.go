@@ -0,0 +1,131 @@
+package zns
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewExchanger(t *testing.T) {
+	e, err := NewExchanger("1.1.1.1")
+	assert.Nil(t, err)
+	assert.Equal(t, &dnsExchanger{addr: "1.1.1.1:53"}, e)
+
+	e, err = NewExchanger("tcp://[::1]:5353")
+	assert.Nil(t, err)
+	assert.Equal(t, &dnsExchanger{addr: "[::1]:5353", tcp: true}, e)
+
+	e, err = NewExchanger("tls://dns.google")
+	assert.Nil(t, err)
+	assert.Equal(t, "dns.google:853", e.(*dotExchanger).addr)
+	assert.Equal(t, "dns.google", e.(*dotExchanger).cfg.ServerName)
+
+	e, err = NewExchanger("quic://dns.adguard-dns.com")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"doq"}, e.(*doqExchanger).cfg.NextProtos)
+
+	_, err = NewExchanger("sdns://foo")
+	assert.NotNil(t, err)
+}
+
+func TestDNSExchangerTruncated(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	ln, err := net.Listen("tcp", pc.LocalAddr().String())
+	assert.Nil(t, err)
+
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		a := new(dns.Msg)
+		a.SetReply(r)
+		if w.RemoteAddr().Network() == "udp" {
+			a.Truncated = true
+		} else {
+			rr, _ := dns.NewRR("example.com. 300 IN A 1.2.3.4")
+			a.Answer = []dns.RR{rr}
+		}
+		w.WriteMsg(a)
+	})
+
+	udp := &dns.Server{PacketConn: pc, Handler: handler}
+	tcp := &dns.Server{Listener: ln, Handler: handler}
+	go udp.ActivateAndServe()
+	go tcp.ActivateAndServe()
+	defer udp.Shutdown()
+	defer tcp.Shutdown()
+
+	e, err := NewExchanger("udp://" + pc.LocalAddr().String())
+	assert.Nil(t, err)
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	question, _ := q.Pack()
+
+	answer, err := e.Exchange(context.Background(), question)
+	assert.Nil(t, err)
+
+	a := new(dns.Msg)
+	assert.Nil(t, a.Unpack(answer))
+	assert.Equal(t, q.Id, a.Id)
+	assert.False(t, a.Truncated)
+	assert.Equal(t, 1, len(a.Answer))
+}
+
+func TestDoTExchangerDuplicate(t *testing.T) {
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", testTLSConfig(t))
+	assert.Nil(t, err)
+	defer ln.Close()
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		for {
+			q, err := readStreamMsg(c)
+			if err != nil {
+				return
+			}
+			m := new(dns.Msg)
+			m.Unpack(q)
+			a := new(dns.Msg)
+			a.SetReply(m)
+			b, _ := a.Pack()
+			// 重复的应答
+			for range 3 {
+				writeStreamMsg(c, b)
+			}
+		}
+	}()
+
+	e, err := NewExchanger("tls://foo.zns.test")
+	assert.Nil(t, err)
+	dot := e.(*dotExchanger)
+	dot.addr = ln.Addr().String()
+	dot.cfg.InsecureSkipVerify = true
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	question, _ := q.Pack()
+
+	done := make(chan error)
+	go func() {
+		for range 2 {
+			if _, err := e.Exchange(context.Background(), question); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+	select {
+	case err := <-done:
+		assert.Nil(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("exchange blocked by duplicate answers")
+	}
+}
@@ -0,0 +1,366 @@
+package zns
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Filter is the custom block and allow rules of one token. Rules use the
+// same syntax as the blocklist, like ||ads.example^ or example.com.
+type Filter struct {
+	Token string   `json:"-"`
+	Lists []string `json:"lists"`
+	Deny  []string `json:"deny"`
+	Allow []string `json:"allow"`
+
+	// SafeSearch forces safe search of search engines.
+	SafeSearch bool `json:"safe_search"`
+	// DNS64 synthesizes AAAA records for IPv6-only clients.
+	DNS64 bool `json:"dns64"`
+	// ECS is the fixed client subnet sent to upstreams, like 1.2.3.0/24.
+	ECS string `json:"ecs,omitempty"`
+	// NoLog opts out of the query log.
+	NoLog bool `json:"no_log"`
+
+	Updated time.Time `json:"updated"`
+}
+
+const (
+	// maxFilterRules limits the number of custom rules of each token.
+	maxFilterRules = 1000
+	// maxFilterRegexpSize limits the total instructions of the regular
+	// expressions of each token.
+	maxFilterRegexpSize = 20000
+)
+
+type filterRow struct {
+	Token      string    `db:"token"`
+	Lists      string    `db:"lists"`
+	Deny       string    `db:"deny"`
+	Allow      string    `db:"allow"`
+	SafeSearch bool      `db:"safe_search"`
+	DNS64      bool      `db:"dns64"`
+	ECS        string    `db:"ecs"`
+	NoLog      bool      `db:"no_log"`
+	Updated    time.Time `db:"updated"`
+}
+
+func (_ *filterRow) KeyName() string   { return "token" }
+func (_ *filterRow) TableName() string { return "filters" }
+func (f *filterRow) Schema() string {
+	return "CREATE TABLE IF NOT EXISTS " + f.TableName() + `(
+	` + f.KeyName() + ` TEXT PRIMARY KEY,
+	lists TEXT,
+	deny TEXT,
+	allow TEXT,
+	safe_search INTEGER DEFAULT 0,
+	dns64 INTEGER DEFAULT 0,
+	ecs TEXT DEFAULT '',
+	no_log INTEGER DEFAULT 0,
+	updated DATETIME
+);`
+}
+
+type FilterRepo interface {
+	// GetFilter fetches the Filter of token, empty if not set.
+	GetFilter(token string) (Filter, error)
+	// SetFilter creates or replaces the Filter.
+	SetFilter(f Filter) error
+}
+
+func (r sqliteTicketReop) GetFilter(token string) (f Filter, err error) {
+	defer observeSQL("get_filter", time.Now())
+
+	var row filterRow
+	q := "select * from " + (*filterRow).TableName(nil) + " where token = ?"
+	err = r.db.Get(&row, q, token)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Filter{Token: token}, nil
+	}
+	if err != nil {
+		return
+	}
+	return Filter{
+		Token:      row.Token,
+		Lists:      splitLines(row.Lists),
+		Deny:       splitLines(row.Deny),
+		Allow:      splitLines(row.Allow),
+		SafeSearch: row.SafeSearch,
+		DNS64:      row.DNS64,
+		ECS:        row.ECS,
+		NoLog:      row.NoLog,
+		Updated:    row.Updated,
+	}, nil
+}
+
+func (r sqliteTicketReop) SetFilter(f Filter) error {
+	defer observeSQL("set_filter", time.Now())
+
+	q := "insert or replace into " + (*filterRow).TableName(nil) +
+		"(token, lists, deny, allow, safe_search, dns64, ecs, no_log, updated) values (?, ?, ?, ?, ?, ?, ?, ?, ?)"
+	_, err := r.db.Exec(q, f.Token,
+		strings.Join(f.Lists, "\n"),
+		strings.Join(f.Deny, "\n"),
+		strings.Join(f.Allow, "\n"),
+		f.SafeSearch,
+		f.DNS64,
+		f.ECS,
+		f.NoLog,
+		f.Updated,
+	)
+	return err
+}
+
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, "\n")
+}
+
+// filterTTL is how long a loaded Filter is used before reading it again,
+// so that changes made by other instances take effect.
+const filterTTL = 1 * time.Minute
+
+type tokenFilter struct {
+	lists      []string
+	rules      *ruleSet
+	safeSearch bool
+	dns64      bool
+	ecs        netip.Prefix
+	noLog      bool
+	loaded     time.Time
+}
+
+// Filters applies the custom rules of each token and serves the API to
+// manage them.
+//
+//	GET /ticket/{token}/filter
+//	PUT /ticket/{token}/filter {"lists":["ads"],"deny":["||ads.example^"],"allow":["good.example"]}
+type Filters struct {
+	Repo      FilterRepo
+	Tickets   TicketRepo
+	Blocklist *Blocklist
+	AltSvc    string
+
+	cache sync.Map // token -> *tokenFilter
+}
+
+// customList is the list name reported for the custom rules of tokens.
+const customList = "custom"
+
+// Lookup returns the list blocking name for token and the Extended DNS
+// Error code, which is Filtered for the token's own rules and lists and
+// Blocked for the others. With all being true, all the shared lists are
+// used besides the subscribed ones.
+func (fs *Filters) Lookup(token, name string, all bool) (list string, code uint16, err error) {
+	f, err := fs.load(token)
+	if err != nil {
+		return
+	}
+
+	if f.rules != nil {
+		blocked, allowed := f.rules.Match(name)
+		if allowed {
+			return
+		}
+		if blocked {
+			return customList, dns.ExtendedErrorCodeFiltered, nil
+		}
+	}
+
+	if fs.Blocklist == nil {
+		return
+	}
+	if l, ok := fs.Blocklist.Lookup(name, f.lists); ok {
+		return l, dns.ExtendedErrorCodeFiltered, nil
+	}
+	if all {
+		if l, ok := fs.Blocklist.LookupAll(name); ok {
+			return l, dns.ExtendedErrorCodeBlocked, nil
+		}
+	}
+	return
+}
+
+// SafeSearch reports whether token forces safe search.
+func (fs *Filters) SafeSearch(token string) (bool, error) {
+	f, err := fs.load(token)
+	if err != nil {
+		return false, err
+	}
+	return f.safeSearch, nil
+}
+
+// DNS64 reports whether token uses DNS64.
+func (fs *Filters) DNS64(token string) (bool, error) {
+	f, err := fs.load(token)
+	if err != nil {
+		return false, err
+	}
+	return f.dns64, nil
+}
+
+// ECS returns the fixed client subnet of token, invalid if not set.
+func (fs *Filters) ECS(token string) (netip.Prefix, error) {
+	f, err := fs.load(token)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return f.ecs, nil
+}
+
+// NoLog reports whether token opts out of the query log.
+func (fs *Filters) NoLog(token string) (bool, error) {
+	f, err := fs.load(token)
+	if err != nil {
+		return false, err
+	}
+	return f.noLog, nil
+}
+
+func (fs *Filters) load(token string) (*tokenFilter, error) {
+	if v, ok := fs.cache.Load(token); ok {
+		if f := v.(*tokenFilter); time.Since(f.loaded) < filterTTL {
+			return f, nil
+		}
+	}
+
+	f, err := fs.Repo.GetFilter(token)
+	if err != nil {
+		return nil, err
+	}
+	tf, err := compileFilter(f)
+	if err != nil {
+		return nil, err
+	}
+	fs.cache.Store(token, tf)
+	return tf, nil
+}
+
+func compileFilter(f Filter) (*tokenFilter, error) {
+	tf := &tokenFilter{lists: f.Lists, safeSearch: f.SafeSearch, dns64: f.DNS64, noLog: f.NoLog, loaded: time.Now()}
+	if f.ECS != "" {
+		p, err := netip.ParsePrefix(f.ECS)
+		if err != nil {
+			return nil, fmt.Errorf("ecs: %w", err)
+		}
+		tf.ecs = p.Masked()
+	}
+	if len(f.Deny)+len(f.Allow) == 0 {
+		return tf, nil
+	}
+	if len(f.Deny)+len(f.Allow) > maxFilterRules {
+		return nil, fmt.Errorf("too many rules, max %d", maxFilterRules)
+	}
+
+	var rules []blockRule
+	size := 0
+	for i, s := range f.Deny {
+		rs, err := parseRule(s)
+		if err != nil {
+			return nil, fmt.Errorf("deny %d: %w", i, err)
+		}
+		size += rulesSize(rs)
+		rules = append(rules, rs...)
+	}
+	for i, s := range f.Allow {
+		rs, err := parseRule(s)
+		if err != nil {
+			return nil, fmt.Errorf("allow %d: %w", i, err)
+		}
+		size += rulesSize(rs)
+		for _, r := range rs {
+			r.allow = true
+			rules = append(rules, r)
+		}
+	}
+	// 查询时编译规则，复杂的正则会阻塞查询
+	if size > maxFilterRegexpSize {
+		return nil, fmt.Errorf("regular expressions too complex, max size %d", maxFilterRegexpSize)
+	}
+	rs, err := newRuleSet(rules)
+	if err != nil {
+		return nil, err
+	}
+	tf.rules = rs
+	return tf, nil
+}
+
+// rulesSize returns the total size of the regular expressions of rules.
+func rulesSize(rules []blockRule) (n int) {
+	for _, r := range rules {
+		if r.pattern != "" {
+			n += regexpSize(r.pattern)
+		}
+	}
+	return n
+}
+
+func (fs *Filters) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if fs.AltSvc != "" {
+		w.Header().Set("Alt-Svc", fs.AltSvc)
+	}
+
+	token := r.PathValue("token")
+	ts, err := fs.Tickets.List(token, 1)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if len(ts) == 0 {
+		http.Error(w, "invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		f, err := fs.Repo.GetFilter(token)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Add("content-type", "application/json")
+		json.NewEncoder(w).Encode(f)
+	case http.MethodPut, http.MethodPost:
+		var f Filter
+		defer r.Body.Close()
+		if err := json.NewDecoder(r.Body).Decode(&f); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		for _, l := range f.Lists {
+			if fs.Blocklist == nil || !fs.Blocklist.Has(l) {
+				http.Error(w, "unknown list "+l, http.StatusBadRequest)
+				return
+			}
+		}
+		f.Token = token
+		f.Updated = time.Now()
+
+		tf, err := compileFilter(f)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := fs.Repo.SetFilter(f); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		fs.cache.Store(token, tf)
+
+		w.Header().Add("content-type", "application/json")
+		json.NewEncoder(w).Encode(f)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
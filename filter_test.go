@@ -0,0 +1,110 @@
+package zns
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFilterRepo(t *testing.T) {
+	r := NewTicketRepo(":memory:").(FilterRepo)
+
+	f, err := r.GetFilter("foo")
+	assert.Nil(t, err)
+	assert.Equal(t, Filter{Token: "foo"}, f)
+
+	f.Lists = []string{"ads"}
+	f.Deny = []string{"||ads.example^", "bad.example"}
+	assert.Nil(t, r.SetFilter(f))
+
+	f, err = r.GetFilter("foo")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"ads"}, f.Lists)
+	assert.Equal(t, []string{"||ads.example^", "bad.example"}, f.Deny)
+	assert.Nil(t, f.Allow)
+}
+
+func TestFilters(t *testing.T) {
+	up, stop := testUpstream(t)
+	defer stop()
+
+	file := filepath.Join(t.TempDir(), "ads.txt")
+	os.WriteFile(file, []byte("||ads.example^\n||tracker.example^\n"), 0644)
+	bl, err := NewBlocklist([]string{"ads=" + file})
+	assert.Nil(t, err)
+
+	repo := NewTicketRepo(":memory:")
+	repo.New("foo", 1000, "buy-1", "pay-1")
+
+	fs := &Filters{Repo: repo.(FilterRepo), Tickets: repo, Blocklist: bl}
+	h := &Handler{Upstream: up, Repo: repo, Blocklist: bl, Filters: fs}
+
+	put := func(token, body string) int {
+		req := httptest.NewRequest(http.MethodPut, "/ticket/"+token+"/filter", strings.NewReader(body))
+		req.SetPathValue("token", token)
+		w := httptest.NewRecorder()
+		fs.ServeHTTP(w, req)
+		return w.Code
+	}
+	var ede *dns.EDNS0_EDE
+	query := func(name string, noad bool) int {
+		m := new(dns.Msg)
+		m.SetQuestion(name, dns.TypeA)
+		b, _ := m.Pack()
+		url := "/dns/foo?dns=" + base64.RawURLEncoding.EncodeToString(b)
+		if noad {
+			url += "&noad=1"
+		}
+		req := httptest.NewRequest(http.MethodGet, url, nil)
+		req.SetPathValue("token", "foo")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Nil(t, m.Unpack(w.Body.Bytes()))
+		if es := edes(m); len(es) > 0 {
+			ede = es[0]
+		}
+		return m.Rcode
+	}
+
+	// nothing blocked without subscription
+	assert.Equal(t, dns.RcodeSuccess, query("ads.example.", false))
+	assert.Equal(t, dns.RcodeNameError, query("ads.example.", true))
+	assert.Equal(t, dns.ExtendedErrorCodeBlocked, ede.InfoCode)
+	assert.Equal(t, "blocked by ads", ede.ExtraText)
+
+	assert.Equal(t, http.StatusUnauthorized, put("bar", `{}`))
+	assert.Equal(t, http.StatusBadRequest, put("foo", `{"lists":["malware"]}`))
+	assert.Equal(t, http.StatusBadRequest, put("foo", `{"deny":["not a domain"]}`))
+	assert.Equal(t, http.StatusBadRequest, put("foo", `{"deny":[`+strings.Repeat(`"/a{1,1000}x/",`, 20)+`"/b/"]}`))
+	assert.Equal(t, http.StatusOK, put("foo", `{
+		"lists": ["ads"],
+		"deny": ["||custom.example^"],
+		"allow": ["tracker.example"]
+	}`))
+
+	assert.Equal(t, dns.RcodeNameError, query("ads.example.", false))
+	assert.Equal(t, dns.RcodeNameError, query("www.custom.example.", false))
+	assert.Equal(t, dns.ExtendedErrorCodeFiltered, ede.InfoCode)
+	assert.Equal(t, "blocked by custom", ede.ExtraText)
+	assert.Equal(t, dns.RcodeSuccess, query("tracker.example.", false))
+	assert.Equal(t, dns.RcodeSuccess, query("tracker.example.", true))
+	assert.Equal(t, dns.RcodeSuccess, query("example.com.", false))
+
+	req := httptest.NewRequest(http.MethodGet, "/ticket/foo/filter", nil)
+	req.SetPathValue("token", "foo")
+	w := httptest.NewRecorder()
+	fs.ServeHTTP(w, req)
+	var f Filter
+	assert.Nil(t, json.NewDecoder(bytes.NewReader(w.Body.Bytes())).Decode(&f))
+	assert.Equal(t, []string{"||custom.example^"}, f.Deny)
+}
@@ -0,0 +1,191 @@
+package zns
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+type forwardRule struct {
+	suffix string
+	// upstream urls separated by comma
+	upstreams string
+}
+
+// Forwarder routes queries to different upstreams by domain suffix, and
+// the longest matched suffix wins. Rules are loaded from files or URLs
+// with lines like
+//
+//	corp.example udp://10.0.0.1,tls://10.0.0.2
+//	*.in-addr.arpa 10.0.0.1
+//	server=/consul/127.0.0.1#8600
+//
+// The last one is the dnsmasq format used by lists like dnsmasq-china-list.
+type Forwarder struct {
+	Sources []string
+	// Strategy is used by upstreams of each rule, see NewUpstreams.
+	Strategy string
+
+	routes atomic.Pointer[map[string]*Upstreams]
+
+	sourceSet[[]forwardRule]
+	// 按地址复用上游，重新加载后保留熔断和延迟状态
+	upstreams map[string]*Upstreams
+}
+
+// NewForwarder creates a Forwarder and loads all the sources.
+func NewForwarder(sources []string, strategy string) (*Forwarder, error) {
+	f := &Forwarder{Sources: sources, Strategy: strategy}
+	return f, f.Reload()
+}
+
+// Reload loads all the sources again. Rules of former sources take
+// precedence if the same suffix appears more than once.
+func (f *Forwarder) Reload() error {
+	return f.reload(f.Sources, false, loadForwardRules, func(loaded [][]forwardRule, stats []ListStat) error {
+		routes := map[string]*Upstreams{}
+		upstreams := map[string]*Upstreams{}
+		for i, rules := range loaded {
+			st := &stats[i]
+			for _, r := range rules {
+				if _, ok := routes[r.suffix]; ok {
+					continue
+				}
+				u := upstreams[r.upstreams]
+				if u == nil {
+					if u = f.upstreams[r.upstreams]; u == nil {
+						var err error
+						if u, err = NewUpstreams(strings.Split(r.upstreams, ","), f.Strategy); err != nil {
+							if len(st.Errors) < maxParseErrors {
+								st.Errors = append(st.Errors, fmt.Sprintf("%s: %v", r.suffix, err))
+							}
+							continue
+						}
+					}
+					upstreams[r.upstreams] = u
+				}
+				routes[r.suffix] = u
+				st.Rules++
+			}
+		}
+		f.upstreams = upstreams
+		f.routes.Store(&routes)
+		return nil
+	})
+}
+
+// Watch reloads the sources every d until stop is closed. It returns
+// immediately if d is not positive.
+func (f *Forwarder) Watch(d time.Duration, stop <-chan struct{}) {
+	watch(d, stop, f.Reload)
+}
+
+// Lookup returns the upstreams of the longest suffix matching name, nil if
+// no rule matched.
+func (f *Forwarder) Lookup(name string) *Upstreams {
+	routes := f.routes.Load()
+	if routes == nil {
+		return nil
+	}
+	name = strings.ToLower(dns.Fqdn(name))
+	for i, end := 0, false; !end; i, end = dns.NextLabel(name, i) {
+		if u := (*routes)[name[i:]]; u != nil {
+			return u
+		}
+	}
+	return nil
+}
+
+func loadForwardRules(src string) (rules []forwardRule, errs []string, err error) {
+	r, err := openSource(src)
+	if err != nil {
+		return
+	}
+	defer r.Close()
+
+	rules, errs = parseForwardRules(r)
+	return
+}
+
+// parseForwardRules parses rules line by line. Malformed lines are skipped
+// and reported.
+func parseForwardRules(r io.Reader) (rules []forwardRule, errs []string) {
+	s := bufio.NewScanner(r)
+	for i := 1; s.Scan(); i++ {
+		rs, err := parseForwardRule(s.Text())
+		if err != nil {
+			if len(errs) < maxParseErrors {
+				errs = append(errs, fmt.Sprintf("line %d: %v", i, err))
+			}
+			continue
+		}
+		rules = append(rules, rs...)
+	}
+	return
+}
+
+func parseForwardRule(line string) ([]forwardRule, error) {
+	line = strings.TrimSpace(line)
+	if line == "" || line[0] == '#' {
+		return nil, nil
+	}
+
+	var domains []string
+	var upstreams string
+	if s, ok := strings.CutPrefix(line, "server=/"); ok {
+		// server=/a.com/b.com/1.2.3.4#53，# 后面是端口
+		i := strings.LastIndexByte(s, '/')
+		if i < 0 {
+			return nil, errors.New("invalid dnsmasq rule")
+		}
+		domains = strings.Split(s[:i], "/")
+		if s = s[i+1:]; s != "" {
+			upstreams = dnsmasqServer(s)
+		}
+	} else {
+		fields := strings.Fields(line)
+		if i := slices.IndexFunc(fields, func(f string) bool { return f[0] == '#' }); i >= 0 {
+			fields = fields[:i]
+		}
+		if len(fields) != 2 {
+			return nil, errors.New("invalid rule")
+		}
+		domains = fields[:1]
+		upstreams = fields[1]
+	}
+	if upstreams == "" {
+		return nil, errors.New("no upstream")
+	}
+
+	rules := make([]forwardRule, 0, len(domains))
+	for _, d := range domains {
+		d = strings.TrimPrefix(strings.ToLower(d), "*.")
+		d = dns.Fqdn(d)
+		if _, ok := dns.IsDomainName(d); !ok || d == "." {
+			return nil, errors.New("invalid domain: " + d)
+		}
+		rules = append(rules, forwardRule{suffix: d, upstreams: upstreams})
+	}
+	return rules, nil
+}
+
+// dnsmasqServer converts the dnsmasq server address like 1.2.3.4#53 to
+// the upstream url.
+func dnsmasqServer(s string) string {
+	host, port, ok := strings.Cut(s, "#")
+	if !ok {
+		port = "53"
+	}
+	if net.ParseIP(host) == nil {
+		return s
+	}
+	return "udp://" + net.JoinHostPort(host, port)
+}
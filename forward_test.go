@@ -0,0 +1,120 @@
+package zns
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseForwardRule(t *testing.T) {
+	for line, want := range map[string][]forwardRule{
+		"corp.example udp://10.0.0.1,tls://10.0.0.2": {{"corp.example.", "udp://10.0.0.1,tls://10.0.0.2"}},
+		"*.in-addr.arpa 10.0.0.1 # ptr":              {{"in-addr.arpa.", "10.0.0.1"}},
+		"server=/consul/127.0.0.1#8600":              {{"consul.", "udp://127.0.0.1:8600"}},
+		"server=/a.cn/b.cn/::1":                      {{"a.cn.", "udp://[::1]:53"}, {"b.cn.", "udp://[::1]:53"}},
+		"# comment":                                  nil,
+	} {
+		rules, err := parseForwardRule(line)
+		assert.Nil(t, err, line)
+		assert.Equal(t, want, rules, line)
+	}
+
+	for _, line := range []string{"corp.example", "server=/consul/", ". 10.0.0.1"} {
+		_, err := parseForwardRule(line)
+		assert.NotNil(t, err, line)
+	}
+}
+
+func TestForwarder(t *testing.T) {
+	up, stop := testUpstream(t)
+	defer stop()
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	s := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		a := new(dns.Msg)
+		a.SetReply(r)
+		a.Answer = []dns.RR{rr(r.Question[0].Name + " 300 IN A 10.0.0.1")}
+		w.WriteMsg(a)
+	})}
+	go s.ActivateAndServe()
+	defer s.Shutdown()
+
+	file := filepath.Join(t.TempDir(), "forward.conf")
+	conf := "corp.example udp://" + pc.LocalAddr().String() + "\n" +
+		"pub.corp.example " + up.list[0].url + "\n" +
+		"bad\n"
+	os.WriteFile(file, []byte(conf), 0644)
+
+	f, err := NewForwarder([]string{file}, StrategyFailover)
+	assert.Nil(t, err)
+	st := f.Stats()[0]
+	assert.Equal(t, 2, st.Rules)
+	assert.Equal(t, 1, len(st.Errors))
+
+	h := &Handler{Upstream: up, Repo: FreeTicketRepo{}, Forwarder: f}
+	query := func(name string) string {
+		m := new(dns.Msg)
+		m.SetQuestion(name, dns.TypeA)
+		question, _ := m.Pack()
+		answer, _, err := h.forward(m, question)
+		assert.Nil(t, err)
+		assert.Nil(t, m.Unpack(answer))
+		return m.Answer[0].(*dns.A).A.String()
+	}
+
+	assert.Equal(t, "10.0.0.1", query("www.Corp.Example."))
+	assert.Equal(t, "10.0.0.1", query("corp.example."))
+	assert.Equal(t, "1.2.3.4", query("www.pub.corp.example."))
+	assert.Equal(t, "1.2.3.4", query("example.com."))
+
+	// 上游在重新加载后复用
+	u := f.Lookup("corp.example.")
+	os.WriteFile(file, []byte(strings.Replace(conf, "corp.example", "lan", 1)), 0644)
+	assert.Nil(t, f.Reload())
+	assert.Same(t, u, f.Lookup("x.lan."))
+	assert.Nil(t, f.Lookup("corp.example."))
+}
+
+func TestForwardPrivateReverse(t *testing.T) {
+	up, stop := testUpstream(t)
+	defer stop()
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	s := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		a := new(dns.Msg)
+		a.SetReply(r)
+		a.Answer = []dns.RR{rr(r.Question[0].Name + " 300 IN A 10.0.0.1")}
+		w.WriteMsg(a)
+	})}
+	go s.ActivateAndServe()
+	defer s.Shutdown()
+
+	file := filepath.Join(t.TempDir(), "forward.conf")
+	os.WriteFile(file, []byte("10.in-addr.arpa udp://"+pc.LocalAddr().String()+"\n"), 0644)
+	f, err := NewForwarder([]string{file}, StrategyFailover)
+	assert.Nil(t, err)
+
+	h := &Handler{Upstream: up, Repo: FreeTicketRepo{}, Forwarder: f}
+	m := new(dns.Msg)
+	m.SetQuestion("1.0.0.10.in-addr.arpa.", dns.TypePTR)
+	assert.Nil(t, h.localReply(m))
+
+	// 验证器也走转发规则
+	question, _ := m.Pack()
+	answer, err := h.Exchange(question)
+	assert.Nil(t, err)
+	assert.Nil(t, m.Unpack(answer))
+	assert.Equal(t, "10.0.0.1", m.Answer[0].(*dns.A).A.String())
+
+	m.SetQuestion("1.1.168.192.in-addr.arpa.", dns.TypePTR)
+	a := h.localReply(m)
+	assert.NotNil(t, a)
+	assert.Equal(t, dns.RcodeNameError, a.Rcode)
+}
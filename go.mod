@@ -5,28 +5,41 @@ go 1.23.0
 toolchain go1.24.0
 
 require (
+	github.com/cloudflare/circl v1.6.1
 	github.com/dghubble/trie v0.0.0-20220428154201-8146155f623e
+	github.com/dnstap/golang-dnstap v0.4.0
 	github.com/felixge/httpsnoop v1.0.4
 	github.com/go-kiss/sqlx v0.0.0-20250514141631-7be2cb31cba2
 	github.com/miekg/dns v1.1.66
+	github.com/prometheus/client_golang v1.20.5
 	github.com/quic-go/quic-go v0.51.0
 	github.com/smartwalle/alipay/v3 v3.2.25
 	github.com/stretchr/testify v1.10.0
 	golang.org/x/crypto v0.38.0
+	google.golang.org/protobuf v1.36.5
 	modernc.org/sqlite v1.37.1
 )
 
 require (
+	github.com/beorn7/perks v1.0.1 // indirect
+	github.com/cespare/xxhash/v2 v2.3.0 // indirect
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/dustin/go-humanize v1.0.1 // indirect
+	github.com/farsightsec/golang-framestream v0.3.0 // indirect
 	github.com/go-task/slim-sprig/v3 v3.0.0 // indirect
 	github.com/google/pprof v0.0.0-20250501235452-c0086092b71a // indirect
 	github.com/google/uuid v1.6.0 // indirect
 	github.com/jmoiron/sqlx v1.4.0 // indirect
+	github.com/klauspost/compress v1.17.9 // indirect
+	github.com/kylelemons/godebug v1.1.0 // indirect
 	github.com/mattn/go-isatty v0.0.20 // indirect
+	github.com/munnerz/goautoneg v0.0.0-20191010083416-a7dc8b61c822 // indirect
 	github.com/ncruces/go-strftime v0.1.9 // indirect
 	github.com/onsi/ginkgo/v2 v2.23.4 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
+	github.com/prometheus/client_model v0.6.1 // indirect
+	github.com/prometheus/common v0.55.0 // indirect
+	github.com/prometheus/procfs v0.15.1 // indirect
 	github.com/quic-go/qpack v0.5.1 // indirect
 	github.com/remyoudompheng/bigfft v0.0.0-20230129092748-24d4a6f8daec // indirect
 	github.com/smartwalle/ncrypto v1.0.4 // indirect
@@ -1,15 +1,16 @@
 package zns
 
 import (
-	"bytes"
 	"context"
 	"encoding/base64"
+	"errors"
 	"io"
 	"log"
 	"net"
 	"net/http"
 	"net/netip"
 	"net/url"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -21,10 +22,66 @@ import (
 )
 
 type Handler struct {
-	Upstream string
+	Upstream *Upstreams
 	Repo     TicketRepo
 	AltSvc   string
 	Root     http.Dir
+
+	Cache *Cache
+	// CacheFree 为真时缓存命中的查询不扣流量
+	CacheFree bool
+
+	// Clients are trusted networks allowed to use plain DNS.
+	Clients []ClientNet
+
+	ODoH *ODoHTarget
+
+	// Validator enables DNSSEC validation if not nil.
+	Validator *Validator
+
+	// Blocklist is used by queries with the noad parameter.
+	Blocklist *Blocklist
+
+	// Filters applies the custom rules of each token if not nil.
+	Filters *Filters
+
+	// BlockMode answers blocked queries, NXDOMAIN if nil.
+	BlockMode *BlockMode
+
+	// RPZ applies response policy zones if not nil.
+	RPZ *RPZ
+
+	// Local answers local names instead of upstreams if not nil.
+	Local *LocalZone
+
+	// Forwarder routes queries to other upstreams by domain suffix if not nil.
+	Forwarder *Forwarder
+
+	// ECS decides the client subnet sent to upstreams, DefaultECSPolicy
+	// if nil.
+	ECS *ECSPolicy
+
+	// RateLimit limits queries if not nil.
+	RateLimit *RateLimiter
+
+	// TrustedProxies are the peers allowed to set the client address by the
+	// zns-real-addr header.
+	TrustedProxies []netip.Prefix
+
+	// QueryLog records every query if not nil.
+	QueryLog *QueryLogger
+
+	// Dnstap emits dnstap frames of queries if not nil.
+	Dnstap *Dnstap
+
+	// Usage counts the usage of tokens if not nil.
+	Usage *UsageRecorder
+
+	// DNS64 is used by queries with the dns64 parameter, tokens enabled it
+	// and its listeners if not nil.
+	DNS64 *DNS64
+
+	noadOnce sync.Once
 }
 
 func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -32,6 +89,13 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Alt-Svc", h.AltSvc)
 	}
 
+	if h.RateLimit != nil {
+		if wait, ok := h.RateLimit.AllowIP(clientAddr(r, h.TrustedProxies)); !ok {
+			tooManyRequests(w, wait)
+			return
+		}
+	}
+
 	if r.Method == http.MethodConnect {
 		auth := r.Header.Get("Proxy-Authorization")
 		if auth == "" {
@@ -50,6 +114,9 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			w.WriteHeader(http.StatusProxyAuthRequired)
 			return
 		}
+		if !h.allowToken(w, username, ts[0]) {
+			return
+		}
 		r.URL.User = url.User(username)
 		if r.Proto == "connect-udp" {
 			h.proxyUDP(w, r)
@@ -68,14 +135,20 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		token = r.PathValue("token")
 	}
 
-	if token == "" {
-		http.Error(w, "invalid token", http.StatusUnauthorized)
-		return
-	}
+	// 出错或拦截的应答不能缓存
+	w.Header().Set("Cache-Control", "no-store")
 
 	var err error
 	var question []byte
-	if r.Method == http.MethodGet {
+	if r.Method == http.MethodGet && r.URL.Query().Has("name") {
+		var m *dns.Msg
+		if m, err = parseJSONQuery(r.URL.Query()); err == nil {
+			question, err = m.Pack()
+		}
+		// 允许浏览器跨域调用
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w = &jsonWriter{ResponseWriter: w}
+	} else if r.Method == http.MethodGet {
 		q := r.URL.Query().Get("dns")
 		if q == "" {
 			f, err := h.Root.Open("/index.html")
@@ -96,6 +169,52 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if r.Header.Get("content-type") == odohContentType {
+		if h.ODoH == nil {
+			http.Error(w, "odoh is disabled", http.StatusUnsupportedMediaType)
+			return
+		}
+		var seal func([]byte) ([]byte, error)
+		if question, seal, err = h.ODoH.Open(question); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w = &odohWriter{ResponseWriter: w, seal: seal}
+	}
+
+	var m dns.Msg
+	if err := m.Unpack(question); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	aw := &answerWriter{ResponseWriter: w}
+	w = aw
+
+	// 以下变量在返回时写入查询日志和指标
+	status, upstream, billed := StatusResolved, "", 0
+	tr, start := transport(r), time.Now()
+	var qtype uint16
+	if len(m.Question) > 0 {
+		qtype = m.Question[0].Qtype
+	}
+	defer func() { observeQuery(aw, tr, qtype, status, start) }()
+
+	// token 可以放在加密的查询中
+	if t := takeToken(&m); t != "" {
+		token = t
+		// 去掉 token 后的查询才能写入 dnstap
+		if question, err = m.Pack(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if token == "" {
+		http.Error(w, "invalid token", http.StatusUnauthorized)
+		return
+	}
+
 	ts, err := h.Repo.List(token, 1)
 	if err != nil {
 		http.Error(w, "invalid token", http.StatusInternalServerError)
@@ -105,10 +224,7 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "invalid token", http.StatusUnauthorized)
 		return
 	}
-
-	var m dns.Msg
-	if err := m.Unpack(question); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	if !h.allowToken(w, token, ts[0]) {
 		return
 	}
 
@@ -117,6 +233,39 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// 只记录通过验证的查询
+	if h.Dnstap != nil {
+		client, query := clientAddrPort(r, h.TrustedProxies), question
+		h.Dnstap.ClientQuery(tr, client, query, start)
+		defer func() {
+			if aw.code == 0 || aw.code == http.StatusOK {
+				h.Dnstap.ClientResponse(tr, client, query, aw.body, start)
+			}
+		}()
+	}
+
+	if h.QueryLog != nil {
+		q := m.Question[0]
+		defer func() {
+			h.logQuery(aw, QueryLog{
+				Time:     start,
+				Token:    token,
+				Client:   clientAddr(r, h.TrustedProxies).String(),
+				Name:     q.Name,
+				Type:     dns.TypeToString[q.Qtype],
+				Upstream: upstream,
+				Latency:  time.Since(start).Milliseconds(),
+				Status:   status,
+				Bytes:    billed,
+			})
+		}()
+	}
+
+	if h.Usage != nil {
+		service := usageService(tr)
+		defer func() { h.Usage.Add(token, service, billed, 1) }()
+	}
+
 	if q := m.Question[0]; q.Qtype == dns.TypeSVCB && strings.HasPrefix(q.Name, "_dns.") {
 		server := strings.TrimPrefix(q.Name, "_dns.")
 		var dohServer, dotServer string
@@ -161,6 +310,7 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		a.SetReply(&m)
 		a.Authoritative = true
 		a.Answer = []dns.RR{doh, dot}
+		status = StatusLocal
 
 		buf, err := a.Pack()
 		if err != nil {
@@ -173,97 +323,519 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if r.URL.Query().Get("noad") != "" {
-		n := m.Question[0].Name
-		n = strings.TrimRight(n, ".")
-		if isBlackDomain(n) {
-			non := new(dns.Msg)
-			non.SetReply(&m)
-			non.Rcode = dns.RcodeNameError
-			answer, err := non.Pack()
-			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
+	costFold := 1
+	if _, ok := proxiedAddr(r, h.TrustedProxies); ok {
+		costFold = 100 // 主服务正常时备用线路消耗百倍流量，只在必要时使用
+	}
+
+	// 本地数据优先，内网地址的反向解析不能转发到上游
+	if a := h.localReply(&m); a != nil {
+		status = StatusLocal
+		billed = h.writeSynthesized(w, a, token, question, costFold)
+		return
+	}
+
+	if list, code := h.blocked(token, m.Question[0].Name, r.URL.Query().Get("noad") != ""); list != "" {
+		status = StatusBlocked
+		blockedTotal.WithLabelValues(list).Inc()
+		mode := h.BlockMode
+		if mode == nil {
+			mode = &BlockMode{Rcode: dns.RcodeNameError}
+		}
+		answer, err := mode.Answer(&m, code, list).Pack()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Add("content-type", "application/dns-message")
+		w.Write(answer)
+		return
+	}
+
+	if h.safeSearch(token, r.URL.Query().Get("safesearch") != "") {
+		if a := safeSearchReply(&m); a != nil {
+			status = StatusSafeSearch
+			billed = h.writeSynthesized(w, a, token, question, costFold)
+			return
+		}
+	}
+
+	useDNS64 := h.useDNS64(token, r.URL.Query().Get("dns64") != "")
+	if useDNS64 {
+		if a := h.DNS64.PTRReply(&m); a != nil {
+			status = StatusLocal
+			billed = h.writeSynthesized(w, a, token, question, costFold)
+			return
+		}
+	}
+
+	// PASSTHRU 规则跳过后续的所有 RPZ 检查
+	var rpzPass bool
+	if h.RPZ != nil {
+		if rule := h.RPZ.Query(m.Question[0].Name); rule != nil {
+			status = StatusRPZ
+			if rule.action == rpzDrop {
+				http.Error(w, "dropped by rpz", statusDropped)
+				return
+			}
+			if rule.action != rpzPassthru {
+				billed = h.writeSynthesized(w, rule.Reply(&m), token, question, costFold)
 				return
 			}
-			w.Header().Add("content-type", "application/dns-message")
-			w.Write(answer)
+			status, rpzPass = StatusResolved, true
 		}
 	}
 
-	var hasSubnet bool
 	if e := m.IsEdns0(); e != nil {
 		var opts []dns.EDNS0
 		for _, o := range e.Option {
-			if o.Option() == dns.EDNS0SUBNET {
-				a := o.(*dns.EDNS0_SUBNET).Address[:2]
-				// skip empty subnet like 0.0.0.0/0
-				if !bytes.HasPrefix(a, []byte{0, 0}) {
-					hasSubnet = true
-				}
-			} else if o.Option() != dns.EDNS0PADDING {
+			if o.Option() != dns.EDNS0PADDING {
 				opts = append(opts, o)
 			}
 		}
 		e.Option = opts
 	} else {
-		m.SetEdns0(dns.DefaultMsgSize, false) // TODO(tao) DNSSEC
+		m.SetEdns0(dns.DefaultMsgSize, false)
 	}
 
-	costFold := 100 // 主服务正常时备用线路消耗百倍流量，只在必要时使用
-	remoteAddr := r.Header.Get("zns-real-addr")
-	if remoteAddr == "" {
-		remoteAddr = r.RemoteAddr
-		costFold = 1
+	// 客户端是否需要 DNSSEC 记录
+	do, cd := m.IsEdns0().Do(), m.CheckingDisabled
+	if h.Validator != nil {
+		m.IsEdns0().SetDo()
 	}
 
-	if !hasSubnet {
-		ip, err := netip.ParseAddrPort(remoteAddr)
+	h.applyECS(&m, token, clientAddr(r, h.TrustedProxies))
+
+	if question, err = m.Pack(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	answer, hit, upstream, err := h.resolve(&m, question)
+	if hit {
+		status = StatusCached
+	}
+	if err == nil && h.Validator != nil {
+		answer, err = h.validate(answer, do, cd)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if useDNS64 && m.Question[0].Qtype == dns.TypeAAAA {
+		answer = h.synthesize(&m, answer)
+	}
+
+	var maxAge string
+	if a := new(dns.Msg); a.Unpack(answer) == nil {
+		if rule := h.rpzAnswer(a, rpzPass); rule != nil {
+			status = StatusRPZ
+			if rule.action == rpzDrop {
+				http.Error(w, "dropped by rpz", statusDropped)
+				return
+			}
+			if answer, err = h.rpzReply(&m, rule); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		} else if ttl, ok := cacheTTL(a); ok {
+			maxAge = strconv.Itoa(int(ttl))
+		}
+	}
+
+	if !hit || !h.CacheFree {
+		n := (len(question) + len(answer)) * costFold
+		if err = cost(h.Repo, billDNS, token, n); err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		billed = n
+	}
+
+	// 扣费成功后才允许缓存。缓存应答的 TTL 已减去驻留时间，不再发送 Age
+	if maxAge != "" {
+		w.Header().Set("Cache-Control", "max-age="+maxAge)
+	}
+
+	w.Header().Add("content-type", "application/dns-message")
+	w.Write(answer)
+}
+
+// logQuery fills the rcode of q by the answer written to w and saves it,
+// unless the token opts out.
+func (h *Handler) logQuery(w *answerWriter, q QueryLog) {
+	if h.Filters != nil {
+		off, err := h.Filters.NoLog(q.Token)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			log.Println("Failed to load filter", q.Token, err)
+		}
+		if off {
 			return
 		}
-		addr := ip.Addr()
-		ecs := &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET}
-		var bits int
-		if addr.Is4() {
-			bits = 24
-			ecs.Family = 1
-		} else {
-			bits = 48
-			ecs.Family = 2
+	}
+	if w.code != 0 && w.code != http.StatusOK {
+		if q.Status == StatusResolved {
+			q.Status = StatusError
 		}
-		ecs.SourceNetmask = uint8(bits)
-		p := netip.PrefixFrom(addr, bits)
-		ecs.Address = net.IP(p.Masked().Addr().AsSlice())
-		opt := m.IsEdns0()
-		opt.Option = append(opt.Option, ecs)
+	} else if len(w.body) >= 4 {
+		q.Rcode = dns.RcodeToString[int(w.body[3]&0xf)]
 	}
+	h.QueryLog.Log(q)
+}
 
-	if question, err = m.Pack(); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+// allowToken checks the rate limit of token, and replies 429 if exceeded.
+func (h *Handler) allowToken(w http.ResponseWriter, token string, t Ticket) bool {
+	if h.RateLimit == nil {
+		return true
+	}
+	wait, ok := h.RateLimit.AllowToken(token, t)
+	if !ok {
+		tooManyRequests(w, wait)
+	}
+	return ok
+}
+
+// clientAddr returns the client address of r. The zns-real-addr header set
+// by other instances is used only if the peer is in trusted, otherwise
+// anyone could forge it.
+func clientAddr(r *http.Request, trusted []netip.Prefix) netip.Addr {
+	return clientAddrPort(r, trusted).Addr().Unmap()
+}
+
+// clientAddrPort is like clientAddr with the port.
+func clientAddrPort(r *http.Request, trusted []netip.Prefix) netip.AddrPort {
+	if addr, ok := proxiedAddr(r, trusted); ok {
+		return addr
+	}
+	peer, _ := netip.ParseAddrPort(r.RemoteAddr)
+	return peer
+}
+
+// proxiedAddr returns the client address in the zns-real-addr header, and
+// reports whether r is relayed by a trusted proxy with a valid one.
+func proxiedAddr(r *http.Request, trusted []netip.Prefix) (netip.AddrPort, bool) {
+	addr := r.Header.Get("zns-real-addr")
+	if addr == "" {
+		return netip.AddrPort{}, false
+	}
+	peer, _ := netip.ParseAddrPort(r.RemoteAddr)
+	ip := peer.Addr().Unmap()
+	for _, p := range trusted {
+		if p.Contains(ip) {
+			ap, err := netip.ParseAddrPort(addr)
+			return ap, err == nil
+		}
+	}
+	return netip.AddrPort{}, false
+}
+
+// resolve answers m from cache or upstream, and returns the url of the
+// upstream answered.
+//
+// Expired answers are served if upstream fails, see RFC 8767.
+func (h *Handler) resolve(m *dns.Msg, question []byte) (answer []byte, hit bool, upstream string, err error) {
+	if h.Cache != nil {
+		if a, _, prefetch := h.Cache.Get(m); a != nil {
+			cacheLookups.WithLabelValues("hit").Inc()
+			if prefetch {
+				go h.prefetch(m.Copy(), question)
+			}
+			answer, err = a.Pack()
+			return answer, true, "", err
+		}
+		cacheLookups.WithLabelValues("miss").Inc()
+	}
+
+	answer, upstream, err = h.forward(m, question)
+	if h.Cache == nil {
 		return
 	}
 
-	resp, err := http.Post(h.Upstream, "application/dns-message", bytes.NewReader(question))
+	if err == nil {
+		a := new(dns.Msg)
+		if err = a.Unpack(answer); err != nil {
+			return
+		}
+		if a.Rcode != dns.RcodeServerFailure {
+			h.Cache.Set(m, a)
+			return
+		}
+	}
+
+	if a := h.Cache.GetStale(m); a != nil {
+		log.Println("serve stale", m.Question[0].Name, err)
+		cacheLookups.WithLabelValues("stale").Inc()
+		setEDE(a, dns.ExtendedErrorCodeStaleAnswer, "")
+		answer, err = a.Pack()
+		return answer, true, "", err
+	}
+	return
+}
+
+// validate sets AD bit of secure answers and replaces bogus ones with SERVFAIL.
+// Validation is skipped if cd is true. DNSSEC records are removed unless do
+// is true.
+func (h *Handler) validate(answer []byte, do, cd bool) ([]byte, error) {
+	a := new(dns.Msg)
+	if err := a.Unpack(answer); err != nil {
+		return nil, err
+	}
+
+	if cd {
+		// 不验证，但上游应答带有验证器要求的 DNSSEC 记录
+		if do {
+			return answer, nil
+		}
+		stripDNSSEC(a)
+		return a.Pack()
+	}
+
+	secure, err := h.Validator.Validate(a)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		log.Println("dnssec bogus", a.Question[0].Name, err)
+		f := new(dns.Msg)
+		f.SetRcode(a, dns.RcodeServerFailure)
+		f.RecursionAvailable = true
+		setEDE(f, dns.ExtendedErrorCodeDNSBogus, err.Error())
+		return f.Pack()
 	}
-	defer resp.Body.Close()
 
-	answer, err := io.ReadAll(resp.Body)
+	a.AuthenticatedData = secure
+	if !do {
+		stripDNSSEC(a)
+	}
+	return a.Pack()
+}
+
+// blocked returns the list blocking name for token and the Extended DNS
+// Error code. The shared lists are all used if noad is true.
+func (h *Handler) blocked(token, name string, noad bool) (list string, code uint16) {
+	if noad && h.Blocklist == nil {
+		// 没有共享拦截列表时 noad 不拦截任何域名，只提示一次
+		h.noadOnce.Do(func() { log.Println("noad is used without blocklist, nothing is blocked") })
+	}
+	if h.Filters != nil {
+		list, code, err := h.Filters.Lookup(token, name, noad)
+		if err != nil {
+			log.Println("Failed to load filter", token, err)
+		}
+		return list, code
+	}
+	if noad && h.Blocklist != nil {
+		list, _ = h.Blocklist.LookupAll(name)
+	}
+	return list, dns.ExtendedErrorCodeBlocked
+}
+
+// localReply answers m from local data or private reverse zones.
+func (h *Handler) localReply(m *dns.Msg) *dns.Msg {
+	if h.Local != nil {
+		if a := h.Local.Reply(m); a != nil {
+			return a
+		}
+	}
+	// 有转发规则的私有反向区交给转发的上游解析
+	if h.Forwarder != nil && h.Forwarder.Lookup(m.Question[0].Name) != nil {
+		return nil
+	}
+	return privateReverseReply(m)
+}
+
+// safeSearch reports whether safe search is forced for token, or by the
+// safesearch parameter.
+func (h *Handler) safeSearch(token string, param bool) bool {
+	if param || h.Filters == nil {
+		return param
+	}
+	on, err := h.Filters.SafeSearch(token)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		log.Println("Failed to load filter", token, err)
 	}
+	return on
+}
 
-	if err = h.Repo.Cost(token, (len(question)+len(answer))*costFold); err != nil {
-		http.Error(w, err.Error(), http.StatusUnauthorized)
-		return
+// applyECS sets the client subnet of m by the policy and the fixed subnet
+// of token.
+func (h *Handler) applyECS(m *dns.Msg, token string, client netip.Addr) {
+	p := h.ECS
+	if p == nil {
+		p = DefaultECSPolicy
+	}
+	var fixed netip.Prefix
+	if h.Filters != nil {
+		var err error
+		if fixed, err = h.Filters.ECS(token); err != nil {
+			log.Println("Failed to load filter", token, err)
+		}
+	}
+	p.Apply(m, client, fixed)
+}
+
+// useDNS64 reports whether DNS64 is used by token, or by the dns64
+// parameter.
+func (h *Handler) useDNS64(token string, param bool) bool {
+	if h.DNS64 == nil {
+		return false
+	}
+	if param || h.Filters == nil {
+		return param
+	}
+	on, err := h.Filters.DNS64(token)
+	if err != nil {
+		log.Println("Failed to load filter", token, err)
+	}
+	return on
+}
+
+// listenerQuery returns the query string of requests made by the listener.
+func (h *Handler) listenerQuery(listener string) string {
+	if h.DNS64 != nil && h.DNS64.Listen(listener) {
+		return "?dns64=1"
+	}
+	return ""
+}
+
+// synthesize returns the AAAA answer with records synthesized from the A
+// records of the query m if needed.
+func (h *Handler) synthesize(m *dns.Msg, answer []byte) []byte {
+	a := new(dns.Msg)
+	if a.Unpack(answer) != nil {
+		return answer
+	}
+
+	if h.DNS64.Need(a) {
+		q := m.Copy()
+		q.Question[0].Qtype = dns.TypeA
+		if question, err := q.Pack(); err == nil {
+			v4, _, _, err := h.resolve(q, question)
+			if t := new(dns.Msg); err == nil && t.Unpack(v4) == nil {
+				h.DNS64.Synthesize(a, t)
+			} else if err != nil {
+				log.Println("dns64 error", q.Question[0].Name, err)
+			}
+		}
+	}
+
+	// 排除的 AAAA 记录已被删除，需要重新打包
+	if b, err := a.Pack(); err == nil {
+		return b
+	}
+	return answer
+}
+
+// rpzAnswer returns the RPZ rule matching the upstream answer, nil if
+// nothing matched or the query passed.
+func (h *Handler) rpzAnswer(a *dns.Msg, pass bool) *rpzRule {
+	if h.RPZ == nil || pass {
+		return nil
 	}
+	if rule := h.RPZ.Answer(a); rule != nil && rule.action != rpzPassthru {
+		return rule
+	}
+	return nil
+}
+
+// rpzReply builds the answer by the RPZ rule.
+func (h *Handler) rpzReply(m *dns.Msg, rule *rpzRule) ([]byte, error) {
+	a := rule.Reply(m)
+	h.followCNAME(a)
+	return a.Pack()
+}
 
+// writeSynthesized writes the answer a built locally, and returns the billed
+// bytes. Answers are billed like resolved ones if the CNAME target is
+// resolved.
+func (h *Handler) writeSynthesized(w http.ResponseWriter, a *dns.Msg, token string, question []byte, fold int) (billed int) {
+	bill := h.followCNAME(a)
+	answer, err := a.Pack()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return 0
+	}
+	if bill {
+		n := (len(question) + len(answer)) * fold
+		if err := cost(h.Repo, billDNS, token, n); err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return 0
+		}
+		billed = n
+	}
 	w.Header().Add("content-type", "application/dns-message")
 	w.Write(answer)
+	return billed
+}
+
+// followCNAME resolves the target if the synthesized answer a ends with a
+// CNAME rewrite. It reports whether the answer should be billed, that is the
+// target is resolved and not from cache when cache hits are free.
+func (h *Handler) followCNAME(a *dns.Msg) (bill bool) {
+	qtype := a.Question[0].Qtype
+	if len(a.Answer) == 0 || qtype == dns.TypeCNAME {
+		return false
+	}
+	c, ok := a.Answer[len(a.Answer)-1].(*dns.CNAME)
+	if !ok {
+		return false
+	}
+	q := new(dns.Msg)
+	q.SetQuestion(c.Target, qtype)
+	q.SetEdns0(dns.DefaultMsgSize, false)
+	question, err := q.Pack()
+	if err != nil {
+		return false
+	}
+	answer, hit, _, err := h.resolve(q, question)
+	if err != nil {
+		return false
+	}
+	if t := new(dns.Msg); t.Unpack(answer) == nil {
+		a.Answer = append(a.Answer, t.Answer...)
+		a.Rcode = t.Rcode
+	}
+	return !hit || !h.CacheFree
+}
+
+func (h *Handler) prefetch(m *dns.Msg, question []byte) {
+	answer, _, err := h.forward(m, question)
+	if err != nil {
+		log.Println("prefetch error", m.Question[0].Name, err)
+		return
+	}
+	a := new(dns.Msg)
+	if err = a.Unpack(answer); err != nil || a.Rcode == dns.RcodeServerFailure {
+		return
+	}
+	h.Cache.Set(m, a)
+}
+
+// forward sends the packed query m to the upstreams routed by Forwarder,
+// or the default ones.
+func (h *Handler) forward(m *dns.Msg, question []byte) (answer []byte, upstream string, err error) {
+	if h.Dnstap != nil {
+		start := time.Now()
+		defer func() { h.Dnstap.Forward(upstream, question, answer, start) }()
+	}
+	if h.Forwarder != nil {
+		if u := h.Forwarder.Lookup(m.Question[0].Name); u != nil {
+			return u.ExchangeFrom(question)
+		}
+	}
+	return h.Upstream.ExchangeFrom(question)
+}
+
+// Exchange sends the packed query question to the upstreams routed by
+// Forwarder, or the default ones.
+func (h *Handler) Exchange(question []byte) ([]byte, error) {
+	var m dns.Msg
+	if err := m.Unpack(question); err != nil {
+		return nil, err
+	}
+	if len(m.Question) == 0 {
+		return nil, errors.New("no question")
+	}
+	answer, _, err := h.forward(&m, question)
+	return answer, err
 }
 
 func (p *Handler) proxyUDP(w http.ResponseWriter, req *http.Request) {
@@ -290,6 +862,13 @@ func (p *Handler) proxyUDP(w http.ResponseWriter, req *http.Request) {
 	w.WriteHeader(http.StatusOK)
 	w.(http.Flusher).Flush()
 
+	proxyTunnels.WithLabelValues(billConnectUDP).Inc()
+	if p.Usage != nil {
+		p.Usage.Add(req.URL.User.Username(), ServiceMasque, 0, 1)
+	}
+	proxyActive.WithLabelValues(billConnectUDP).Inc()
+	defer proxyActive.WithLabelValues(billConnectUDP).Dec()
+
 	w = w.(httpsnoop.Unwrapper).Unwrap()
 	str := w.(http3.HTTPStreamer).HTTPStream()
 	defer str.Close()
@@ -299,16 +878,20 @@ func (p *Handler) proxyUDP(w http.ResponseWriter, req *http.Request) {
 
 	user := req.URL.User.Username()
 
-	cost := func(n int) {
+	charge := func(n int) {
+		proxyBytes.WithLabelValues(billConnectUDP).Add(float64(n))
 		n *= 2
-		err := p.Repo.Cost(user, n)
+		err := cost(p.Repo, billConnectUDP, user, n)
+		if err == nil && p.Usage != nil {
+			p.Usage.Add(user, ServiceMasque, n, 0)
+		}
 		if err != nil {
 			log.Println("ticket cost error: ", user, n, err)
 			str.Close()
 			up.Close()
 		}
 	}
-	u := &bytesCounter{w: up, d: 1 * time.Second, f: cost}
+	u := &bytesCounter{w: up, d: 1 * time.Second, f: charge}
 
 	go u.Start()
 	defer u.Done()
@@ -367,6 +950,13 @@ func (p *Handler) proxyHTTPS(w http.ResponseWriter, req *http.Request) {
 	w.WriteHeader(http.StatusOK)
 	w.(http.Flusher).Flush()
 
+	proxyTunnels.WithLabelValues(billConnect).Inc()
+	if p.Usage != nil {
+		p.Usage.Add(req.URL.User.Username(), ServiceConnect, 0, 1)
+	}
+	proxyActive.WithLabelValues(billConnect).Inc()
+	defer proxyActive.WithLabelValues(billConnect).Dec()
+
 	var downConn io.ReadWriteCloser
 	if req.ProtoMajor >= 2 {
 		downConn = flushWriter{w: w, r: req.Body}
@@ -385,9 +975,13 @@ func (p *Handler) proxyHTTPS(w http.ResponseWriter, req *http.Request) {
 
 	user := req.URL.User.Username()
 
-	cost := func(n int) {
+	charge := func(n int) {
+		proxyBytes.WithLabelValues(billConnect).Add(float64(n))
 		n *= 2
-		err := p.Repo.Cost(user, n)
+		err := cost(p.Repo, billConnect, user, n)
+		if err == nil && p.Usage != nil {
+			p.Usage.Add(user, ServiceConnect, n, 0)
+		}
 		if err != nil {
 			log.Println("ticket cost error: ", user, n, err)
 			downConn.Close()
@@ -395,7 +989,7 @@ func (p *Handler) proxyHTTPS(w http.ResponseWriter, req *http.Request) {
 		}
 	}
 
-	u := &bytesCounter{w: upConn, d: 1 * time.Second, f: cost}
+	u := &bytesCounter{w: upConn, d: 1 * time.Second, f: charge}
 
 	go u.Start()
 	defer u.Done()
@@ -0,0 +1,128 @@
+package zns
+
+import (
+	"encoding/base64"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCacheControl(t *testing.T) {
+	up, stop := testUpstream(t)
+	defer stop()
+
+	h := &Handler{Upstream: up, Repo: FreeTicketRepo{}, Cache: NewCache(100)}
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	b, _ := q.Pack()
+	url := "https://foo.zns.test/dns-query?dns=" + base64.RawURLEncoding.EncodeToString(b)
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, url, nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "max-age=300", w.Header().Get("Cache-Control"))
+	assert.Equal(t, "", w.Header().Get("Age"))
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, url, nil))
+	assert.Equal(t, "max-age=300", w.Header().Get("Cache-Control"))
+	assert.Equal(t, "", w.Header().Get("Age"))
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, url[:len(url)-2], nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, "no-store", w.Header().Get("Cache-Control"))
+}
+
+// poorRepo accepts tokens but fails to charge them.
+type poorRepo struct {
+	FreeTicketRepo
+}
+
+func (poorRepo) Cost(token string, bytes int) error {
+	return errors.New("no bytes left")
+}
+
+func TestCacheControlCostFailed(t *testing.T) {
+	up, stop := testUpstream(t)
+	defer stop()
+
+	h := &Handler{Upstream: up, Repo: poorRepo{}}
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	b, _ := q.Pack()
+	url := "https://foo.zns.test/dns-query?dns=" + base64.RawURLEncoding.EncodeToString(b)
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, url, nil))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Equal(t, "no-store", w.Header().Get("Cache-Control"))
+}
+
+func TestSynthesizedCost(t *testing.T) {
+	up, stop := testUpstream(t)
+	defer stop()
+
+	h := &Handler{Upstream: up, Repo: poorRepo{}}
+	query := func(name string, qtype uint16, param string) int {
+		q := new(dns.Msg)
+		q.SetQuestion(name, qtype)
+		b, _ := q.Pack()
+		url := "https://foo.zns.test/dns-query?" + param + "dns=" + base64.RawURLEncoding.EncodeToString(b)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, url, nil))
+		return w.Code
+	}
+
+	// 改写的 CNAME 目标由上游解析，和普通查询一样扣费
+	assert.Equal(t, http.StatusUnauthorized, query("www.google.com.", dns.TypeA, "safesearch=1&"))
+	// 完全本地应答的查询不扣费
+	assert.Equal(t, http.StatusOK, query("1.1.168.192.in-addr.arpa.", dns.TypePTR, ""))
+}
+
+func TestRealAddrECS(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	subnets := make(chan string, 1)
+	s := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		subnets <- ecsPrefix(r, false).String()
+		a := new(dns.Msg)
+		a.SetReply(r)
+		w.WriteMsg(a)
+	})}
+	go s.ActivateAndServe()
+	defer s.Shutdown()
+	up, err := NewUpstreams([]string{"udp://" + pc.LocalAddr().String()}, StrategyFailover)
+	assert.Nil(t, err)
+
+	h := &Handler{Upstream: up, Repo: FreeTicketRepo{}}
+	query := func(header string) int {
+		q := new(dns.Msg)
+		q.SetQuestion("example.com.", dns.TypeA)
+		b, _ := q.Pack()
+		r := httptest.NewRequest(http.MethodGet, "/dns-query?dns="+base64.RawURLEncoding.EncodeToString(b), nil)
+		r.RemoteAddr = "192.0.2.1:1234"
+		r.Header.Set("zns-real-addr", header)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	// 不可信的对端不能指定发给上游的子网
+	assert.Equal(t, http.StatusOK, query("203.0.113.9:53"))
+	assert.Equal(t, "192.0.2.0/24", <-subnets)
+
+	h.TrustedProxies, _ = ParsePrefixes("192.0.2.0/24")
+	assert.Equal(t, http.StatusOK, query("203.0.113.9:53"))
+	assert.Equal(t, "203.0.113.0/24", <-subnets)
+
+	assert.Equal(t, http.StatusOK, query("bad"))
+	assert.Equal(t, "192.0.2.0/24", <-subnets)
+}
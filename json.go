@@ -0,0 +1,169 @@
+package zns
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// JSON API compatible with Google and Cloudflare.
+//
+//	GET /dns/{token}?name=example.com&type=AAAA&do=1&cd=1&edns_client_subnet=1.2.3.0/24
+//
+// See https://developers.google.com/speed/public-dns/docs/doh/json
+const jsonContentType = "application/dns-json"
+
+type jsonQuestion struct {
+	Name string `json:"name"`
+	Type uint16 `json:"type"`
+}
+
+type jsonRR struct {
+	Name string `json:"name"`
+	Type uint16 `json:"type"`
+	TTL  uint32 `json:"TTL"`
+	Data string `json:"data"`
+}
+
+type jsonMsg struct {
+	Status     int            `json:"Status"`
+	TC         bool           `json:"TC"`
+	RD         bool           `json:"RD"`
+	RA         bool           `json:"RA"`
+	AD         bool           `json:"AD"`
+	CD         bool           `json:"CD"`
+	Question   []jsonQuestion `json:"Question"`
+	Answer     []jsonRR       `json:"Answer,omitempty"`
+	Authority  []jsonRR       `json:"Authority,omitempty"`
+	Additional []jsonRR       `json:"Additional,omitempty"`
+	Subnet     string         `json:"edns_client_subnet,omitempty"`
+	Comment    string         `json:"Comment,omitempty"`
+}
+
+// parseJSONQuery builds the DNS query from url parameters.
+func parseJSONQuery(q url.Values) (*dns.Msg, error) {
+	name := q.Get("name")
+	if name == "" || len(name) > 253 {
+		return nil, errors.New("invalid name")
+	}
+
+	qtype := dns.TypeA
+	if t := q.Get("type"); t != "" {
+		if n, err := strconv.ParseUint(t, 10, 16); err == nil {
+			qtype = uint16(n)
+		} else if n, ok := dns.StringToType[strings.ToUpper(t)]; ok {
+			qtype = n
+		} else {
+			return nil, errors.New("invalid type")
+		}
+	}
+
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(name), qtype)
+	m.CheckingDisabled = isTrue(q.Get("cd"))
+	m.SetEdns0(dns.DefaultMsgSize, isTrue(q.Get("do")))
+
+	if s := q.Get("edns_client_subnet"); s != "" {
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			addr, err := netip.ParseAddr(s)
+			if err != nil {
+				return nil, err
+			}
+			p = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		p = p.Masked()
+		ecs := &dns.EDNS0_SUBNET{
+			Code:          dns.EDNS0SUBNET,
+			Family:        1,
+			SourceNetmask: uint8(p.Bits()),
+			Address:       net.IP(p.Addr().AsSlice()),
+		}
+		if p.Addr().Is6() {
+			ecs.Family = 2
+		}
+		opt := m.IsEdns0()
+		opt.Option = append(opt.Option, ecs)
+	}
+
+	return m, nil
+}
+
+func isTrue(s string) bool {
+	return s == "1" || s == "true"
+}
+
+func toJSONMsg(m *dns.Msg) jsonMsg {
+	j := jsonMsg{
+		Status: m.Rcode,
+		TC:     m.Truncated,
+		RD:     m.RecursionDesired,
+		RA:     m.RecursionAvailable,
+		AD:     m.AuthenticatedData,
+		CD:     m.CheckingDisabled,
+	}
+	for _, q := range m.Question {
+		j.Question = append(j.Question, jsonQuestion{Name: q.Name, Type: q.Qtype})
+	}
+	j.Answer = toJSONRRs(m.Answer)
+	j.Authority = toJSONRRs(m.Ns)
+	j.Additional = toJSONRRs(m.Extra)
+
+	if p := ecsPrefix(m, true); p.IsValid() {
+		j.Subnet = p.String()
+	}
+	for _, ede := range edes(m) {
+		j.Comment = ede.String()
+	}
+	return j
+}
+
+func toJSONRRs(rrs []dns.RR) (js []jsonRR) {
+	for _, rr := range rrs {
+		h := rr.Header()
+		if h.Rrtype == dns.TypeOPT {
+			continue
+		}
+		js = append(js, jsonRR{
+			Name: h.Name,
+			Type: h.Rrtype,
+			TTL:  h.Ttl,
+			Data: strings.TrimPrefix(rr.String(), h.String()),
+		})
+	}
+	return
+}
+
+// jsonWriter converts the wire format answer written by Handler to JSON.
+type jsonWriter struct {
+	http.ResponseWriter
+	code int
+}
+
+func (w *jsonWriter) WriteHeader(code int) {
+	w.code = code
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *jsonWriter) Write(b []byte) (int, error) {
+	if w.code != 0 && w.code != http.StatusOK {
+		return w.ResponseWriter.Write(b)
+	}
+	m := new(dns.Msg)
+	if err := m.Unpack(b); err != nil {
+		http.Error(w.ResponseWriter, err.Error(), http.StatusInternalServerError)
+		return 0, err
+	}
+	w.Header().Set("content-type", jsonContentType)
+	if err := json.NewEncoder(w.ResponseWriter).Encode(toJSONMsg(m)); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
@@ -0,0 +1,41 @@
+package zns
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJSONQuery(t *testing.T) {
+	up, stop := testUpstream(t)
+	defer stop()
+
+	h := &Handler{Upstream: up, Repo: FreeTicketRepo{}}
+
+	req := httptest.NewRequest(http.MethodGet, "/dns/foo?name=example.com&type=A&edns_client_subnet=1.2.3.4/24", nil)
+	req.SetPathValue("token", "foo")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, jsonContentType, w.Header().Get("content-type"))
+
+	var m jsonMsg
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &m))
+	assert.Equal(t, 0, m.Status)
+	assert.Equal(t, []jsonQuestion{{Name: "example.com.", Type: 1}}, m.Question)
+	assert.Equal(t, []jsonRR{{Name: "example.com.", Type: 1, TTL: 300, Data: "1.2.3.4"}}, m.Answer)
+
+	q, err := parseJSONQuery(req.URL.Query())
+	assert.Nil(t, err)
+	assert.Equal(t, "1.2.3.0/24", ecsPrefix(q, false).String())
+
+	req = httptest.NewRequest(http.MethodGet, "/dns/foo?name=example.com&type=FOO", nil)
+	req.SetPathValue("token", "foo")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
@@ -0,0 +1,295 @@
+package zns
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// localTTL is the TTL of hosts entries and zone records without TTL.
+const localTTL = 300
+
+// maxLocalCNAMEs limits the CNAME chain followed in local data.
+const maxLocalCNAMEs = 8
+
+type localData struct {
+	names map[string][]dns.RR
+	// apexes are the zones with SOA, names under which not found are
+	// answered with NXDOMAIN.
+	apexes map[string]*dns.SOA
+}
+
+// LocalZone answers names from zone files or hosts files instead of
+// upstreams. Wildcard names like *.lan are supported by both formats.
+type LocalZone struct {
+	Sources []string
+
+	data atomic.Pointer[localData]
+
+	sourceSet[[]dns.RR]
+}
+
+// NewLocalZone creates a LocalZone and loads all the sources.
+func NewLocalZone(sources []string) (*LocalZone, error) {
+	z := &LocalZone{Sources: sources}
+	return z, z.Reload()
+}
+
+// Reload loads all the sources again.
+func (z *LocalZone) Reload() error {
+	return z.reload(z.Sources, false, loadLocal, func(loaded [][]dns.RR, stats []ListStat) error {
+		d := &localData{names: map[string][]dns.RR{}, apexes: map[string]*dns.SOA{}}
+		for i, rrs := range loaded {
+			stats[i].Rules = len(rrs)
+			for _, rr := range rrs {
+				name := strings.ToLower(rr.Header().Name)
+				if soa, ok := rr.(*dns.SOA); ok {
+					d.apexes[name] = soa
+				}
+				d.names[name] = append(d.names[name], rr)
+			}
+		}
+		z.data.Store(d)
+		return nil
+	})
+}
+
+// Watch reloads the sources every d until stop is closed. It returns
+// immediately if d is not positive.
+func (z *LocalZone) Watch(d time.Duration, stop <-chan struct{}) {
+	watch(d, stop, z.Reload)
+}
+
+// Reply answers m from local data, nil if the name is not local. The last
+// CNAME target is left to resolve if it is not local.
+func (z *LocalZone) Reply(m *dns.Msg) *dns.Msg {
+	d := z.data.Load()
+	if d == nil {
+		return nil
+	}
+
+	q := m.Question[0]
+	a := new(dns.Msg)
+	a.SetReply(m)
+	a.Authoritative = true
+	a.RecursionAvailable = true
+
+	name := q.Name
+	for range maxLocalCNAMEs {
+		rrs := d.find(name)
+		if rrs == nil {
+			if len(a.Answer) > 0 {
+				return a
+			}
+			soa := d.apex(name)
+			if soa == nil {
+				return nil
+			}
+			a.Rcode = dns.RcodeNameError
+			a.Ns = []dns.RR{soa}
+			return a
+		}
+
+		var cname dns.RR
+		var matched bool
+		for _, rr := range rrs {
+			t := rr.Header().Rrtype
+			if t == q.Qtype || q.Qtype == dns.TypeANY {
+				rr = dns.Copy(rr)
+				rr.Header().Name = name
+				a.Answer = append(a.Answer, rr)
+				matched = true
+			} else if t == dns.TypeCNAME {
+				cname = rr
+			}
+		}
+		if matched || cname == nil {
+			if !matched {
+				if soa := d.apex(name); soa != nil {
+					a.Ns = []dns.RR{soa}
+				}
+			}
+			return a
+		}
+
+		cname = dns.Copy(cname)
+		cname.Header().Name = name
+		a.Answer = append(a.Answer, cname)
+		name = cname.(*dns.CNAME).Target
+	}
+	return a
+}
+
+// find returns the records of name, or of the nearest wildcard.
+func (d *localData) find(name string) []dns.RR {
+	name = strings.ToLower(name)
+	if rrs := d.names[name]; rrs != nil {
+		return rrs
+	}
+	for i, end := dns.NextLabel(name, 0); !end; i, end = dns.NextLabel(name, i) {
+		if rrs := d.names["*."+name[i:]]; rrs != nil {
+			return rrs
+		}
+	}
+	return nil
+}
+
+// apex returns the SOA of the zone containing name.
+func (d *localData) apex(name string) dns.RR {
+	name = strings.ToLower(name)
+	for i, end := 0, false; !end; i, end = dns.NextLabel(name, i) {
+		if soa := d.apexes[name[i:]]; soa != nil {
+			return soa
+		}
+	}
+	return nil
+}
+
+func loadLocal(src string) (rrs []dns.RR, errs []string, err error) {
+	f, err := openSource(src)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	b, err := io.ReadAll(f)
+	if err != nil {
+		return
+	}
+
+	if isHostsFile(b) {
+		rrs, errs = parseHosts(bytes.NewReader(b))
+		return
+	}
+
+	zp := dns.NewZoneParser(bytes.NewReader(b), ".", src)
+	zp.SetDefaultTTL(localTTL)
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		rrs = append(rrs, rr)
+	}
+	if err = zp.Err(); err != nil {
+		return nil, nil, err
+	}
+	return
+}
+
+// isHostsFile reports whether all the lines start with an IP address.
+func isHostsFile(b []byte) bool {
+	s := bufio.NewScanner(bytes.NewReader(b))
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		if f := strings.Fields(line); net.ParseIP(f[0]) == nil {
+			return false
+		}
+	}
+	return true
+}
+
+// parseHosts converts hosts entries to A or AAAA records, and PTR records
+// to the first name of each entry.
+func parseHosts(r io.Reader) (rrs []dns.RR, errs []string) {
+	s := bufio.NewScanner(r)
+	for i := 1; s.Scan(); i++ {
+		line, _, _ := strings.Cut(s.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		ip := net.ParseIP(fields[0])
+		if ip == nil || len(fields) < 2 {
+			if len(errs) < maxParseErrors {
+				errs = append(errs, fmt.Sprintf("line %d: invalid hosts entry", i))
+			}
+			continue
+		}
+
+		var ptr string
+		for _, name := range fields[1:] {
+			name = dns.Fqdn(strings.ToLower(name))
+			if _, ok := dns.IsDomainName(name); !ok {
+				if len(errs) < maxParseErrors {
+					errs = append(errs, fmt.Sprintf("line %d: invalid name %s", i, name))
+				}
+				continue
+			}
+			hdr := dns.RR_Header{Name: name, Class: dns.ClassINET, Ttl: localTTL}
+			if ip4 := ip.To4(); ip4 != nil {
+				hdr.Rrtype = dns.TypeA
+				rrs = append(rrs, &dns.A{Hdr: hdr, A: ip4})
+			} else {
+				hdr.Rrtype = dns.TypeAAAA
+				rrs = append(rrs, &dns.AAAA{Hdr: hdr, AAAA: ip})
+			}
+			if ptr == "" && !strings.HasPrefix(name, "*.") {
+				ptr = name
+			}
+		}
+
+		if ptr != "" {
+			arpa, _ := dns.ReverseAddr(ip.String())
+			rrs = append(rrs, &dns.PTR{
+				Hdr: dns.RR_Header{Name: arpa, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: localTTL},
+				Ptr: ptr,
+			})
+		}
+	}
+	return
+}
+
+// privateReverseZones are the reverse zones of private and special
+// addresses, see RFC 6303 and RFC 6761.
+var privateReverseZones = []string{
+	"0.in-addr.arpa.",
+	"10.in-addr.arpa.",
+	"127.in-addr.arpa.",
+	"254.169.in-addr.arpa.",
+	"16.172.in-addr.arpa.", "17.172.in-addr.arpa.", "18.172.in-addr.arpa.",
+	"19.172.in-addr.arpa.", "20.172.in-addr.arpa.", "21.172.in-addr.arpa.",
+	"22.172.in-addr.arpa.", "23.172.in-addr.arpa.", "24.172.in-addr.arpa.",
+	"25.172.in-addr.arpa.", "26.172.in-addr.arpa.", "27.172.in-addr.arpa.",
+	"28.172.in-addr.arpa.", "29.172.in-addr.arpa.", "30.172.in-addr.arpa.",
+	"31.172.in-addr.arpa.",
+	"168.192.in-addr.arpa.",
+	"2.0.192.in-addr.arpa.",
+	"100.51.198.in-addr.arpa.",
+	"113.0.203.in-addr.arpa.",
+	"255.255.255.255.in-addr.arpa.",
+	"0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.ip6.arpa.",
+	"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.ip6.arpa.",
+	"d.f.ip6.arpa.",
+	"8.e.f.ip6.arpa.", "9.e.f.ip6.arpa.", "a.e.f.ip6.arpa.", "b.e.f.ip6.arpa.",
+	"8.b.d.0.1.0.0.2.ip6.arpa.",
+}
+
+// privateReverseReply answers queries of private reverse zones with
+// NXDOMAIN, nil if the name is not in these zones.
+func privateReverseReply(m *dns.Msg) *dns.Msg {
+	name := strings.ToLower(m.Question[0].Name)
+	if !strings.HasSuffix(name, ".arpa.") {
+		return nil
+	}
+	for _, zone := range privateReverseZones {
+		if !dns.IsSubDomain(zone, name) {
+			continue
+		}
+		a := new(dns.Msg)
+		a.SetRcode(m, dns.RcodeNameError)
+		a.Authoritative = true
+		a.RecursionAvailable = true
+		// RFC 6303 section 3 推荐的 SOA
+		soa, _ := dns.NewRR(zone + " 10800 IN SOA " + zone + " nobody.invalid. 1 3600 1200 604800 10800")
+		a.Ns = []dns.RR{soa}
+		return a
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package zns
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+const testLocalZone = `$ORIGIN lan.
+$TTL 60
+@ SOA localhost. root.localhost. 1 3600 600 86400 60
+nas A 192.168.1.2
+*.dev A 192.168.1.3
+www CNAME nas
+ext CNAME example.com.
+nas TXT "hello"
+`
+
+const testHosts = `# hosts
+192.168.1.10 router.home router
+fd00::10 router.home
+`
+
+func TestLocalZone(t *testing.T) {
+	dir := t.TempDir()
+	zone := filepath.Join(dir, "lan.zone")
+	hosts := filepath.Join(dir, "hosts")
+	os.WriteFile(zone, []byte(testLocalZone), 0644)
+	os.WriteFile(hosts, []byte(testHosts), 0644)
+
+	z, err := NewLocalZone([]string{zone, hosts})
+	assert.Nil(t, err)
+	assert.Equal(t, 6, z.Stats()[0].Rules)
+	assert.Equal(t, 5, z.Stats()[1].Rules)
+
+	query := func(name string, qtype uint16) *dns.Msg {
+		m := new(dns.Msg)
+		m.SetQuestion(name, qtype)
+		return z.Reply(m)
+	}
+
+	a := query("NAS.lan.", dns.TypeA)
+	assert.Equal(t, "192.168.1.2", a.Answer[0].(*dns.A).A.String())
+	assert.Equal(t, "NAS.lan.", a.Answer[0].Header().Name)
+
+	a = query("foo.dev.lan.", dns.TypeA)
+	assert.Equal(t, "192.168.1.3", a.Answer[0].(*dns.A).A.String())
+
+	a = query("www.lan.", dns.TypeTXT)
+	assert.Equal(t, 2, len(a.Answer))
+	assert.Equal(t, "nas.lan.", a.Answer[0].(*dns.CNAME).Target)
+	assert.Equal(t, []string{"hello"}, a.Answer[1].(*dns.TXT).Txt)
+
+	a = query("ext.lan.", dns.TypeA)
+	assert.Equal(t, 1, len(a.Answer))
+	assert.Equal(t, "example.com.", a.Answer[0].(*dns.CNAME).Target)
+
+	a = query("nas.lan.", dns.TypeAAAA)
+	assert.Equal(t, dns.RcodeSuccess, a.Rcode)
+	assert.Equal(t, 0, len(a.Answer))
+	assert.Equal(t, dns.TypeSOA, a.Ns[0].Header().Rrtype)
+
+	a = query("none.lan.", dns.TypeA)
+	assert.Equal(t, dns.RcodeNameError, a.Rcode)
+
+	a = query("router.home.", dns.TypeAAAA)
+	assert.Equal(t, "fd00::10", a.Answer[0].(*dns.AAAA).AAAA.String())
+
+	a = query("10.1.168.192.in-addr.arpa.", dns.TypePTR)
+	assert.Equal(t, "router.home.", a.Answer[0].(*dns.PTR).Ptr)
+
+	assert.Nil(t, query("example.com.", dns.TypeA))
+
+	// 重新加载间隔为 0 时不启动定时器
+	z.Watch(0, nil)
+}
+
+func TestPrivateReverseReply(t *testing.T) {
+	m := new(dns.Msg)
+	m.SetQuestion("1.1.168.192.in-addr.arpa.", dns.TypePTR)
+	a := privateReverseReply(m)
+	assert.Equal(t, dns.RcodeNameError, a.Rcode)
+	assert.Equal(t, "168.192.in-addr.arpa.", a.Ns[0].Header().Name)
+
+	m.SetQuestion("1.1.1.1.in-addr.arpa.", dns.TypePTR)
+	assert.Nil(t, privateReverseReply(m))
+}
@@ -0,0 +1,129 @@
+package zns
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Kinds of billed traffic.
+const (
+	billDNS        = "dns"
+	billODoH       = "odoh"
+	billConnect    = "connect"
+	billConnectUDP = "connect-udp"
+)
+
+// 指标不能带 token 标签，否则序列数量随用户增长
+var (
+	registry = prometheus.NewRegistry()
+	factory  = promauto.With(registry)
+
+	queriesTotal = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "zns_queries_total",
+		Help: "Queries by transport, query type, response code and status.",
+	}, []string{"transport", "qtype", "rcode", "status"})
+	queryDuration = factory.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "zns_query_duration_seconds",
+		Help:    "Time to answer queries by transport.",
+		Buckets: prometheus.ExponentialBuckets(0.001, 2, 14),
+	}, []string{"transport"})
+
+	upstreamDuration = factory.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "zns_upstream_duration_seconds",
+		Help:    "Latency of upstream exchanges.",
+		Buckets: prometheus.ExponentialBuckets(0.001, 2, 14),
+	}, []string{"upstream"})
+	upstreamErrors = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "zns_upstream_errors_total",
+		Help: "Failed upstream exchanges.",
+	}, []string{"upstream"})
+
+	blockedTotal = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "zns_blocked_total",
+		Help: "Queries blocked by list.",
+	}, []string{"list"})
+
+	cacheLookups = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "zns_cache_lookups_total",
+		Help: "Cache lookups by result: hit, miss or stale.",
+	}, []string{"result"})
+
+	billedBytes = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "zns_billed_bytes_total",
+		Help: "Bytes billed to tickets by kind: dns, odoh, connect or connect-udp.",
+	}, []string{"kind"})
+
+	proxyTunnels = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "zns_proxy_tunnels_total",
+		Help: "Proxy tunnels opened by protocol: connect or connect-udp.",
+	}, []string{"proto"})
+	proxyActive = factory.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "zns_proxy_tunnels_active",
+		Help: "Proxy tunnels open now by protocol.",
+	}, []string{"proto"})
+	proxyBytes = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "zns_proxy_bytes_total",
+		Help: "Bytes relayed by proxy tunnels by protocol.",
+	}, []string{"proto"})
+
+	payNotifications = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "zns_payment_notifications_total",
+		Help: "Payment notifications by result: success, invalid or error.",
+	}, []string{"result"})
+
+	sqliteDuration = factory.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "zns_sqlite_duration_seconds",
+		Help:    "Latency of SQLite operations.",
+		Buckets: prometheus.ExponentialBuckets(0.0001, 2, 14),
+	}, []string{"op"})
+)
+
+func init() {
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+}
+
+// MetricsHandler serves the Prometheus metrics.
+func MetricsHandler() http.Handler {
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
+
+// observeQuery records the query of qtype answered with w since start.
+func observeQuery(w *answerWriter, transport string, qtype uint16, status string, start time.Time) {
+	rcode := "error"
+	if w.code != 0 && w.code != http.StatusOK {
+		if status == StatusResolved {
+			status = StatusError
+		}
+	} else if len(w.body) >= 4 {
+		rcode = dns.RcodeToString[int(w.body[3]&0xf)]
+	}
+	typ, ok := dns.TypeToString[qtype]
+	if !ok {
+		typ = "other"
+	}
+	queriesTotal.WithLabelValues(transport, typ, rcode, status).Inc()
+	queryDuration.WithLabelValues(transport).Observe(time.Since(start).Seconds())
+}
+
+// observeSQL records the latency of the SQLite operation op since start.
+func observeSQL(op string, start time.Time) {
+	sqliteDuration.WithLabelValues(op).Observe(time.Since(start).Seconds())
+}
+
+// cost charges token with repo and counts the billed bytes of kind.
+func cost(repo TicketRepo, kind, token string, bytes int) error {
+	if err := repo.Cost(token, bytes); err != nil {
+		return err
+	}
+	billedBytes.WithLabelValues(kind).Add(float64(bytes))
+	return nil
+}
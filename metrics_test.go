@@ -0,0 +1,68 @@
+package zns
+
+import (
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetrics(t *testing.T) {
+	up, stop := testUpstream(t)
+	defer stop()
+
+	file := filepath.Join(t.TempDir(), "hosts")
+	os.WriteFile(file, []byte("0.0.0.0 ads.example.com\n"), 0644)
+	b, err := NewBlocklist([]string{"ads=" + file})
+	assert.Nil(t, err)
+
+	h := &Handler{Upstream: up, Repo: FreeTicketRepo{}, Cache: NewCache(100), Blocklist: b}
+
+	query := func(name, param string) int {
+		m := new(dns.Msg)
+		m.SetQuestion(name, dns.TypeA)
+		buf, _ := m.Pack()
+		req := httptest.NewRequest(http.MethodGet, "/dns/secret?dns="+base64.RawURLEncoding.EncodeToString(buf)+param, nil)
+		req.SetPathValue("token", "secret")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, withTransport(req, TransportDoT))
+		return w.Code
+	}
+
+	resolved := queriesTotal.WithLabelValues(TransportDoT, "A", "NOERROR", StatusResolved)
+	cached := queriesTotal.WithLabelValues(TransportDoT, "A", "NOERROR", StatusCached)
+	blocked := queriesTotal.WithLabelValues(TransportDoT, "A", "NXDOMAIN", StatusBlocked)
+	hits, misses := cacheLookups.WithLabelValues("hit"), cacheLookups.WithLabelValues("miss")
+	billed := billedBytes.WithLabelValues(billDNS)
+
+	n0, c0, b0 := testutil.ToFloat64(resolved), testutil.ToFloat64(cached), testutil.ToFloat64(blocked)
+	h0, m0, bytes0 := testutil.ToFloat64(hits), testutil.ToFloat64(misses), testutil.ToFloat64(billed)
+	l0 := testutil.ToFloat64(blockedTotal.WithLabelValues("ads"))
+
+	assert.Equal(t, http.StatusOK, query("metrics.example.com.", ""))
+	assert.Equal(t, http.StatusOK, query("metrics.example.com.", ""))
+	assert.Equal(t, http.StatusOK, query("ads.example.com.", "&noad=1"))
+
+	assert.Equal(t, n0+1, testutil.ToFloat64(resolved))
+	assert.Equal(t, c0+1, testutil.ToFloat64(cached))
+	assert.Equal(t, b0+1, testutil.ToFloat64(blocked))
+	assert.Equal(t, h0+1, testutil.ToFloat64(hits))
+	assert.Equal(t, m0+1, testutil.ToFloat64(misses))
+	assert.Equal(t, l0+1, testutil.ToFloat64(blockedTotal.WithLabelValues("ads")))
+	assert.Greater(t, testutil.ToFloat64(billed), bytes0)
+
+	w := httptest.NewRecorder()
+	MetricsHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body, _ := io.ReadAll(w.Body)
+	assert.Contains(t, string(body), "zns_upstream_duration_seconds")
+	assert.Contains(t, string(body), `zns_query_duration_seconds_count{transport="dot"}`)
+	assert.False(t, strings.Contains(string(body), "secret"))
+}
@@ -0,0 +1,413 @@
+package zns
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"syscall"
+
+	"github.com/cloudflare/circl/hpke"
+	"github.com/cloudflare/circl/kem"
+	"github.com/miekg/dns"
+)
+
+// Oblivious DNS over HTTPS, see RFC 9230.
+
+const (
+	odohVersion     = 0x0001
+	odohTypeQuery   = 0x01
+	odohTypeAnswer  = 0x02
+	odohContentType = "application/oblivious-dns-message"
+
+	odohKEM  = hpke.KEM_X25519_HKDF_SHA256
+	odohKDF  = hpke.KDF_HKDF_SHA256
+	odohAEAD = hpke.AEAD_AES128GCM
+)
+
+// edns0Token is the local EDNS0 option carrying the ticket token, which is
+// used by ODoH clients as the target never sees the client's URL.
+const edns0Token = dns.EDNS0LOCALSTART
+
+// ODoHTarget decrypts oblivious queries and encrypts the answers.
+type ODoHTarget struct {
+	suite   hpke.Suite
+	sk      kem.PrivateKey
+	keyID   []byte
+	configs []byte
+}
+
+// NewODoHTarget creates an ODoHTarget with key pair derived from the 32 bytes seed.
+func NewODoHTarget(seed []byte) (*ODoHTarget, error) {
+	if len(seed) != 32 {
+		return nil, errors.New("odoh seed must be 32 bytes")
+	}
+
+	pk, sk := odohKEM.Scheme().DeriveKeyPair(seed)
+	pub, err := pk.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+
+	// ObliviousDoHConfigContents
+	contents := binary.BigEndian.AppendUint16(nil, uint16(odohKEM))
+	contents = binary.BigEndian.AppendUint16(contents, uint16(odohKDF))
+	contents = binary.BigEndian.AppendUint16(contents, uint16(odohAEAD))
+	contents = appendOpaque16(contents, pub)
+
+	// ObliviousDoHConfig
+	config := binary.BigEndian.AppendUint16(nil, odohVersion)
+	config = appendOpaque16(config, contents)
+
+	prk := odohKDF.Extract(contents, nil)
+	keyID := odohKDF.Expand(prk, []byte("odoh key id"), uint(odohKDF.ExtractSize()))
+
+	return &ODoHTarget{
+		suite:   hpke.NewSuite(odohKEM, odohKDF, odohAEAD),
+		sk:      sk,
+		keyID:   keyID,
+		configs: appendOpaque16(nil, config),
+	}, nil
+}
+
+// Configs returns the serialized ObliviousDoHConfigs.
+func (t *ODoHTarget) Configs() []byte {
+	return t.configs
+}
+
+// ServeHTTP serves the configs at /.well-known/odohconfigs.
+func (t *ODoHTarget) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("content-type", "application/octet-stream")
+	w.Header().Set("cache-control", "max-age=86400")
+	w.Write(t.configs)
+}
+
+// Open decrypts the ObliviousDoHMessage and returns the DNS query and a
+// function to encrypt the answer.
+func (t *ODoHTarget) Open(msg []byte) (query []byte, seal func(answer []byte) ([]byte, error), err error) {
+	typ, keyID, ct, err := parseODoHMessage(msg)
+	if err != nil {
+		return
+	}
+	if typ != odohTypeQuery || !bytes.Equal(keyID, t.keyID) {
+		err = errors.New("invalid odoh query")
+		return
+	}
+
+	nenc := odohKEM.Scheme().CiphertextSize()
+	if len(ct) < nenc {
+		err = errors.New("invalid odoh query")
+		return
+	}
+
+	r, err := t.suite.NewReceiver(t.sk, []byte("odoh query"))
+	if err != nil {
+		return
+	}
+	opener, err := r.Setup(ct[:nenc])
+	if err != nil {
+		return
+	}
+
+	aad := append([]byte{odohTypeQuery}, appendOpaque16(nil, keyID)...)
+	plain, err := opener.Open(ct[nenc:], aad)
+	if err != nil {
+		return
+	}
+
+	query, _, err = readOpaque16(plain)
+	if err != nil {
+		return
+	}
+
+	seal = func(answer []byte) ([]byte, error) {
+		return odohSealAnswer(opener, plain, answer)
+	}
+	return
+}
+
+func odohSealAnswer(ctx hpke.Context, query, answer []byte) ([]byte, error) {
+	nk, nn := odohAEAD.KeySize(), odohAEAD.NonceSize()
+
+	nonce := make([]byte, max(nk, nn))
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	key, iv := odohAnswerKey(ctx, query, nonce)
+	aead, err := odohAEAD.New(key)
+	if err != nil {
+		return nil, err
+	}
+
+	plain := appendOpaque16(nil, answer)
+	plain = appendOpaque16(plain, nil)
+
+	aad := append([]byte{odohTypeAnswer}, appendOpaque16(nil, nonce)...)
+	ct := aead.Seal(nil, iv, plain, aad)
+
+	msg := []byte{odohTypeAnswer}
+	msg = appendOpaque16(msg, nonce)
+	msg = appendOpaque16(msg, ct)
+	return msg, nil
+}
+
+// odohAnswerKey derives the response key and nonce, see RFC 9230 section 6.4.
+func odohAnswerKey(ctx hpke.Context, query, nonce []byte) (key, iv []byte) {
+	nk, nn := odohAEAD.KeySize(), odohAEAD.NonceSize()
+	secret := ctx.Export([]byte("odoh response"), nk)
+	salt := appendOpaque16(bytes.Clone(query), nonce)
+	prk := odohKDF.Extract(secret, salt)
+	key = odohKDF.Expand(prk, []byte("odoh key"), nk)
+	iv = odohKDF.Expand(prk, []byte("odoh nonce"), nn)
+	return
+}
+
+func parseODoHMessage(msg []byte) (typ byte, keyID, ct []byte, err error) {
+	if len(msg) < 1 {
+		err = errors.New("invalid odoh message")
+		return
+	}
+	typ = msg[0]
+	if keyID, msg, err = readOpaque16(msg[1:]); err != nil {
+		return
+	}
+	ct, _, err = readOpaque16(msg)
+	return
+}
+
+func appendOpaque16(b, v []byte) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(v)))
+	return append(b, v...)
+}
+
+func readOpaque16(b []byte) (v, rest []byte, err error) {
+	if len(b) < 2 {
+		return nil, nil, errors.New("invalid opaque length")
+	}
+	n := int(binary.BigEndian.Uint16(b))
+	if len(b) < 2+n {
+		return nil, nil, errors.New("invalid opaque length")
+	}
+	return b[2 : 2+n], b[2+n:], nil
+}
+
+// odohWriter encrypts the answer written by Handler.
+type odohWriter struct {
+	http.ResponseWriter
+	seal func([]byte) ([]byte, error)
+	code int
+}
+
+func (w *odohWriter) WriteHeader(code int) {
+	w.code = code
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *odohWriter) Write(b []byte) (int, error) {
+	if w.code != 0 && w.code != http.StatusOK {
+		return w.ResponseWriter.Write(b)
+	}
+	msg, err := w.seal(b)
+	if err != nil {
+		http.Error(w.ResponseWriter, err.Error(), http.StatusInternalServerError)
+		return 0, err
+	}
+	w.Header().Set("content-type", odohContentType)
+	// 每个应答的密钥都不同，缓存没有意义
+	w.Header().Set("cache-control", "no-store")
+	w.Header().Del("age")
+	if _, err := w.ResponseWriter.Write(msg); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// takeToken removes the token option from m and returns its value.
+func takeToken(m *dns.Msg) (token string) {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return
+	}
+	var opts []dns.EDNS0
+	for _, o := range opt.Option {
+		if l, ok := o.(*dns.EDNS0_LOCAL); ok && l.Code == edns0Token {
+			token = string(l.Data)
+			continue
+		}
+		opts = append(opts, o)
+	}
+	opt.Option = opts
+	return
+}
+
+// errPrivateTarget is returned when the ODoH proxy dials a private address.
+var errPrivateTarget = errors.New("private odoh target")
+
+// odohProxyClient relays oblivious queries to public addresses only, and
+// never follows redirects which could point to internal services.
+var odohProxyClient = &http.Client{
+	Timeout: exchangeTimeout,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: exchangeTimeout,
+			Control: func(network, address string, _ syscall.RawConn) error {
+				ap, err := netip.ParseAddrPort(address)
+				if err != nil {
+					return err
+				}
+				if !publicAddr(ap.Addr()) {
+					return errPrivateTarget
+				}
+				return nil
+			},
+		}).DialContext,
+		ForceAttemptHTTP2:   true,
+		TLSHandshakeTimeout: exchangeTimeout,
+	},
+	CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// nonPublicAddrs are special ranges not covered by netip, which are this
+// network and the shared address space of carrier-grade NAT, see RFC 6598.
+var nonPublicAddrs = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+}
+
+// publicAddr reports whether ip is reachable on the Internet.
+func publicAddr(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	if !ip.IsGlobalUnicast() || ip.IsPrivate() {
+		return false
+	}
+	for _, p := range nonPublicAddrs {
+		if p.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// ODoHProxy relays oblivious queries to targets, see RFC 9230 section 5.
+//
+//	POST /proxy/{token}?targethost=odoh.example&targetpath=/dns-query
+type ODoHProxy struct {
+	Repo   TicketRepo
+	AltSvc string
+
+	// RateLimit limits queries if not nil.
+	RateLimit *RateLimiter
+
+	// TrustedProxies are the peers allowed to set the client address by the
+	// zns-real-addr header.
+	TrustedProxies []netip.Prefix
+
+	// Usage counts the usage of tokens if not nil.
+	Usage *UsageRecorder
+}
+
+func (p *ODoHProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if p.AltSvc != "" {
+		w.Header().Set("Alt-Svc", p.AltSvc)
+	}
+
+	if p.RateLimit != nil {
+		if wait, ok := p.RateLimit.AllowIP(clientAddr(r, p.TrustedProxies)); !ok {
+			tooManyRequests(w, wait)
+			return
+		}
+	}
+
+	token := r.PathValue("token")
+	if token == "" {
+		// https://${token}.zns.lehu.in/proxy
+		token, _, _ = strings.Cut(r.Host, ".")
+	}
+
+	ts, err := p.Repo.List(token, 1)
+	if err != nil {
+		http.Error(w, "invalid token", http.StatusInternalServerError)
+		return
+	}
+	if len(ts) == 0 || ts[0].Bytes <= 0 {
+		http.Error(w, "invalid token", http.StatusUnauthorized)
+		return
+	}
+	if p.RateLimit != nil {
+		if wait, ok := p.RateLimit.AllowToken(token, ts[0]); !ok {
+			tooManyRequests(w, wait)
+			return
+		}
+	}
+
+	if r.Method != http.MethodPost || r.Header.Get("content-type") != odohContentType {
+		http.Error(w, "invalid odoh query", http.StatusBadRequest)
+		return
+	}
+
+	host := r.URL.Query().Get("targethost")
+	path := r.URL.Query().Get("targetpath")
+	if host == "" || !strings.HasPrefix(path, "/") {
+		http.Error(w, "invalid target", http.StatusBadRequest)
+		return
+	}
+	// 禁止转发到内网地址，域名解析后的地址在拨号时检查
+	name := host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		name = h
+	}
+	if ip, err := netip.ParseAddr(strings.Trim(name, "[]")); err == nil && !publicAddr(ip) {
+		http.Error(w, "invalid target", http.StatusForbidden)
+		return
+	}
+
+	query, err := io.ReadAll(io.LimitReader(r.Body, dns.MaxMsgSize))
+	r.Body.Close()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	target := &url.URL{Scheme: "https", Host: host, Path: path}
+	req, err := http.NewRequest(http.MethodPost, target.String(), bytes.NewReader(query))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req.Header.Set("content-type", odohContentType)
+	req.Header.Set("accept", odohContentType)
+
+	resp, err := odohProxyClient.Do(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	answer, err := io.ReadAll(io.LimitReader(resp.Body, dns.MaxMsgSize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	if err = cost(p.Repo, billODoH, token, len(query)+len(answer)); err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if p.Usage != nil {
+		p.Usage.Add(token, ServiceODoH, len(query)+len(answer), 1)
+	}
+
+	w.Header().Set("content-type", resp.Header.Get("content-type"))
+	w.WriteHeader(resp.StatusCode)
+	w.Write(answer)
+}
@@ -0,0 +1,138 @@
+package zns
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+
+	"github.com/cloudflare/circl/hpke"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+type tokenRepo struct {
+	FreeTicketRepo
+	token string
+}
+
+func (r tokenRepo) List(token string, limit int) ([]Ticket, error) {
+	if token != r.token {
+		return nil, nil
+	}
+	return r.FreeTicketRepo.List(token, limit)
+}
+
+func TestODoH(t *testing.T) {
+	up, stop := testUpstream(t)
+	defer stop()
+
+	seed := make([]byte, 32)
+	rand.Read(seed)
+	target, err := NewODoHTarget(seed)
+	assert.Nil(t, err)
+
+	h := &Handler{Upstream: up, Repo: tokenRepo{token: "foo"}, ODoH: target}
+
+	// client side
+	configs, _, err := readOpaque16(target.Configs())
+	assert.Nil(t, err)
+	config, _, err := readOpaque16(configs[2:])
+	assert.Nil(t, err)
+	pub, _, err := readOpaque16(config[6:])
+	assert.Nil(t, err)
+	pk, err := odohKEM.Scheme().UnmarshalBinaryPublicKey(pub)
+	assert.Nil(t, err)
+	keyID := odohKDF.Expand(odohKDF.Extract(config, nil), []byte("odoh key id"), 32)
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	q.SetEdns0(dns.DefaultMsgSize, false)
+	opt := q.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{Code: edns0Token, Data: []byte("foo")})
+	query, _ := q.Pack()
+
+	sender, err := hpke.NewSuite(odohKEM, odohKDF, odohAEAD).NewSender(pk, []byte("odoh query"))
+	assert.Nil(t, err)
+	enc, sealer, err := sender.Setup(rand.Reader)
+	assert.Nil(t, err)
+	plain := appendOpaque16(appendOpaque16(nil, query), nil)
+	aad := append([]byte{odohTypeQuery}, appendOpaque16(nil, keyID)...)
+	ct, err := sealer.Seal(plain, aad)
+	assert.Nil(t, err)
+	msg := appendOpaque16([]byte{odohTypeQuery}, keyID)
+	msg = appendOpaque16(msg, append(enc, ct...))
+
+	req := httptest.NewRequest(http.MethodPost, "https://odoh.zns.test/dns-query", bytes.NewReader(msg))
+	req.Header.Set("content-type", odohContentType)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, odohContentType, w.Header().Get("content-type"))
+
+	typ, nonce, ct, err := parseODoHMessage(w.Body.Bytes())
+	assert.Nil(t, err)
+	assert.Equal(t, byte(odohTypeAnswer), typ)
+
+	key, iv := odohAnswerKey(sealer, plain, nonce)
+	aead, _ := odohAEAD.New(key)
+	plain, err = aead.Open(nil, iv, ct, append([]byte{odohTypeAnswer}, appendOpaque16(nil, nonce)...))
+	assert.Nil(t, err)
+	answer, _, err := readOpaque16(plain)
+	assert.Nil(t, err)
+
+	a := new(dns.Msg)
+	assert.Nil(t, a.Unpack(answer))
+	assert.Equal(t, "1.2.3.4", a.Answer[0].(*dns.A).A.String())
+
+	// the tampered query is rejected
+	msg[len(msg)-1] ^= 1
+	req = httptest.NewRequest(http.MethodPost, "https://foo.zns.test/dns-query", bytes.NewReader(msg))
+	req.Header.Set("content-type", odohContentType)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestODoHProxyPrivateTarget(t *testing.T) {
+	s := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("internal"))
+	}))
+	defer s.Close()
+	_, port, _ := net.SplitHostPort(s.Listener.Addr().String())
+
+	p := &ODoHProxy{Repo: FreeTicketRepo{}}
+	proxy := func(host string) int {
+		req := httptest.NewRequest(http.MethodPost, "/proxy/foo?targethost="+host+"&targetpath=/dns-query", bytes.NewReader([]byte{0}))
+		req.SetPathValue("token", "foo")
+		req.Header.Set("content-type", odohContentType)
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusForbidden, proxy("127.0.0.1:"+port))
+	assert.Equal(t, http.StatusForbidden, proxy("[::1]:"+port))
+	assert.Equal(t, http.StatusForbidden, proxy("10.0.0.1"))
+	// 域名在拨号时检查
+	assert.Equal(t, http.StatusBadGateway, proxy("localhost:"+port))
+	dial := odohProxyClient.Transport.(*http.Transport).DialContext
+	_, err := dial(context.Background(), "tcp", "localhost:"+port)
+	assert.ErrorIs(t, err, errPrivateTarget)
+
+	assert.True(t, publicAddr(netip.MustParseAddr("8.8.8.8")))
+	assert.False(t, publicAddr(netip.MustParseAddr("::ffff:192.168.1.1")))
+	assert.False(t, publicAddr(netip.MustParseAddr("100.64.0.1")))
+	assert.False(t, publicAddr(netip.MustParseAddr("169.254.169.254")))
+	assert.False(t, publicAddr(netip.MustParseAddr("fe80::1")))
+}
+
+func TestODoHProxyRedirect(t *testing.T) {
+	req, _ := http.NewRequest(http.MethodGet, "https://odoh.example/dns-query", nil)
+	assert.Equal(t, http.ErrUseLastResponse, odohProxyClient.CheckRedirect(req, nil))
+}
@@ -0,0 +1,353 @@
+package zns
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/netip"
+	"os"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Status of logged queries.
+const (
+	StatusResolved   = "resolved"
+	StatusCached     = "cached"
+	StatusBlocked    = "blocked"
+	StatusLocal      = "local"
+	StatusSafeSearch = "safesearch"
+	StatusRPZ        = "rpz"
+	StatusError      = "error"
+)
+
+// QueryLog is the record of one query.
+type QueryLog struct {
+	ID       int       `db:"id" json:"-"`
+	Time     time.Time `db:"time" json:"time"`
+	Token    string    `db:"token" json:"token"`
+	Client   string    `db:"client" json:"client"`
+	Name     string    `db:"name" json:"name"`
+	Type     string    `db:"type" json:"type"`
+	Rcode    string    `db:"rcode" json:"rcode,omitempty"`
+	Upstream string    `db:"upstream" json:"upstream,omitempty"`
+	// Latency in milliseconds
+	Latency int64  `db:"latency" json:"latency"`
+	Status  string `db:"status" json:"status"`
+	// Bytes billed, zero for free queries
+	Bytes int `db:"bytes" json:"bytes"`
+}
+
+func (_ *QueryLog) KeyName() string   { return "id" }
+func (_ *QueryLog) TableName() string { return "query_logs" }
+func (l *QueryLog) Schema() string {
+	return "CREATE TABLE IF NOT EXISTS " + l.TableName() + `(
+	` + l.KeyName() + ` INTEGER PRIMARY KEY AUTOINCREMENT,
+	time DATETIME,
+	token TEXT,
+	client TEXT,
+	name TEXT,
+	type TEXT,
+	rcode TEXT,
+	upstream TEXT,
+	latency INTEGER,
+	status TEXT,
+	bytes INTEGER
+);
+	CREATE INDEX IF NOT EXISTS ql_token_time ON ` + l.TableName() + `(token, time);
+	CREATE INDEX IF NOT EXISTS ql_time ON ` + l.TableName() + `(time);`
+}
+
+// QueryLogSink saves query logs.
+type QueryLogSink interface {
+	WriteLogs(logs []QueryLog) error
+}
+
+// QueryLogPruner is the sink which deletes old logs by itself.
+type QueryLogPruner interface {
+	PruneLogs(before time.Time) error
+}
+
+// WriteLogs saves logs into the query_logs table.
+func (r sqliteTicketReop) WriteLogs(logs []QueryLog) error {
+	defer observeSQL("write_logs", time.Now())
+
+	tx, err := r.db.Beginx()
+	if err != nil {
+		return err
+	}
+	for i := range logs {
+		// 时间按字符串比较，统一用 UTC 保存
+		l := logs[i]
+		l.Time = l.Time.UTC()
+		if _, err := tx.Insert(&l); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// PruneLogs deletes logs before the time.
+func (r sqliteTicketReop) PruneLogs(before time.Time) error {
+	defer observeSQL("prune_logs", time.Now())
+
+	q := "delete from " + (*QueryLog).TableName(nil) + " where time < ?"
+	_, err := r.db.Exec(q, before.UTC().Truncate(time.Second))
+	return err
+}
+
+// JSONSink writes logs as JSON lines.
+type JSONSink struct {
+	W io.Writer
+}
+
+func (s JSONSink) WriteLogs(logs []QueryLog) error {
+	e := json.NewEncoder(s.W)
+	for _, l := range logs {
+		if err := e.Encode(l); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FileSink writes logs as JSON lines into Path. The file is rotated to
+// Path.1, Path.2 and so on when it exceeds MaxSize bytes, and only
+// MaxBackups old files are kept.
+type FileSink struct {
+	Path       string
+	MaxSize    int64
+	MaxBackups int
+
+	f    *os.File
+	size int64
+}
+
+func (s *FileSink) WriteLogs(logs []QueryLog) error {
+	if s.f == nil {
+		if err := s.open(); err != nil {
+			return err
+		}
+	}
+	w := &countWriter{w: s.f}
+	err := JSONSink{W: w}.WriteLogs(logs)
+	s.size += w.n
+	if err != nil {
+		return err
+	}
+	if s.MaxSize > 0 && s.size >= s.MaxSize {
+		return s.rotate()
+	}
+	return nil
+}
+
+func (s *FileSink) open() error {
+	f, err := os.OpenFile(s.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	s.f, s.size = f, fi.Size()
+	return nil
+}
+
+func (s *FileSink) rotate() error {
+	s.f.Close()
+	s.f = nil
+	if s.MaxBackups <= 0 {
+		return os.Remove(s.Path)
+	}
+	// 从最旧的开始依次后移，超过 MaxBackups 的被覆盖
+	for i := s.MaxBackups - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", s.Path, i), fmt.Sprintf("%s.%d", s.Path, i+1))
+	}
+	return os.Rename(s.Path, s.Path+".1")
+}
+
+// Close closes the current file.
+func (s *FileSink) Close() error {
+	if s.f == nil {
+		return nil
+	}
+	err := s.f.Close()
+	s.f = nil
+	return err
+}
+
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countWriter) Write(b []byte) (int, error) {
+	n, err := w.w.Write(b)
+	w.n += int64(n)
+	return n, err
+}
+
+const (
+	// queryLogBuffer is the max number of logs waiting to be written,
+	// more logs are dropped.
+	queryLogBuffer = 4096
+	// queryLogBatch is the max number of logs written at once.
+	queryLogBatch = 256
+	// queryLogFlush is the interval of writing logs.
+	queryLogFlush = 1 * time.Second
+	// queryLogPrune is the interval of deleting expired logs.
+	queryLogPrune = 1 * time.Hour
+)
+
+// QueryLogger writes query logs to sinks asynchronously.
+type QueryLogger struct {
+	Sinks []QueryLogSink
+	// Anonymize masks client addresses to /24 for IPv4 and /48 for IPv6.
+	Anonymize bool
+	// Retention is the age of logs deleted from sinks implementing
+	// QueryLogPruner, zero to keep them.
+	Retention time.Duration
+
+	// mu guards closing logs against Log in flight
+	mu      sync.RWMutex
+	closed  bool
+	logs    chan QueryLog
+	done    chan struct{}
+	dropped atomic.Int64
+}
+
+// NewQueryLogger creates QueryLogger and starts writing.
+func NewQueryLogger(sinks ...QueryLogSink) *QueryLogger {
+	l := &QueryLogger{
+		Sinks: sinks,
+		logs:  make(chan QueryLog, queryLogBuffer),
+		done:  make(chan struct{}),
+	}
+	go l.run()
+	return l
+}
+
+// Log queues the log without blocking. It is dropped if the queue is full
+// or the logger is closed.
+func (l *QueryLogger) Log(q QueryLog) {
+	if l.Anonymize {
+		q.Client = anonymize(q.Client)
+	}
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.closed {
+		return
+	}
+	select {
+	case l.logs <- q:
+	default:
+		l.dropped.Add(1)
+	}
+}
+
+// Close writes the queued logs and stops.
+func (l *QueryLogger) Close() {
+	l.mu.Lock()
+	if !l.closed {
+		l.closed = true
+		close(l.logs)
+	}
+	l.mu.Unlock()
+	<-l.done
+}
+
+func (l *QueryLogger) run() {
+	defer close(l.done)
+
+	t := time.NewTicker(queryLogFlush)
+	defer t.Stop()
+	prune := time.NewTicker(queryLogPrune)
+	defer prune.Stop()
+
+	batch := make([]QueryLog, 0, queryLogBatch)
+	flush := func() {
+		if n := l.dropped.Swap(0); n > 0 {
+			log.Println("query logs dropped", n)
+		}
+		if len(batch) == 0 {
+			return
+		}
+		for _, s := range l.Sinks {
+			if err := s.WriteLogs(batch); err != nil {
+				log.Println("Failed to write query logs", err)
+			}
+		}
+		batch = batch[:0]
+	}
+
+	for {
+		select {
+		case q, ok := <-l.logs:
+			if !ok {
+				flush()
+				return
+			}
+			if batch = append(batch, q); len(batch) >= queryLogBatch {
+				flush()
+			}
+		case <-t.C:
+			flush()
+		case <-prune.C:
+			l.prune(time.Now())
+		}
+	}
+}
+
+// prune deletes logs older than Retention from the sinks.
+func (l *QueryLogger) prune(now time.Time) {
+	if l.Retention <= 0 {
+		return
+	}
+	for _, s := range l.Sinks {
+		if p, ok := s.(QueryLogPruner); ok {
+			if err := p.PruneLogs(now.Add(-l.Retention)); err != nil {
+				log.Println("Failed to prune query logs", err)
+			}
+		}
+	}
+}
+
+// answerWriter keeps the status and the answer written, which are used by
+// the query log, dnstap and metrics.
+type answerWriter struct {
+	http.ResponseWriter
+	code int
+	body []byte
+}
+
+func (w *answerWriter) WriteHeader(code int) {
+	w.code = code
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *answerWriter) Write(b []byte) (int, error) {
+	if w.body == nil {
+		w.body = slices.Clone(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func anonymize(addr string) string {
+	ip, err := netip.ParseAddr(addr)
+	if err != nil {
+		return ""
+	}
+	bits := 48
+	if ip.Is4() {
+		bits = 24
+	}
+	p, _ := ip.Prefix(bits)
+	return p.Addr().String()
+}
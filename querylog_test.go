@@ -0,0 +1,169 @@
+package zns
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+type testSink struct {
+	mu   sync.Mutex
+	logs []QueryLog
+}
+
+func (s *testSink) WriteLogs(logs []QueryLog) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.logs = append(s.logs, logs...)
+	return nil
+}
+
+func TestFileSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "query.log")
+	s := &FileSink{Path: path, MaxSize: 100, MaxBackups: 2}
+	defer s.Close()
+
+	for range 4 {
+		assert.Nil(t, s.WriteLogs([]QueryLog{{Name: "example.com.", Type: "A"}}))
+	}
+
+	for _, p := range []string{path + ".1", path + ".2"} {
+		_, err := os.Stat(p)
+		assert.Nil(t, err, p)
+	}
+	_, err := os.Stat(path + ".3")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestSqliteSink(t *testing.T) {
+	repo := NewTicketRepo(":memory:")
+	sink := repo.(QueryLogSink)
+	assert.Nil(t, sink.WriteLogs([]QueryLog{{Token: "foo", Name: "a."}, {Token: "foo", Name: "b."}}))
+
+	var n int
+	assert.Nil(t, repo.(sqliteTicketReop).db.Get(&n, "select count(*) from query_logs where token = ?", "foo"))
+	assert.Equal(t, 2, n)
+}
+
+func TestQueryLog(t *testing.T) {
+	up, stop := testUpstream(t)
+	defer stop()
+
+	repo := NewTicketRepo(":memory:")
+	repo.New("foo", 1000, "buy-1", "pay-1")
+	repo.New("bar", 1000, "buy-2", "pay-2")
+	fr := repo.(FilterRepo)
+	fr.SetFilter(Filter{Token: "foo", Deny: []string{"ads.example"}})
+	fr.SetFilter(Filter{Token: "bar", NoLog: true})
+
+	sink := &testSink{}
+	ql := NewQueryLogger(sink)
+	ql.Anonymize = true
+	h := &Handler{
+		Upstream: up,
+		Repo:     repo,
+		Filters:  &Filters{Repo: fr, Tickets: repo},
+		QueryLog: ql,
+	}
+
+	query := func(token, name string) {
+		m := new(dns.Msg)
+		m.SetQuestion(name, dns.TypeA)
+		b, _ := m.Pack()
+		req := httptest.NewRequest(http.MethodGet, "/dns/"+token+"?dns="+base64.RawURLEncoding.EncodeToString(b), nil)
+		req.SetPathValue("token", token)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusOK, w.Code)
+	}
+
+	query("foo", "example.com.")
+	query("foo", "ads.example.")
+	query("foo", "1.1.168.192.in-addr.arpa.")
+	query("bar", "example.com.")
+	ql.Close()
+
+	logs := sink.logs
+	assert.Equal(t, 3, len(logs))
+
+	l := logs[0]
+	assert.Equal(t, "foo", l.Token)
+	assert.Equal(t, "192.0.2.0", l.Client)
+	assert.Equal(t, "example.com.", l.Name)
+	assert.Equal(t, "A", l.Type)
+	assert.Equal(t, "NOERROR", l.Rcode)
+	assert.Equal(t, StatusResolved, l.Status)
+	assert.Equal(t, up.list[0].url, l.Upstream)
+	assert.True(t, l.Bytes > 0)
+
+	assert.Equal(t, StatusBlocked, logs[1].Status)
+	assert.Equal(t, "NXDOMAIN", logs[1].Rcode)
+	assert.Equal(t, 0, logs[1].Bytes)
+
+	assert.Equal(t, StatusLocal, logs[2].Status)
+}
+
+func TestQueryLogCostFailed(t *testing.T) {
+	up, stop := testUpstream(t)
+	defer stop()
+
+	sink := &testSink{}
+	ql := NewQueryLogger(sink)
+	h := &Handler{Upstream: up, Repo: poorRepo{}, QueryLog: ql}
+
+	m := new(dns.Msg)
+	m.SetQuestion("example.com.", dns.TypeA)
+	b, _ := m.Pack()
+	req := httptest.NewRequest(http.MethodGet, "/dns/foo?dns="+base64.RawURLEncoding.EncodeToString(b), nil)
+	req.SetPathValue("token", "foo")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	ql.Close()
+
+	// 扣费失败的流量不记录
+	assert.Equal(t, 1, len(sink.logs))
+	assert.Equal(t, StatusError, sink.logs[0].Status)
+	assert.Equal(t, 0, sink.logs[0].Bytes)
+}
+
+func TestQueryLogAfterClose(t *testing.T) {
+	sink := &testSink{}
+	ql := NewQueryLogger(sink)
+	ql.Log(QueryLog{Name: "a."})
+	ql.Close()
+	// 关闭后仍在处理的请求不能导致崩溃
+	ql.Log(QueryLog{Name: "b."})
+	ql.Close()
+	assert.Equal(t, 1, len(sink.logs))
+}
+
+func TestQueryLogPrune(t *testing.T) {
+	repo := NewTicketRepo(":memory:")
+	sink := repo.(QueryLogSink)
+	now := time.Now()
+	// 不同时区的时间也按实际先后删除
+	old := now.Add(-48 * time.Hour).In(time.FixedZone("", 14*3600))
+	recent := now.Add(-20 * time.Hour).In(time.FixedZone("", -12*3600))
+	assert.Nil(t, sink.WriteLogs([]QueryLog{{Token: "foo", Name: "old.", Time: old}, {Token: "foo", Name: "new.", Time: recent}}))
+
+	l := &QueryLogger{Sinks: []QueryLogSink{sink}}
+	l.prune(now)
+	var names []string
+	assert.Nil(t, repo.(sqliteTicketReop).db.Select(&names, "select name from query_logs"))
+	assert.Equal(t, []string{"old.", "new."}, names)
+
+	l.Retention = 24 * time.Hour
+	l.prune(now)
+	names = nil
+	assert.Nil(t, repo.(sqliteTicketReop).db.Select(&names, "select name from query_logs"))
+	assert.Equal(t, []string{"new."}, names)
+}
@@ -0,0 +1,223 @@
+package zns
+
+import (
+	"container/list"
+	"errors"
+	"hash/maphash"
+	"math"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Limit is the token bucket of Rate queries per second and Burst queries.
+// Zero Rate means no limit.
+type Limit struct {
+	Rate  float64
+	Burst int
+}
+
+// ParseLimit parses limits like 10/20, which means 10 queries per second
+// with burst 20. The burst equals to the rate if omitted.
+func ParseLimit(s string) (l Limit, err error) {
+	if s == "" || s == "0" {
+		return
+	}
+	r, b, ok := strings.Cut(s, "/")
+	if l.Rate, err = strconv.ParseFloat(r, 64); err != nil || l.Rate < 0 {
+		return l, errors.New("invalid rate limit: " + s)
+	}
+	l.Burst = int(math.Ceil(l.Rate))
+	if ok {
+		if l.Burst, err = strconv.Atoi(b); err != nil || l.Burst < 1 {
+			return l, errors.New("invalid rate limit: " + s)
+		}
+	}
+	return
+}
+
+// RatePlan is the token limit of tickets whose total bytes are at least
+// Bytes.
+type RatePlan struct {
+	Bytes int
+	Limit Limit
+}
+
+// ParseRatePlans parses comma separated bytes=limit pairs like
+//
+//	0=10/20,1073741824=50/100
+func ParseRatePlans(s string) ([]RatePlan, error) {
+	var ps []RatePlan
+	for _, kv := range strings.Split(s, ",") {
+		if kv == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok {
+			return nil, errors.New("invalid rate plan: " + kv)
+		}
+		n, err := strconv.Atoi(k)
+		if err != nil {
+			return nil, errors.New("invalid rate plan: " + kv)
+		}
+		l, err := ParseLimit(v)
+		if err != nil {
+			return nil, err
+		}
+		ps = append(ps, RatePlan{Bytes: n, Limit: l})
+	}
+	// 大套餐优先
+	slices.SortStableFunc(ps, func(a, b RatePlan) int {
+		return b.Bytes - a.Bytes
+	})
+	return ps, nil
+}
+
+const (
+	limiterShards = 32
+	// maxBuckets is the max number of buckets, the least recently used ones
+	// are evicted beyond it.
+	maxBuckets = 100000
+)
+
+var limiterSeed = maphash.MakeSeed()
+
+type bucket struct {
+	key    string
+	tokens float64
+	last   time.Time
+	limit  Limit
+}
+
+// take refills the bucket and takes one token. It returns how long to wait
+// if no token is left.
+func (b *bucket) take(now time.Time) (time.Duration, bool) {
+	b.tokens = min(float64(b.limit.Burst), b.tokens+now.Sub(b.last).Seconds()*b.limit.Rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0, true
+	}
+	return time.Duration((1 - b.tokens) / b.limit.Rate * float64(time.Second)), false
+}
+
+func (b *bucket) idle(now time.Time) bool {
+	return b.tokens+now.Sub(b.last).Seconds()*b.limit.Rate >= float64(b.limit.Burst)
+}
+
+// RateLimiter limits queries globally, per client network and per token.
+type RateLimiter struct {
+	Global Limit
+	IP     Limit
+	// Bits4 and Bits6 are the prefix lengths of client networks.
+	Bits4 int
+	Bits6 int
+	// Plans are the token limits by the total bytes of the current ticket.
+	Plans []RatePlan
+
+	shards [limiterShards]limiterShard
+}
+
+type limiterShard struct {
+	mu      sync.Mutex
+	buckets map[string]*list.Element
+	lru     *list.List
+}
+
+// AllowIP checks the global limit and the limit of the client network.
+func (l *RateLimiter) AllowIP(ip netip.Addr) (time.Duration, bool) {
+	if wait, ok := l.allow("", l.Global); !ok {
+		return wait, false
+	}
+	if !ip.IsValid() {
+		return 0, true
+	}
+	ip = ip.Unmap()
+	bits := l.Bits6
+	if ip.Is4() {
+		bits = l.Bits4
+	}
+	p, err := ip.Prefix(bits)
+	if err != nil {
+		return 0, true
+	}
+	return l.allow(p.String(), l.IP)
+}
+
+// AllowToken checks the limit of the plan of ticket t.
+func (l *RateLimiter) AllowToken(token string, t Ticket) (time.Duration, bool) {
+	for _, p := range l.Plans {
+		if t.TotalBytes >= p.Bytes {
+			return l.allow("t:"+token, p.Limit)
+		}
+	}
+	return 0, true
+}
+
+func (l *RateLimiter) allow(key string, limit Limit) (time.Duration, bool) {
+	if limit.Rate <= 0 {
+		return 0, true
+	}
+
+	sh := &l.shards[maphash.String(limiterSeed, key)%limiterShards]
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	now := time.Now()
+	if sh.buckets == nil {
+		sh.buckets = map[string]*list.Element{}
+		sh.lru = list.New()
+	}
+	if e, ok := sh.buckets[key]; ok {
+		b := e.Value.(*bucket)
+		if b.limit == limit {
+			sh.lru.MoveToFront(e)
+			return b.take(now)
+		}
+		sh.lru.Remove(e)
+		delete(sh.buckets, key)
+	}
+
+	b := &bucket{key: key, tokens: float64(limit.Burst), last: now, limit: limit}
+	sh.buckets[key] = sh.lru.PushFront(b)
+	sh.evict(now)
+	return b.take(now)
+}
+
+// evict removes the least recently used buckets beyond the cap, and a few
+// idle ones which would be refilled anyway.
+func (sh *limiterShard) evict(now time.Time) {
+	for i := 0; sh.lru.Len() > 1; i++ {
+		e := sh.lru.Back()
+		b := e.Value.(*bucket)
+		if sh.lru.Len() <= maxBuckets/limiterShards && (i >= 2 || !b.idle(now)) {
+			return
+		}
+		sh.lru.Remove(e)
+		delete(sh.buckets, b.key)
+	}
+}
+
+// tooManyRequests replies 429 with the Retry-After header in seconds.
+func tooManyRequests(w http.ResponseWriter, wait time.Duration) {
+	secs := int(math.Ceil(wait.Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(max(secs, 1)))
+	http.Error(w, "too many requests", http.StatusTooManyRequests)
+}
+
+// refused packs the REFUSED answer of the packed query.
+func refused(query []byte) ([]byte, error) {
+	m := new(dns.Msg)
+	if err := m.Unpack(query); err != nil {
+		return nil, err
+	}
+	a := new(dns.Msg)
+	a.SetRcode(m, dns.RcodeRefused)
+	return a.Pack()
+}
@@ -0,0 +1,164 @@
+package zns
+
+import (
+	"encoding/base64"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseLimit(t *testing.T) {
+	l, err := ParseLimit("10/20")
+	assert.Nil(t, err)
+	assert.Equal(t, Limit{Rate: 10, Burst: 20}, l)
+
+	l, err = ParseLimit("0.5")
+	assert.Nil(t, err)
+	assert.Equal(t, Limit{Rate: 0.5, Burst: 1}, l)
+
+	for _, s := range []string{"x", "10/0", "-1"} {
+		_, err = ParseLimit(s)
+		assert.NotNil(t, err, s)
+	}
+
+	ps, err := ParseRatePlans("0=10/20,1073741824=50/100")
+	assert.Nil(t, err)
+	assert.Equal(t, 1073741824, ps[0].Bytes)
+	assert.Equal(t, 0, ps[1].Bytes)
+}
+
+func TestBucket(t *testing.T) {
+	now := time.Now()
+	b := &bucket{tokens: 2, last: now, limit: Limit{Rate: 2, Burst: 2}}
+	_, ok := b.take(now)
+	assert.True(t, ok)
+	_, ok = b.take(now)
+	assert.True(t, ok)
+	wait, ok := b.take(now)
+	assert.False(t, ok)
+	assert.Equal(t, 500*time.Millisecond, wait)
+
+	_, ok = b.take(now.Add(500 * time.Millisecond))
+	assert.True(t, ok)
+	assert.False(t, b.idle(now.Add(500*time.Millisecond)))
+	assert.True(t, b.idle(now.Add(2*time.Second)))
+}
+
+func TestRateLimiterEvict(t *testing.T) {
+	l := &RateLimiter{}
+	limit := Limit{Rate: 0.001, Burst: 1}
+	for i := range maxBuckets + 10000 {
+		l.allow(strconv.Itoa(i), limit)
+	}
+	n := 0
+	for i := range l.shards {
+		n += len(l.shards[i].buckets)
+		assert.Equal(t, len(l.shards[i].buckets), l.shards[i].lru.Len())
+	}
+	assert.LessOrEqual(t, n, maxBuckets)
+
+	// 最近使用的保留，最久未用的被淘汰
+	_, ok := l.allow(strconv.Itoa(maxBuckets+9999), limit)
+	assert.False(t, ok)
+	_, ok = l.allow("0", limit)
+	assert.True(t, ok)
+}
+
+func TestRateLimiter(t *testing.T) {
+	l := &RateLimiter{
+		IP:    Limit{Rate: 1, Burst: 2},
+		Bits4: 24,
+		Bits6: 56,
+		Plans: []RatePlan{{Bytes: 100, Limit: Limit{Rate: 1, Burst: 3}}, {Bytes: 0, Limit: Limit{Rate: 1, Burst: 1}}},
+	}
+
+	a := netip.MustParseAddr("192.0.2.1")
+	b := netip.MustParseAddr("192.0.2.2")
+	c := netip.MustParseAddr("198.51.100.1")
+	_, ok := l.AllowIP(a)
+	assert.True(t, ok)
+	_, ok = l.AllowIP(b)
+	assert.True(t, ok)
+	_, ok = l.AllowIP(a)
+	assert.False(t, ok)
+	_, ok = l.AllowIP(c)
+	assert.True(t, ok)
+
+	for range 3 {
+		_, ok = l.AllowToken("big", Ticket{TotalBytes: 200})
+		assert.True(t, ok)
+	}
+	_, ok = l.AllowToken("big", Ticket{TotalBytes: 200})
+	assert.False(t, ok)
+
+	_, ok = l.AllowToken("small", Ticket{TotalBytes: 10})
+	assert.True(t, ok)
+	_, ok = l.AllowToken("small", Ticket{TotalBytes: 10})
+	assert.False(t, ok)
+}
+
+func TestRateLimitHandler(t *testing.T) {
+	up, stop := testUpstream(t)
+	defer stop()
+
+	h := &Handler{
+		Upstream:  up,
+		Repo:      FreeTicketRepo{},
+		RateLimit: &RateLimiter{Plans: []RatePlan{{Limit: Limit{Rate: 0.1, Burst: 1}}}},
+		Clients:   []ClientNet{{Prefix: netip.MustParsePrefix("127.0.0.0/8"), Token: "foo"}},
+	}
+
+	m := new(dns.Msg)
+	m.SetQuestion("example.com.", dns.TypeA)
+	b, _ := m.Pack()
+	query := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/dns/foo?dns="+base64.RawURLEncoding.EncodeToString(b), nil)
+		req.SetPathValue("token", "foo")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	assert.Equal(t, http.StatusOK, query().Code)
+	w := query()
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "10", w.Header().Get("Retry-After"))
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	s := &dns.Server{PacketConn: pc, Handler: h}
+	go s.ActivateAndServe()
+	defer s.Shutdown()
+
+	a, _, err := new(dns.Client).Exchange(m, pc.LocalAddr().String())
+	assert.Nil(t, err)
+	assert.Equal(t, dns.RcodeRefused, a.Rcode)
+}
+
+func TestClientAddrTrusted(t *testing.T) {
+	trusted, err := ParsePrefixes("10.0.0.0/8,::1")
+	assert.Nil(t, err)
+
+	r := httptest.NewRequest(http.MethodGet, "/dns-query", nil)
+	r.RemoteAddr = "192.0.2.1:1234"
+	r.Header.Set("zns-real-addr", "203.0.113.9:53")
+	// 不可信的对端不能伪造客户端地址
+	assert.Equal(t, "192.0.2.1", clientAddr(r, trusted).String())
+
+	r.RemoteAddr = "10.1.2.3:1234"
+	assert.Equal(t, "203.0.113.9", clientAddr(r, trusted).String())
+
+	r.RemoteAddr = "[::1]:1234"
+	assert.Equal(t, "203.0.113.9", clientAddr(r, trusted).String())
+	assert.Equal(t, "::1", clientAddr(r, nil).String())
+
+	_, err = ParsePrefixes("10.0.0.0/33")
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,359 @@
+package zns
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Response Policy Zones, see https://datatracker.ietf.org/doc/draft-vixie-dnsop-dns-rpz/
+//
+// Supported triggers are QNAME, response IP (rpz-ip) and NSDNAME. NSDNAME
+// triggers only match the NS records carried in the upstream answer.
+// Supported actions are NXDOMAIN, NODATA, PASSTHRU, DROP and local data.
+
+type rpzAction int
+
+const (
+	rpzLocal rpzAction = iota
+	rpzNXDOMAIN
+	rpzNODATA
+	rpzPassthru
+	rpzDrop
+)
+
+// statusDropped is the HTTP status of queries dropped by RPZ. Plain DNS
+// clients get no response at all.
+const statusDropped = http.StatusGatewayTimeout
+
+type rpzRule struct {
+	zone   string
+	action rpzAction
+	data   []dns.RR
+}
+
+type rpzZone struct {
+	name     string
+	qnames   map[string]*rpzRule
+	nsdnames map[string]*rpzRule
+	ips      map[netip.Prefix]*rpzRule
+	bits     []int // prefix lengths of ips, longest first
+	rules    int
+}
+
+// RPZ loads policy zone files from local files or URLs. Zones are checked
+// in order and the first matched rule wins.
+type RPZ struct {
+	Sources []string
+
+	zones atomic.Pointer[[]*rpzZone]
+
+	sourceSet[*rpzZone]
+}
+
+// NewRPZ creates a RPZ and loads all the zones.
+func NewRPZ(sources []string) (*RPZ, error) {
+	p := &RPZ{Sources: sources}
+	return p, p.Reload()
+}
+
+// Reload loads all the zones again.
+func (p *RPZ) Reload() error {
+	return p.reload(p.Sources, false, loadRPZ, func(loaded []*rpzZone, stats []ListStat) error {
+		var zones []*rpzZone
+		for i, z := range loaded {
+			if z != nil {
+				stats[i].Name = z.name
+				stats[i].Rules = z.rules
+				zones = append(zones, z)
+			}
+		}
+		p.zones.Store(&zones)
+		return nil
+	})
+}
+
+// Watch reloads the zones every d until stop is closed. It returns
+// immediately if d is not positive.
+func (p *RPZ) Watch(d time.Duration, stop <-chan struct{}) {
+	watch(d, stop, p.Reload)
+}
+
+// Query returns the rule of QNAME triggers matching name.
+func (p *RPZ) Query(name string) *rpzRule {
+	zones := p.zones.Load()
+	if zones == nil {
+		return nil
+	}
+	name = strings.ToLower(dns.Fqdn(name))
+	for _, z := range *zones {
+		if r := lookupName(z.qnames, name); r != nil {
+			return r
+		}
+	}
+	return nil
+}
+
+// Answer returns the rule of triggers matching the upstream answer, which
+// are QNAME of CNAME targets, response IP and NSDNAME.
+func (p *RPZ) Answer(a *dns.Msg) *rpzRule {
+	zones := p.zones.Load()
+	if zones == nil {
+		return nil
+	}
+	for _, z := range *zones {
+		if r := z.answer(a); r != nil {
+			return r
+		}
+	}
+	return nil
+}
+
+func (z *rpzZone) answer(a *dns.Msg) *rpzRule {
+	for _, rr := range a.Answer {
+		if c, ok := rr.(*dns.CNAME); ok {
+			if r := lookupName(z.qnames, strings.ToLower(c.Target)); r != nil {
+				return r
+			}
+		}
+	}
+	for _, rr := range a.Answer {
+		var addr netip.Addr
+		switch v := rr.(type) {
+		case *dns.A:
+			addr, _ = netip.AddrFromSlice(v.A.To4())
+		case *dns.AAAA:
+			addr, _ = netip.AddrFromSlice(v.AAAA)
+		default:
+			continue
+		}
+		addr = addr.Unmap()
+		for _, bits := range z.bits {
+			if bits > addr.BitLen() {
+				continue
+			}
+			if r := z.ips[netip.PrefixFrom(addr, bits).Masked()]; r != nil {
+				return r
+			}
+		}
+	}
+	for _, rr := range append(a.Answer[:len(a.Answer):len(a.Answer)], a.Ns...) {
+		if ns, ok := rr.(*dns.NS); ok {
+			if r := lookupName(z.nsdnames, strings.ToLower(ns.Ns)); r != nil {
+				return r
+			}
+		}
+	}
+	return nil
+}
+
+// lookupName finds the rule of name, or the nearest wildcard *.parent.
+func lookupName(rules map[string]*rpzRule, name string) *rpzRule {
+	if len(rules) == 0 {
+		return nil
+	}
+	if r := rules[name]; r != nil {
+		return r
+	}
+	for i, end := dns.NextLabel(name, 0); !end; i, end = dns.NextLabel(name, i) {
+		if r := rules["*."+name[i:]]; r != nil {
+			return r
+		}
+	}
+	return nil
+}
+
+// Reply builds the answer of q by the rule. CNAME targets of local data are
+// not resolved.
+func (r *rpzRule) Reply(q *dns.Msg) *dns.Msg {
+	a := new(dns.Msg)
+	a.SetReply(q)
+	a.RecursionAvailable = true
+
+	qs := q.Question[0]
+	switch r.action {
+	case rpzNXDOMAIN:
+		a.Rcode = dns.RcodeNameError
+	case rpzLocal:
+		for _, rr := range r.data {
+			h := rr.Header()
+			if h.Rrtype != qs.Qtype && h.Rrtype != dns.TypeCNAME {
+				continue
+			}
+			rr = dns.Copy(rr)
+			rr.Header().Name = qs.Name
+			if c, ok := rr.(*dns.CNAME); ok && strings.HasPrefix(c.Target, "*.") {
+				c.Target = qs.Name + c.Target[2:]
+			}
+			a.Answer = append(a.Answer, rr)
+			if h.Rrtype == dns.TypeCNAME {
+				// CNAME 不能与其他记录共存
+				a.Answer = a.Answer[len(a.Answer)-1:]
+				break
+			}
+		}
+		setEDE(a, dns.ExtendedErrorCodeForgedAnswer, "rpz "+r.zone)
+		return a
+	}
+	setEDE(a, dns.ExtendedErrorCodeBlocked, "rpz "+r.zone)
+	return a
+}
+
+// rpzTTL is the TTL of local data without explicit TTL.
+const rpzTTL = 60
+
+func loadRPZ(src string) (z *rpzZone, errs []string, err error) {
+	f, err := openSource(src)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	zp := dns.NewZoneParser(f, "", src)
+	zp.SetDefaultTTL(rpzTTL)
+
+	z = &rpzZone{
+		qnames:   map[string]*rpzRule{},
+		nsdnames: map[string]*rpzRule{},
+		ips:      map[netip.Prefix]*rpzRule{},
+	}
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		h := rr.Header()
+		if z.name == "" {
+			if h.Rrtype != dns.TypeSOA {
+				return nil, nil, errors.New("missing SOA")
+			}
+			z.name = strings.ToLower(h.Name)
+			continue
+		}
+		if err := z.add(rr); err != nil && len(errs) < maxParseErrors {
+			errs = append(errs, fmt.Sprintf("%s: %v", h.Name, err))
+		}
+	}
+	if err = zp.Err(); err != nil {
+		return nil, nil, err
+	}
+	if z.name == "" {
+		return nil, nil, errors.New("missing SOA")
+	}
+
+	for p := range z.ips {
+		if !slices.Contains(z.bits, p.Bits()) {
+			z.bits = append(z.bits, p.Bits())
+		}
+	}
+	slices.Sort(z.bits)
+	slices.Reverse(z.bits)
+	return z, errs, nil
+}
+
+func (z *rpzZone) add(rr dns.RR) error {
+	h := rr.Header()
+	if h.Rrtype == dns.TypeNS || h.Rrtype == dns.TypeSOA {
+		return nil
+	}
+
+	owner := strings.ToLower(h.Name)
+	if !dns.IsSubDomain(z.name, owner) || owner == z.name {
+		return errors.New("out of zone")
+	}
+	owner = strings.TrimSuffix(owner, "."+z.name)
+
+	var r *rpzRule
+	switch {
+	case strings.HasSuffix(owner, ".rpz-ip"):
+		p, err := parseRPZIP(strings.TrimSuffix(owner, ".rpz-ip"))
+		if err != nil {
+			return err
+		}
+		if r = z.ips[p]; r == nil {
+			r = z.newRule()
+			z.ips[p] = r
+		}
+	case strings.HasSuffix(owner, ".rpz-nsdname"):
+		name := strings.TrimSuffix(owner, ".rpz-nsdname") + "."
+		if r = z.nsdnames[name]; r == nil {
+			r = z.newRule()
+			z.nsdnames[name] = r
+		}
+	case strings.HasSuffix(owner, ".rpz-client-ip") || strings.HasSuffix(owner, ".rpz-nsip"):
+		return errors.New("unsupported trigger")
+	default:
+		name := owner + "."
+		if r = z.qnames[name]; r == nil {
+			r = z.newRule()
+			z.qnames[name] = r
+		}
+	}
+
+	if c, ok := rr.(*dns.CNAME); ok {
+		switch strings.ToLower(c.Target) {
+		case ".":
+			r.action = rpzNXDOMAIN
+			return nil
+		case "*.":
+			r.action = rpzNODATA
+			return nil
+		case "rpz-passthru.":
+			r.action = rpzPassthru
+			return nil
+		case "rpz-drop.":
+			r.action = rpzDrop
+			return nil
+		case "rpz-tcp-only.":
+			return errors.New("unsupported action")
+		}
+	}
+	r.data = append(r.data, rr)
+	return nil
+}
+
+func (z *rpzZone) newRule() *rpzRule {
+	z.rules++
+	return &rpzRule{zone: strings.TrimSuffix(z.name, ".")}
+}
+
+// parseRPZIP parses the reversed prefix like 24.0.2.0.192 or
+// 128.1.zz.db8.2001.
+func parseRPZIP(s string) (netip.Prefix, error) {
+	labels := strings.Split(s, ".")
+	bits, err := strconv.Atoi(labels[0])
+	if err != nil || len(labels) < 2 {
+		return netip.Prefix{}, errors.New("invalid rpz-ip")
+	}
+	labels = labels[1:]
+	slices.Reverse(labels)
+
+	var addr string
+	if len(labels) == 4 && !slices.Contains(labels, "zz") {
+		addr = strings.Join(labels, ".")
+	} else {
+		for i, l := range labels {
+			if l == "zz" {
+				labels[i] = ""
+				if i == 0 || i == len(labels)-1 {
+					labels[i] = ":"
+				}
+			}
+		}
+		addr = strings.Join(labels, ":")
+	}
+
+	ip, err := netip.ParseAddr(addr)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	p, err := ip.Prefix(bits)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return p, nil
+}
@@ -0,0 +1,116 @@
+package zns
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+const testRPZ = `$ORIGIN rpz.test.
+$TTL 60
+@ SOA localhost. root.localhost. 1 3600 600 86400 60
+  NS localhost.
+nx.example CNAME .
+*.nx.example CNAME .
+nodata.example CNAME *.
+pass.example CNAME rpz-passthru.
+drop.example CNAME rpz-drop.
+local.example A 10.0.0.1
+local.example AAAA fd00::1
+rewrite.example CNAME example.com.
+32.4.3.2.1.rpz-ip CNAME .
+ns.bad.rpz-nsdname CNAME .
+32.1.0.0.127.rpz-client-ip CNAME .
+`
+
+func TestParseRPZIP(t *testing.T) {
+	for s, p := range map[string]string{
+		"32.4.3.2.1":          "1.2.3.4/32",
+		"24.0.2.0.192":        "192.0.2.0/24",
+		"128.1.zz.db8.2001":   "2001:db8::1/128",
+		"48.zz.db8.2001":      "2001:db8::/48",
+		"128.1.zz":            "::1/128",
+		"64.zz.1.2.3.4.5.6.7": "7:6:5:4::/64",
+	} {
+		v, err := parseRPZIP(s)
+		assert.Nil(t, err, s)
+		assert.Equal(t, netip.MustParsePrefix(p), v, s)
+	}
+
+	_, err := parseRPZIP("33.4.3.2.1")
+	assert.NotNil(t, err)
+}
+
+func TestRPZ(t *testing.T) {
+	up, stop := testUpstream(t)
+	defer stop()
+
+	file := filepath.Join(t.TempDir(), "rpz.zone")
+	os.WriteFile(file, []byte(testRPZ), 0644)
+
+	p, err := NewRPZ([]string{file})
+	assert.Nil(t, err)
+	st := p.Stats()[0]
+	assert.Equal(t, "rpz.test.", st.Name)
+	assert.Equal(t, 9, st.Rules)
+	assert.Equal(t, 1, len(st.Errors))
+
+	h := &Handler{Upstream: up, Repo: FreeTicketRepo{}, RPZ: p}
+
+	query := func(name string, qtype uint16) (int, *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetQuestion(name, qtype)
+		b, _ := m.Pack()
+		req := httptest.NewRequest(http.MethodGet, "/dns/foo?dns="+base64.RawURLEncoding.EncodeToString(b), nil)
+		req.SetPathValue("token", "foo")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			return w.Code, nil
+		}
+		assert.Nil(t, m.Unpack(w.Body.Bytes()))
+		return w.Code, m
+	}
+
+	_, a := query("nx.example.", dns.TypeA)
+	assert.Equal(t, dns.RcodeNameError, a.Rcode)
+	assert.Equal(t, "rpz rpz.test", edes(a)[0].ExtraText)
+
+	_, a = query("www.nx.example.", dns.TypeA)
+	assert.Equal(t, dns.RcodeNameError, a.Rcode)
+
+	_, a = query("nodata.example.", dns.TypeA)
+	assert.Equal(t, dns.RcodeSuccess, a.Rcode)
+	assert.Equal(t, 0, len(a.Answer))
+
+	code, _ := query("drop.example.", dns.TypeA)
+	assert.Equal(t, statusDropped, code)
+
+	_, a = query("local.example.", dns.TypeAAAA)
+	assert.Equal(t, "fd00::1", a.Answer[0].(*dns.AAAA).AAAA.String())
+	assert.Equal(t, dns.ExtendedErrorCodeForgedAnswer, edes(a)[0].InfoCode)
+
+	_, a = query("rewrite.example.", dns.TypeA)
+	assert.Equal(t, 2, len(a.Answer))
+	assert.Equal(t, "example.com.", a.Answer[0].(*dns.CNAME).Target)
+	assert.Equal(t, "1.2.3.4", a.Answer[1].(*dns.A).A.String())
+
+	// the upstream answers 1.2.3.4 which is blocked by rpz-ip
+	_, a = query("other.example.", dns.TypeA)
+	assert.Equal(t, dns.RcodeNameError, a.Rcode)
+
+	_, a = query("pass.example.", dns.TypeA)
+	assert.Equal(t, dns.RcodeSuccess, a.Rcode)
+	assert.Equal(t, "1.2.3.4", a.Answer[0].(*dns.A).A.String())
+
+	ns := new(dns.Msg)
+	ns.Ns = []dns.RR{rr("example.org. 300 IN NS ns.bad.")}
+	assert.NotNil(t, p.Answer(ns))
+}
@@ -0,0 +1,77 @@
+package zns
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// safeSearchTTL is the TTL of the synthesized CNAME records.
+const safeSearchTTL = 300
+
+// safeSearchHosts maps search engines to their safe search hosts.
+var safeSearchHosts = map[string]string{
+	"www.bing.com.": "strict.bing.com.",
+	"bing.com.":     "strict.bing.com.",
+
+	"duckduckgo.com.":       "safe.duckduckgo.com.",
+	"www.duckduckgo.com.":   "safe.duckduckgo.com.",
+	"start.duckduckgo.com.": "safe.duckduckgo.com.",
+
+	"www.youtube.com.":          "restrict.youtube.com.",
+	"m.youtube.com.":            "restrict.youtube.com.",
+	"youtubei.googleapis.com.":  "restrict.youtube.com.",
+	"youtube.googleapis.com.":   "restrict.youtube.com.",
+	"www.youtube-nocookie.com.": "restrict.youtube.com.",
+}
+
+// googleTLDs are the domains of Google search, see https://www.google.com/supported_domains
+var googleTLDs = []string{
+	"com", "ad", "ae", "com.af", "com.ag", "al", "am", "co.ao", "com.ar",
+	"as", "at", "com.au", "az", "ba", "com.bd", "be", "bf", "bg", "com.bh",
+	"bi", "bj", "com.bn", "com.bo", "com.br", "bs", "bt", "co.bw", "by",
+	"com.bz", "ca", "cd", "cf", "cg", "ch", "ci", "co.ck", "cl", "cm", "cn",
+	"com.co", "co.cr", "com.cu", "cv", "com.cy", "cz", "de", "dj", "dk",
+	"dm", "com.do", "dz", "com.ec", "ee", "com.eg", "es", "com.et", "fi",
+	"com.fj", "fm", "fr", "ga", "ge", "gg", "com.gh", "com.gi", "gl", "gm",
+	"gr", "com.gt", "gy", "com.hk", "hn", "hr", "ht", "hu", "co.id", "ie",
+	"co.il", "im", "co.in", "iq", "is", "it", "je", "com.jm", "jo", "co.jp",
+	"co.ke", "com.kh", "ki", "kg", "co.kr", "com.kw", "kz", "la", "com.lb",
+	"li", "lk", "co.ls", "lt", "lu", "lv", "com.ly", "co.ma", "md", "me",
+	"mg", "mk", "ml", "com.mm", "mn", "com.mt", "mu", "mv", "mw", "com.mx",
+	"com.my", "co.mz", "com.na", "com.ng", "com.ni", "ne", "nl", "no",
+	"com.np", "nr", "nu", "co.nz", "com.om", "com.pa", "com.pe", "com.pg",
+	"com.ph", "com.pk", "pl", "pn", "com.pr", "ps", "pt", "com.py", "com.qa",
+	"ro", "ru", "rw", "com.sa", "com.sb", "sc", "se", "com.sg", "sh", "si",
+	"sk", "com.sl", "sn", "so", "sm", "sr", "st", "com.sv", "td", "tg",
+	"co.th", "com.tj", "tl", "tm", "tn", "to", "com.tr", "tt", "com.tw",
+	"co.tz", "com.ua", "co.ug", "co.uk", "com.uy", "co.uz", "com.vc",
+	"co.ve", "co.vi", "com.vn", "vu", "ws", "rs", "co.za", "co.zm", "co.zw",
+	"cat",
+}
+
+func init() {
+	for _, tld := range googleTLDs {
+		safeSearchHosts["google."+tld+"."] = "forcesafesearch.google.com."
+		safeSearchHosts["www.google."+tld+"."] = "forcesafesearch.google.com."
+	}
+}
+
+// safeSearchReply builds the CNAME answer to the safe search host of the
+// queried name, nil if it is not a search engine.
+func safeSearchReply(m *dns.Msg) *dns.Msg {
+	q := m.Question[0]
+	target, ok := safeSearchHosts[strings.ToLower(q.Name)]
+	if !ok {
+		return nil
+	}
+
+	a := new(dns.Msg)
+	a.SetReply(m)
+	a.RecursionAvailable = true
+	a.Answer = []dns.RR{&dns.CNAME{
+		Hdr:    dns.RR_Header{Name: q.Name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: safeSearchTTL},
+		Target: target,
+	}}
+	return a
+}
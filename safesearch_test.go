@@ -0,0 +1,52 @@
+package zns
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSafeSearch(t *testing.T) {
+	up, stop := testUpstream(t)
+	defer stop()
+
+	repo := NewTicketRepo(":memory:")
+	repo.New("foo", 1000, "buy-1", "pay-1")
+	repo.New("bar", 1000, "buy-2", "pay-2")
+	fr := repo.(FilterRepo)
+	fr.SetFilter(Filter{Token: "foo", SafeSearch: true})
+
+	h := &Handler{Upstream: up, Repo: repo, Filters: &Filters{Repo: fr, Tickets: repo}}
+
+	query := func(token, name, param string) *dns.Msg {
+		m := new(dns.Msg)
+		m.SetQuestion(name, dns.TypeA)
+		b, _ := m.Pack()
+		req := httptest.NewRequest(http.MethodGet, "/dns/"+token+"?dns="+base64.RawURLEncoding.EncodeToString(b)+param, nil)
+		req.SetPathValue("token", token)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Nil(t, m.Unpack(w.Body.Bytes()))
+		return m
+	}
+
+	a := query("foo", "www.Google.co.uk.", "")
+	assert.Equal(t, 2, len(a.Answer))
+	assert.Equal(t, "forcesafesearch.google.com.", a.Answer[0].(*dns.CNAME).Target)
+	assert.Equal(t, "1.2.3.4", a.Answer[1].(*dns.A).A.String())
+
+	a = query("bar", "www.bing.com.", "")
+	assert.Equal(t, 1, len(a.Answer))
+	assert.Equal(t, dns.TypeA, a.Answer[0].Header().Rrtype)
+
+	a = query("bar", "www.bing.com.", "&safesearch=1")
+	assert.Equal(t, "strict.bing.com.", a.Answer[0].(*dns.CNAME).Target)
+
+	a = query("foo", "example.com.", "")
+	assert.Equal(t, dns.TypeA, a.Answer[0].Header().Rrtype)
+}
@@ -0,0 +1,116 @@
+package zns
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ListStat is the loading result of one source.
+type ListStat struct {
+	Name   string   `json:"name"`
+	Source string   `json:"source"`
+	Rules  int      `json:"rules"`
+	Errors []string `json:"errors,omitempty"`
+	// Err is the error of the last load, and the source keeps the rules
+	// loaded before.
+	Err     string    `json:"err,omitempty"`
+	Updated time.Time `json:"updated"`
+}
+
+// maxParseErrors limits parse errors kept for each source.
+const maxParseErrors = 10
+
+// sourceSet keeps the rules of type T loaded from each source, which are
+// reloaded together. A source failed to load keeps its previous rules, and
+// the error is reported in Stats.
+type sourceSet[T any] struct {
+	mu     sync.Mutex
+	loaded map[string]loadedSource[T]
+	stats  []ListStat
+}
+
+type loadedSource[T any] struct {
+	rules   T
+	updated time.Time
+}
+
+// Stats returns the loading result of each source.
+func (s *sourceSet[T]) Stats() []ListStat {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.stats)
+}
+
+// reload loads the sources with load, and passes the rules and the stats of
+// all sources in order to apply, which may fill in the stats. Sources may be
+// named like ads=https://example.org/ads.txt if named is true.
+func (s *sourceSet[T]) reload(sources []string, named bool, load func(src string) (T, []string, error), apply func(rules []T, stats []ListStat) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.loaded == nil {
+		s.loaded = map[string]loadedSource[T]{}
+	}
+
+	var errs []error
+	rules := make([]T, 0, len(sources))
+	stats := make([]ListStat, 0, len(sources))
+	for _, src := range sources {
+		name := src
+		if named {
+			name, src = listName(src)
+		}
+		st := ListStat{Name: name, Source: src, Updated: time.Now()}
+		r, perrs, err := load(src)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", src, err))
+			st.Err = err.Error()
+			prev := s.loaded[name]
+			if !prev.updated.IsZero() {
+				st.Updated = prev.updated
+			}
+			r = prev.rules
+		} else {
+			s.loaded[name] = loadedSource[T]{rules: r, updated: st.Updated}
+		}
+		st.Errors = perrs
+		rules = append(rules, r)
+		stats = append(stats, st)
+	}
+
+	if err := apply(rules, stats); err != nil {
+		errs = append(errs, err)
+	}
+	s.stats = stats
+	return errors.Join(errs...)
+}
+
+// listName splits ads=/path/to/ads.txt into name and source.
+func listName(s string) (name, src string) {
+	if n, src, ok := strings.Cut(s, "="); ok && !strings.ContainsAny(n, ":/") {
+		return n, src
+	}
+	return s, s
+}
+
+// watch calls reload every d until stop is closed. It returns immediately
+// if d is not positive.
+func watch(d time.Duration, stop <-chan struct{}, reload func() error) {
+	if d <= 0 {
+		return
+	}
+	t := time.NewTicker(d)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			reload()
+		case <-stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package zns
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSourceSet(t *testing.T) {
+	var s sourceSet[int]
+	results := map[string]int{"a": 1, "b": 2}
+	load := func(src string) (int, []string, error) {
+		n, ok := results[src]
+		if !ok {
+			return 0, nil, errors.New("gone")
+		}
+		return n, []string{"line 1: bad"}, nil
+	}
+	var got []int
+	apply := func(rules []int, stats []ListStat) error {
+		got = rules
+		for i := range stats {
+			stats[i].Rules = rules[i]
+		}
+		return nil
+	}
+
+	assert.Nil(t, s.reload([]string{"x=a", "b"}, true, load, apply))
+	assert.Equal(t, []int{1, 2}, got)
+	stats := s.Stats()
+	assert.Equal(t, "x", stats[0].Name)
+	assert.Equal(t, "a", stats[0].Source)
+	assert.Equal(t, []string{"line 1: bad"}, stats[1].Errors)
+
+	// 加载失败的源保留之前的规则和更新时间
+	delete(results, "a")
+	assert.NotNil(t, s.reload([]string{"x=a", "b", "c"}, true, load, apply))
+	assert.Equal(t, []int{1, 2, 0}, got)
+	next := s.Stats()
+	assert.Equal(t, "gone", next[0].Err)
+	assert.Equal(t, stats[0].Updated, next[0].Updated)
+	assert.Equal(t, 1, next[0].Rules)
+	assert.Equal(t, "", next[1].Err)
+
+	// 重新加载间隔为 0 时不启动定时器
+	watch(0, nil, func() error { panic("reloaded") })
+}
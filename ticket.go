@@ -88,9 +88,25 @@ func (r sqliteTicketReop) Init() {
 	if _, err := r.db.Exec((*Ticket).Schema(nil)); err != nil {
 		panic(err)
 	}
+	if _, err := r.db.Exec((*filterRow).Schema(nil)); err != nil {
+		panic(err)
+	}
+	// 旧版本的 filters 表没有 safe_search、dns64、ecs 和 no_log 字段，重复添加会报错，忽略即可
+	r.db.Exec("alter table " + (*filterRow).TableName(nil) + " add column safe_search INTEGER DEFAULT 0")
+	r.db.Exec("alter table " + (*filterRow).TableName(nil) + " add column dns64 INTEGER DEFAULT 0")
+	r.db.Exec("alter table " + (*filterRow).TableName(nil) + " add column ecs TEXT DEFAULT ''")
+	r.db.Exec("alter table " + (*filterRow).TableName(nil) + " add column no_log INTEGER DEFAULT 0")
+	if _, err := r.db.Exec((*QueryLog).Schema(nil)); err != nil {
+		panic(err)
+	}
+	if _, err := r.db.Exec((*Usage).Schema(nil)); err != nil {
+		panic(err)
+	}
 }
 
 func (r sqliteTicketReop) New(token string, bytes int, trade, order string) error {
+	defer observeSQL("new", time.Now())
+
 	now := time.Now()
 
 	ts, err := r.List(token, 1)
@@ -131,6 +147,8 @@ func (r sqliteTicketReop) New(token string, bytes int, trade, order string) erro
 }
 
 func (r sqliteTicketReop) Cost(token string, bytes int) error {
+	defer observeSQL("cost", time.Now())
+
 	now := time.Now()
 
 	sql := "update " + (*Ticket).TableName(nil) +
@@ -208,6 +226,7 @@ func (r sqliteTicketReop) costSlow(token string, bytes int) error {
 }
 
 func (r sqliteTicketReop) List(token string, limit int) (tickets []Ticket, err error) {
+	defer observeSQL("list", time.Now())
 	sql := "select * from " + (*Ticket).TableName(nil) +
 		" where token = ? order by id desc limit ?"
 	err = r.db.Select(&tickets, sql, token, limit)
@@ -292,6 +311,7 @@ func (h *TicketHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	} else {
 		o, err := h.Pay.OnPay(r)
 		if err != nil {
+			payNotifications.WithLabelValues("invalid").Inc()
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
@@ -301,6 +321,7 @@ func (h *TicketHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 		yuan, err := strconv.ParseFloat(o.Amount, 64)
 		if err != nil {
+			payNotifications.WithLabelValues("invalid").Inc()
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
@@ -309,10 +330,12 @@ func (h *TicketHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 		err = h.Repo.New(token, bytes, o.OrderNo, o.TradeNo)
 		if err != nil {
+			payNotifications.WithLabelValues("error").Inc()
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
+		payNotifications.WithLabelValues("success").Inc()
 		w.Write([]byte("success"))
 	}
 }
@@ -47,17 +47,27 @@ func (p *Handler) ServeDoT(conn *tls.Conn) {
 			return
 		}
 
-		url := "https://" + domain + ":853/dns-query"
+		url := "https://" + domain + ":853/dns-query" + p.listenerQuery("dot")
 		req, err := http.NewRequest("POST", url, io.NopCloser(bytes.NewReader(queryBuf)))
 		if err != nil {
 			return
 		}
 
 		req.RemoteAddr = conn.RemoteAddr().String()
+		req = withTransport(req, TransportDoT)
 
+		w.code = 0
 		p.ServeHTTP(w, req)
 
-		if w.code != http.StatusOK && w.code != 0 {
+		// 丢弃的查询不应答，同一连接上的其他查询继续处理
+		if w.code == statusDropped {
+			continue
+		}
+		if w.code == http.StatusTooManyRequests {
+			if w.body, err = refused(queryBuf); err != nil {
+				return
+			}
+		} else if w.code != http.StatusOK && w.code != 0 {
 			log.Println("dot query error", string(w.body))
 			return
 		}
@@ -0,0 +1,58 @@
+package zns
+
+import (
+	"crypto/tls"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// testDropRPZ returns the RPZ dropping drop.example.
+func testDropRPZ(t *testing.T) *RPZ {
+	file := filepath.Join(t.TempDir(), "rpz.zone")
+	os.WriteFile(file, []byte("$ORIGIN rpz.test.\n$TTL 60\n@ SOA localhost. root.localhost. 1 3600 600 86400 60\ndrop.example CNAME rpz-drop.\n"), 0644)
+	p, err := NewRPZ([]string{file})
+	assert.Nil(t, err)
+	return p
+}
+
+func TestServeDoTDropped(t *testing.T) {
+	up, stop := testUpstream(t)
+	defer stop()
+
+	h := &Handler{Upstream: up, Repo: FreeTicketRepo{}, RPZ: testDropRPZ(t)}
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", testTLSConfig(t))
+	assert.Nil(t, err)
+	defer ln.Close()
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		h.ServeDoT(c.(*tls.Conn))
+	}()
+
+	c, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{ServerName: "foo.zns.test", InsecureSkipVerify: true})
+	assert.Nil(t, err)
+	defer c.Close()
+
+	// 被丢弃的查询不能关闭连接
+	for i, name := range []string{"drop.example.", "example.com."} {
+		m := new(dns.Msg)
+		m.SetQuestion(name, dns.TypeA)
+		m.Id = uint16(i + 1)
+		b, _ := m.Pack()
+		assert.Nil(t, writeStreamMsg(c, b))
+	}
+
+	b, err := readStreamMsg(c)
+	assert.Nil(t, err)
+	a := new(dns.Msg)
+	assert.Nil(t, a.Unpack(b))
+	assert.Equal(t, uint16(2), a.Id)
+	assert.Equal(t, "1.2.3.4", a.Answer[0].(*dns.A).A.String())
+}
@@ -0,0 +1,229 @@
+package zns
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"log"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	StrategyFailover   = "failover"
+	StrategyRoundRobin = "roundrobin"
+	StrategyLatency    = "latency"
+	StrategyRace       = "race"
+)
+
+const (
+	// 连续失败多少次后熔断
+	breakerFails = 3
+	// 熔断后多久允许重试
+	breakerCooldown = 30 * time.Second
+)
+
+// Upstreams forwards queries to a list of upstream servers.
+type Upstreams struct {
+	Strategy string
+
+	list []*upstream
+	next atomic.Uint32
+}
+
+type upstream struct {
+	url string
+	ex  Exchanger
+
+	mu    sync.Mutex
+	fails int
+	// 熔断截止时间，零值表示正常
+	openUntil time.Time
+	// 指数加权平均耗时
+	rtt time.Duration
+}
+
+// NewUpstreams creates Upstreams with server urls, see NewExchanger.
+func NewUpstreams(urls []string, strategy string) (*Upstreams, error) {
+	switch strategy {
+	case "":
+		strategy = StrategyFailover
+	case StrategyFailover, StrategyRoundRobin, StrategyLatency, StrategyRace:
+	default:
+		return nil, errors.New("invalid upstream strategy: " + strategy)
+	}
+
+	u := &Upstreams{Strategy: strategy}
+	for _, s := range urls {
+		if s == "" {
+			continue
+		}
+		ex, err := NewExchanger(s)
+		if err != nil {
+			return nil, err
+		}
+		u.list = append(u.list, &upstream{url: s, ex: ex})
+	}
+	if len(u.list) == 0 {
+		return nil, errors.New("no upstream")
+	}
+	return u, nil
+}
+
+// Exchange sends the packed query to upstreams according to the strategy.
+func (u *Upstreams) Exchange(question []byte) ([]byte, error) {
+	answer, _, err := u.ExchangeFrom(question)
+	return answer, err
+}
+
+// ExchangeFrom is like Exchange, and returns the url of the upstream
+// answered.
+func (u *Upstreams) ExchangeFrom(question []byte) ([]byte, string, error) {
+	ups := u.pick()
+
+	if u.Strategy == StrategyRace && len(ups) > 1 {
+		if answer, url, err := u.race(ups[:2], question); err == nil {
+			return answer, url, nil
+		}
+		ups = ups[2:]
+	}
+
+	var err error
+	for _, up := range ups {
+		var answer []byte
+		answer, err = up.exchange(context.Background(), question)
+		if err == nil {
+			return answer, up.url, nil
+		}
+		log.Println("upstream error", up.url, err)
+	}
+	return nil, "", err
+}
+
+// pick orders upstreams by strategy, healthy ones first.
+func (u *Upstreams) pick() []*upstream {
+	ups := slices.Clone(u.list)
+
+	switch u.Strategy {
+	case StrategyRoundRobin:
+		i := int(u.next.Add(1)-1) % len(ups)
+		ups = append(ups[i:], ups[:i]...)
+	case StrategyLatency, StrategyRace:
+		slices.SortStableFunc(ups, func(a, b *upstream) int {
+			return cmp.Compare(a.latency(), b.latency())
+		})
+	}
+
+	now := time.Now()
+	slices.SortStableFunc(ups, func(a, b *upstream) int {
+		x, y := a.available(now), b.available(now)
+		switch {
+		case x == y:
+			return 0
+		case x:
+			return -1
+		default:
+			return 1
+		}
+	})
+	return ups
+}
+
+func (u *Upstreams) race(ups []*upstream, question []byte) ([]byte, string, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	type result struct {
+		answer []byte
+		url    string
+		err    error
+	}
+	c := make(chan result, len(ups))
+	for _, up := range ups {
+		go func() {
+			answer, err := up.exchange(ctx, question)
+			c <- result{answer, up.url, err}
+		}()
+	}
+
+	var err error
+	for range ups {
+		r := <-c
+		if r.err == nil {
+			return r.answer, r.url, nil
+		}
+		err = r.err
+	}
+	return nil, "", err
+}
+
+// Probe sends a root NS query to every upstream periodically, which closes
+// the breaker of recovered upstreams.
+func (u *Upstreams) Probe(d time.Duration) {
+	m := new(dns.Msg)
+	m.SetQuestion(".", dns.TypeNS)
+	question, err := m.Pack()
+	if err != nil {
+		panic(err)
+	}
+
+	for range time.Tick(d) {
+		for _, up := range u.list {
+			go up.exchange(context.Background(), question)
+		}
+	}
+}
+
+func (up *upstream) exchange(ctx context.Context, question []byte) ([]byte, error) {
+	start := time.Now()
+	answer, err := up.ex.Exchange(ctx, question)
+	if errors.Is(err, context.Canceled) {
+		return nil, err
+	}
+	rtt := time.Since(start)
+	up.done(rtt, err)
+	if err != nil {
+		upstreamErrors.WithLabelValues(up.url).Inc()
+	} else {
+		upstreamDuration.WithLabelValues(up.url).Observe(rtt.Seconds())
+	}
+	return answer, err
+}
+
+func (up *upstream) done(rtt time.Duration, err error) {
+	up.mu.Lock()
+	defer up.mu.Unlock()
+
+	if err != nil {
+		up.fails++
+		if up.fails >= breakerFails {
+			up.openUntil = time.Now().Add(breakerCooldown)
+		}
+		return
+	}
+
+	up.fails = 0
+	up.openUntil = time.Time{}
+	if up.rtt == 0 {
+		up.rtt = rtt
+	} else {
+		up.rtt = (up.rtt*7 + rtt) / 8
+	}
+}
+
+// available reports whether the breaker is closed or the cooldown has passed.
+func (up *upstream) available(now time.Time) bool {
+	up.mu.Lock()
+	defer up.mu.Unlock()
+	return now.After(up.openUntil)
+}
+
+func (up *upstream) latency() time.Duration {
+	up.mu.Lock()
+	defer up.mu.Unlock()
+	return up.rtt
+}
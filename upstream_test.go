@@ -0,0 +1,81 @@
+package zns
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestDoH(answer string, code int) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.ReadAll(r.Body)
+		w.WriteHeader(code)
+		w.Write([]byte(answer))
+	}))
+}
+
+func TestUpstreamsFailover(t *testing.T) {
+	bad := newTestDoH("", http.StatusBadGateway)
+	defer bad.Close()
+	good := newTestDoH("good", http.StatusOK)
+	defer good.Close()
+
+	u, err := NewUpstreams([]string{bad.URL, good.URL}, StrategyFailover)
+	assert.Nil(t, err)
+
+	for range breakerFails {
+		answer, err := u.Exchange([]byte("q"))
+		assert.Nil(t, err)
+		assert.Equal(t, "good", string(answer))
+	}
+
+	// bad upstream is broken and moved to the end
+	ups := u.pick()
+	assert.Equal(t, good.URL, ups[0].url)
+
+	ups[1].openUntil = time.Now().Add(-time.Second)
+	ups = u.pick()
+	assert.Equal(t, bad.URL, ups[0].url)
+}
+
+func TestUpstreamsRoundRobin(t *testing.T) {
+	a := newTestDoH("a", http.StatusOK)
+	defer a.Close()
+	b := newTestDoH("b", http.StatusOK)
+	defer b.Close()
+
+	u, err := NewUpstreams([]string{a.URL, b.URL}, StrategyRoundRobin)
+	assert.Nil(t, err)
+
+	var got []string
+	for range 4 {
+		answer, err := u.Exchange([]byte("q"))
+		assert.Nil(t, err)
+		got = append(got, string(answer))
+	}
+	assert.Equal(t, []string{"a", "b", "a", "b"}, got)
+}
+
+func TestUpstreamsRace(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(500 * time.Millisecond)
+		w.Write([]byte("slow"))
+	}))
+	defer slow.Close()
+	fast := newTestDoH("fast", http.StatusOK)
+	defer fast.Close()
+
+	u, err := NewUpstreams([]string{slow.URL, fast.URL}, StrategyRace)
+	assert.Nil(t, err)
+
+	answer, err := u.Exchange([]byte("q"))
+	assert.Nil(t, err)
+	assert.Equal(t, "fast", string(answer))
+
+	_, err = NewUpstreams([]string{fast.URL}, "random")
+	assert.NotNil(t, err)
+}
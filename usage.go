@@ -0,0 +1,421 @@
+package zns
+
+import (
+	"cmp"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Services of usage records.
+const (
+	ServiceDoH     = "doh"
+	ServiceDoT     = "dot"
+	ServiceDoQ     = "doq"
+	ServiceDNS     = "dns"
+	ServiceODoH    = "odoh"
+	ServiceConnect = "connect"
+	ServiceMasque  = "masque"
+)
+
+// Usage is the bytes billed and queries of one token and service since
+// Start. Queries of proxy services are the tunnels opened.
+type Usage struct {
+	ID      int       `db:"id" json:"-"`
+	Token   string    `db:"token" json:"-"`
+	Service string    `db:"service" json:"-"`
+	Start   time.Time `db:"start" json:"time"`
+	// Span in seconds, one hour or one day for rolled up rows
+	Span    int `db:"span" json:"-"`
+	Bytes   int `db:"bytes" json:"bytes"`
+	Queries int `db:"queries" json:"queries"`
+}
+
+func (_ *Usage) KeyName() string   { return "id" }
+func (_ *Usage) TableName() string { return "usages" }
+func (u *Usage) Schema() string {
+	return "CREATE TABLE IF NOT EXISTS " + u.TableName() + `(
+	` + u.KeyName() + ` INTEGER PRIMARY KEY AUTOINCREMENT,
+	token TEXT,
+	service TEXT,
+	start DATETIME,
+	span INTEGER,
+	bytes INTEGER,
+	queries INTEGER
+);
+	CREATE UNIQUE INDEX IF NOT EXISTS u_token_service_start ON ` + u.TableName() + `(token, service, start, span);
+	CREATE INDEX IF NOT EXISTS u_start ON ` + u.TableName() + `(start);`
+}
+
+const (
+	usageHour = 3600
+	usageDay  = 24 * usageHour
+)
+
+type UsageRepo interface {
+	// AddUsage adds the bytes and queries of us to the saved rows.
+	AddUsage(us []Usage) error
+	// ListUsage fetches the rows of token starting in [from, to).
+	ListUsage(token string, from, to time.Time) ([]Usage, error)
+	// RollupUsage merges hourly rows before into daily ones, and deletes
+	// rows before expire.
+	RollupUsage(before, expire time.Time) error
+}
+
+func (r sqliteTicketReop) AddUsage(us []Usage) error {
+	defer observeSQL("add_usage", time.Now())
+
+	tx, err := r.db.Beginx()
+	if err != nil {
+		return err
+	}
+	if err = addUsage(tx.Exec, us); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// addUsage upserts us with exec. 时间统一按 UTC 保存，保证字符串比较的结果和
+// 时间先后一致。
+func addUsage(exec func(string, ...any) (sql.Result, error), us []Usage) error {
+	q := "insert into " + (*Usage).TableName(nil) +
+		"(token, service, start, span, bytes, queries) values (?, ?, ?, ?, ?, ?)" +
+		" on conflict (token, service, start, span) do update set" +
+		" bytes = bytes + excluded.bytes, queries = queries + excluded.queries"
+	for _, u := range us {
+		if _, err := exec(q, u.Token, u.Service, u.Start.UTC(), u.Span, u.Bytes, u.Queries); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r sqliteTicketReop) ListUsage(token string, from, to time.Time) (us []Usage, err error) {
+	defer observeSQL("list_usage", time.Now())
+	q := "select * from " + (*Usage).TableName(nil) +
+		" where token = ? and start >= ? and start < ? order by start asc"
+	err = r.db.Select(&us, q, token, from.UTC().Truncate(time.Second), to.UTC().Truncate(time.Second))
+	return
+}
+
+func (r sqliteTicketReop) RollupUsage(before, expire time.Time) error {
+	defer observeSQL("rollup_usage", time.Now())
+
+	before, expire = before.UTC().Truncate(time.Second), expire.UTC().Truncate(time.Second)
+	table := (*Usage).TableName(nil)
+
+	tx, err := r.db.Beginx()
+	if err != nil {
+		return err
+	}
+	err = func() error {
+		if _, err := tx.Exec("delete from "+table+" where start < ?", expire); err != nil {
+			return err
+		}
+		var hours []Usage
+		q := "select * from " + table + " where span = ? and start < ?"
+		if err := tx.Select(&hours, q, usageHour, before); err != nil {
+			return err
+		}
+		if len(hours) == 0 {
+			return nil
+		}
+		if _, err := tx.Exec("delete from "+table+" where span = ? and start < ?", usageHour, before); err != nil {
+			return err
+		}
+		return addUsage(tx.Exec, rollup(hours, usageDay))
+	}()
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// usageStart returns the start of the span containing t. Days start at
+// midnight of the local time zone.
+func usageStart(t time.Time, span int) time.Time {
+	if span >= usageDay {
+		y, m, d := t.In(time.Local).Date()
+		return time.Date(y, m, d, 0, 0, 0, 0, time.Local)
+	}
+	return t.Truncate(time.Duration(span) * time.Second)
+}
+
+// rollup merges us into rows of span, which are ordered by start.
+func rollup(us []Usage, span int) []Usage {
+	type key struct {
+		token, service string
+		start          int64
+	}
+	idx := map[key]int{}
+	var rs []Usage
+	for _, u := range us {
+		start := usageStart(u.Start, span)
+		k := key{u.Token, u.Service, start.Unix()}
+		i, ok := idx[k]
+		if !ok {
+			i = len(rs)
+			idx[k] = i
+			rs = append(rs, Usage{Token: u.Token, Service: u.Service, Start: start, Span: span})
+		}
+		rs[i].Bytes += u.Bytes
+		rs[i].Queries += u.Queries
+	}
+	slices.SortStableFunc(rs, func(a, b Usage) int {
+		return a.Start.Compare(b.Start)
+	})
+	return rs
+}
+
+const (
+	// usageFlush is the interval of saving usage.
+	usageFlush = 1 * time.Minute
+	// usageRollup is the interval of rolling up and expiring usage.
+	usageRollup = 1 * time.Hour
+	// maxUsagePoints is the max number of spans queried at once.
+	maxUsagePoints = 2000
+)
+
+// UsageRecorder counts the usage of tokens per hour and saves it
+// periodically, and serves the API to query it.
+//
+//	GET /ticket/{token}/usage?from=2025-01-01&to=2025-02-01&granularity=day
+//
+// from and to are RFC 3339 times, dates or Unix seconds, the last day by
+// default. granularity is hour or day. Rolled up rows are counted at the
+// start of their day even if the granularity is hour.
+type UsageRecorder struct {
+	Repo    UsageRepo
+	Tickets TicketRepo
+	AltSvc  string
+
+	// RollupAfter is the age of hourly rows merged into daily ones, zero
+	// to keep them.
+	RollupAfter time.Duration
+	// Retention is the age of rows deleted, zero to keep them.
+	Retention time.Duration
+
+	mu      sync.Mutex
+	pending map[usageKey]*Usage
+
+	stop chan struct{}
+	done chan struct{}
+	once sync.Once
+}
+
+type usageKey struct {
+	token, service string
+	start          int64
+}
+
+// NewUsageRecorder creates UsageRecorder and starts saving.
+func NewUsageRecorder(repo UsageRepo, tickets TicketRepo) *UsageRecorder {
+	u := &UsageRecorder{
+		Repo:    repo,
+		Tickets: tickets,
+		pending: map[usageKey]*Usage{},
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go u.run()
+	return u
+}
+
+// Add counts bytes and queries of token using service in the current hour.
+func (u *UsageRecorder) Add(token, service string, bytes, queries int) {
+	start := usageStart(time.Now(), usageHour)
+	k := usageKey{token, service, start.Unix()}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	p := u.pending[k]
+	if p == nil {
+		p = &Usage{Token: token, Service: service, Start: start, Span: usageHour}
+		u.pending[k] = p
+	}
+	p.Bytes += bytes
+	p.Queries += queries
+}
+
+// Flush saves the usage counted.
+func (u *UsageRecorder) Flush() error {
+	u.mu.Lock()
+	pending := u.pending
+	u.pending = map[usageKey]*Usage{}
+	u.mu.Unlock()
+
+	if len(pending) == 0 {
+		return nil
+	}
+	us := make([]Usage, 0, len(pending))
+	for _, p := range pending {
+		us = append(us, *p)
+	}
+	return u.Repo.AddUsage(us)
+}
+
+// Close saves the usage counted and stops.
+func (u *UsageRecorder) Close() {
+	u.once.Do(func() { close(u.stop) })
+	<-u.done
+}
+
+func (u *UsageRecorder) run() {
+	defer close(u.done)
+
+	flush := time.NewTicker(usageFlush)
+	defer flush.Stop()
+	roll := time.NewTicker(usageRollup)
+	defer roll.Stop()
+
+	for {
+		select {
+		case <-flush.C:
+			if err := u.Flush(); err != nil {
+				log.Println("Failed to save usage", err)
+			}
+		case <-roll.C:
+			if err := u.rollup(time.Now()); err != nil {
+				log.Println("Failed to roll up usage", err)
+			}
+		case <-u.stop:
+			if err := u.Flush(); err != nil {
+				log.Println("Failed to save usage", err)
+			}
+			return
+		}
+	}
+}
+
+func (u *UsageRecorder) rollup(now time.Time) error {
+	var before, expire time.Time
+	if u.RollupAfter > 0 {
+		// 只合并完整的一天
+		before = usageStart(now.Add(-u.RollupAfter), usageDay)
+	}
+	if u.Retention > 0 {
+		expire = now.Add(-u.Retention)
+	}
+	if before.IsZero() && expire.IsZero() {
+		return nil
+	}
+	return u.Repo.RollupUsage(before, expire)
+}
+
+func (u *UsageRecorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if u.AltSvc != "" {
+		w.Header().Set("Alt-Svc", u.AltSvc)
+	}
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	token := r.PathValue("token")
+	ts, err := u.Tickets.List(token, 1)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if len(ts) == 0 {
+		http.Error(w, "invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	q := r.URL.Query()
+	span := usageHour
+	switch g := q.Get("granularity"); g {
+	case "", "hour":
+	case "day":
+		span = usageDay
+	default:
+		http.Error(w, "invalid granularity "+g, http.StatusBadRequest)
+		return
+	}
+
+	to, from := time.Now(), time.Time{}
+	if s := q.Get("to"); s != "" {
+		if to, err = parseUsageTime(s); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if s := q.Get("from"); s != "" {
+		if from, err = parseUsageTime(s); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	} else {
+		from = to.Add(-24 * time.Hour)
+	}
+	from = usageStart(from, span)
+	if !from.Before(to) {
+		http.Error(w, "from must be before to", http.StatusBadRequest)
+		return
+	}
+	if to.Sub(from) > maxUsagePoints*time.Duration(span)*time.Second {
+		http.Error(w, "time range too large", http.StatusBadRequest)
+		return
+	}
+
+	if err := u.Flush(); err != nil {
+		log.Println("Failed to save usage", err)
+	}
+	us, err := u.Repo.ListUsage(token, from, to)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	series := map[string][]Usage{}
+	for _, p := range rollup(us, span) {
+		series[p.Service] = append(series[p.Service], p)
+	}
+
+	w.Header().Add("content-type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		From        time.Time          `json:"from"`
+		To          time.Time          `json:"to"`
+		Granularity string             `json:"granularity"`
+		Series      map[string][]Usage `json:"series"`
+	}{
+		From:        from,
+		To:          to,
+		Granularity: cmp.Or(q.Get("granularity"), "hour"),
+		Series:      series,
+	})
+}
+
+// parseUsageTime parses RFC 3339 times, dates in the local time zone or
+// Unix seconds.
+func parseUsageTime(s string) (time.Time, error) {
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(n, 0), nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", s, time.Local); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// usageService returns the service of queries over transport.
+func usageService(transport string) string {
+	switch transport {
+	case TransportUDP, TransportTCP:
+		return ServiceDNS
+	case TransportDoT:
+		return ServiceDoT
+	case TransportDoQ:
+		return ServiceDoQ
+	default:
+		return ServiceDoH
+	}
+}
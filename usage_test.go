@@ -0,0 +1,129 @@
+package zns
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUsageRollup(t *testing.T) {
+	r := NewTicketRepo(":memory:").(UsageRepo)
+
+	day := time.Date(2025, 1, 1, 0, 0, 0, 0, time.Local)
+	err := r.AddUsage([]Usage{
+		{Token: "foo", Service: ServiceDoH, Start: day.Add(1 * time.Hour), Span: usageHour, Bytes: 10, Queries: 1},
+		{Token: "foo", Service: ServiceDoH, Start: day.Add(5 * time.Hour), Span: usageHour, Bytes: 20, Queries: 2},
+		{Token: "foo", Service: ServiceDoT, Start: day.Add(5 * time.Hour), Span: usageHour, Bytes: 5, Queries: 1},
+		{Token: "foo", Service: ServiceDoH, Start: day.Add(25 * time.Hour), Span: usageHour, Bytes: 7, Queries: 1},
+		{Token: "foo", Service: ServiceDoH, Start: day.Add(-48 * time.Hour), Span: usageDay, Bytes: 1, Queries: 1},
+	})
+	assert.Nil(t, err)
+	// 重复写入累加
+	err = r.AddUsage([]Usage{{Token: "foo", Service: ServiceDoH, Start: day.Add(1 * time.Hour), Span: usageHour, Bytes: 1, Queries: 1}})
+	assert.Nil(t, err)
+
+	assert.Nil(t, r.RollupUsage(day.Add(24*time.Hour), day.Add(-24*time.Hour)))
+
+	us, err := r.ListUsage("foo", day.Add(-72*time.Hour), day.Add(48*time.Hour))
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(us))
+
+	byKey := map[string]Usage{}
+	for _, u := range us {
+		byKey[u.Service+u.Start.Local().Format(time.DateTime)] = u
+	}
+	doh := byKey[ServiceDoH+day.Format(time.DateTime)]
+	assert.Equal(t, usageDay, doh.Span)
+	assert.Equal(t, 31, doh.Bytes)
+	assert.Equal(t, 4, doh.Queries)
+	dot := byKey[ServiceDoT+day.Format(time.DateTime)]
+	assert.Equal(t, usageDay, dot.Span)
+	assert.Equal(t, 5, dot.Bytes)
+	next := byKey[ServiceDoH+day.Add(25*time.Hour).Format(time.DateTime)]
+	assert.Equal(t, usageHour, next.Span)
+	assert.Equal(t, 7, next.Bytes)
+}
+
+func TestUsageRecorder(t *testing.T) {
+	up, stop := testUpstream(t)
+	defer stop()
+
+	repo := NewTicketRepo(":memory:")
+	assert.Nil(t, repo.New("foo", 1<<20, "t1", "o1"))
+
+	u := NewUsageRecorder(repo.(UsageRepo), repo)
+	defer u.Close()
+	h := &Handler{Upstream: up, Repo: repo, Usage: u}
+
+	m := new(dns.Msg)
+	m.SetQuestion("example.com.", dns.TypeA)
+	b, _ := m.Pack()
+	query := func(tr string) {
+		req := httptest.NewRequest(http.MethodGet, "/dns/foo?dns="+base64.RawURLEncoding.EncodeToString(b), nil)
+		req.SetPathValue("token", "foo")
+		if tr != "" {
+			req = withTransport(req, tr)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusOK, w.Code)
+	}
+	query("")
+	query(TransportDoT)
+	query(TransportDoT)
+
+	ts, _ := repo.List("foo", 1)
+	used := 1<<20 - ts[0].Bytes
+
+	var resp struct {
+		Granularity string
+		Series      map[string][]Usage
+	}
+	req := httptest.NewRequest(http.MethodGet, "/ticket/foo/usage?granularity=day", nil)
+	req.SetPathValue("token", "foo")
+	w := httptest.NewRecorder()
+	u.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Nil(t, json.NewDecoder(w.Body).Decode(&resp))
+
+	assert.Equal(t, "day", resp.Granularity)
+	assert.Equal(t, 1, len(resp.Series[ServiceDoH]))
+	assert.Equal(t, 1, resp.Series[ServiceDoH][0].Queries)
+	assert.Equal(t, 2, resp.Series[ServiceDoT][0].Queries)
+	assert.Equal(t, used, resp.Series[ServiceDoH][0].Bytes+resp.Series[ServiceDoT][0].Bytes)
+
+	req = httptest.NewRequest(http.MethodGet, "/ticket/foo/usage?granularity=week", nil)
+	req.SetPathValue("token", "foo")
+	w = httptest.NewRecorder()
+	u.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	req = httptest.NewRequest(http.MethodGet, "/ticket/bar/usage", nil)
+	req.SetPathValue("token", "bar")
+	w = httptest.NewRecorder()
+	u.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+func TestParseUsageTime(t *testing.T) {
+	ts, err := parseUsageTime("1735689600")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1735689600), ts.Unix())
+
+	ts, err = parseUsageTime("2025-01-01")
+	assert.Nil(t, err)
+	assert.Equal(t, time.Date(2025, 1, 1, 0, 0, 0, 0, time.Local), ts)
+
+	ts, err = parseUsageTime("2025-01-01T08:00:00+08:00")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1735689600), ts.Unix())
+
+	_, err = parseUsageTime("yesterday")
+	assert.NotNil(t, err)
+}
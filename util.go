@@ -4,9 +4,12 @@ import (
 	"encoding/base64"
 	"io"
 	"net/http"
+	"net/netip"
 	"strings"
 	"sync/atomic"
 	"time"
+
+	"github.com/miekg/dns"
 )
 
 type bytesCounter struct {
@@ -93,3 +96,46 @@ func parseBasicAuth(auth string) (username, password string, ok bool) {
 	}
 	return cs[:s], cs[s+1:], true
 }
+
+// ParsePrefixes parses comma separated prefixes like 10.0.0.0/8,::1, and a
+// single address is a full length prefix.
+func ParsePrefixes(s string) ([]netip.Prefix, error) {
+	var ps []netip.Prefix
+	for _, v := range strings.Split(s, ",") {
+		if v == "" {
+			continue
+		}
+		if ip, err := netip.ParseAddr(v); err == nil {
+			ip = ip.Unmap()
+			ps = append(ps, netip.PrefixFrom(ip, ip.BitLen()))
+			continue
+		}
+		p, err := netip.ParsePrefix(v)
+		if err != nil {
+			return nil, err
+		}
+		ps = append(ps, p.Masked())
+	}
+	return ps, nil
+}
+
+// setEDE attaches an Extended DNS Error to m, see RFC 8914.
+func setEDE(m *dns.Msg, code uint16, text string) {
+	opt := m.IsEdns0()
+	if opt == nil {
+		m.SetEdns0(dns.DefaultMsgSize, false)
+		opt = m.IsEdns0()
+	}
+	opt.Option = append(opt.Option, &dns.EDNS0_EDE{InfoCode: code, ExtraText: text})
+}
+
+func edes(m *dns.Msg) (es []*dns.EDNS0_EDE) {
+	if opt := m.IsEdns0(); opt != nil {
+		for _, o := range opt.Option {
+			if e, ok := o.(*dns.EDNS0_EDE); ok {
+				es = append(es, e)
+			}
+		}
+	}
+	return
+}